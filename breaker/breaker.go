@@ -0,0 +1,179 @@
+package breaker
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/cperez08/h2-proxy/config"
+)
+
+// ErrOpen is returned when a request waiting for a stream exceeds the max pending requests
+var ErrOpen = errors.New("[h2-proxy]: circuit breaker open")
+
+// Breaker limits the requests, pending requests, retries and connections of a cluster,
+// the requests over the thresholds fail fast. A nil breaker has no limits
+type Breaker struct {
+	cfg *config.CircuitBreakersConfig
+
+	m        sync.Mutex
+	requests int
+	pending  int // requests waiting for a free stream in the connections
+	retries  int
+	trips    Trips
+}
+
+// Trips counts the times every threshold was reached
+type Trips struct {
+	Requests        uint64 // the request was rejected
+	PendingRequests uint64 // the request waiting for a stream was rejected
+	Retries         uint64 // the retry was not done
+	Connections     uint64 // the connection was not opened
+}
+
+// New returns a new circuit breaker, nil when cfg is nil
+func New(cfg *config.CircuitBreakersConfig) *Breaker {
+	if cfg == nil {
+		return nil
+	}
+
+	return &Breaker{cfg: cfg}
+}
+
+// AcquireRequest takes a request slot, false when all of them are taken,
+// the slot must be released with ReleaseRequest
+func (b *Breaker) AcquireRequest() bool {
+	if b == nil {
+		return true
+	}
+
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	if b.requests >= b.cfg.MaxRequests {
+		b.trips.Requests++
+		return false
+	}
+
+	b.requests++
+	return true
+}
+
+// ReleaseRequest releases the request slot
+func (b *Breaker) ReleaseRequest() {
+	if b == nil {
+		return
+	}
+
+	b.m.Lock()
+	b.requests--
+	b.m.Unlock()
+}
+
+// AcquirePending takes a pending request slot while the request waits for a free stream in
+// the connections, false when all of them are taken. The slot must be released with ReleasePending
+func (b *Breaker) AcquirePending() bool {
+	if b == nil {
+		return true
+	}
+
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	// without max pending requests the requests never wait
+	if b.cfg.MaxPendingRequests == nil || b.pending >= *b.cfg.MaxPendingRequests {
+		b.trips.PendingRequests++
+		return false
+	}
+
+	b.pending++
+	return true
+}
+
+// ReleasePending releases the pending request slot
+func (b *Breaker) ReleasePending() {
+	if b == nil {
+		return
+	}
+
+	b.m.Lock()
+	b.pending--
+	b.m.Unlock()
+}
+
+// AcquireRetry takes a retry slot, false when all of them are taken,
+// the slot must be released with ReleaseRetry
+func (b *Breaker) AcquireRetry() bool {
+	if b == nil {
+		return true
+	}
+
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	if b.retries >= b.maxRetries() {
+		b.trips.Retries++
+		return false
+	}
+
+	b.retries++
+	return true
+}
+
+// maxRetries returns the concurrent retries allowed, with the retry budget they are
+// a percentage of the active requests, b.m must be held
+func (b *Breaker) maxRetries() int {
+	if b.cfg.RetryBudget == 0 {
+		return b.cfg.MaxRetries
+	}
+
+	max := int(b.cfg.RetryBudget * float64(b.requests) / 100)
+	if max < b.cfg.MinRetryConcurrency {
+		return b.cfg.MinRetryConcurrency
+	}
+
+	return max
+}
+
+// ReleaseRetry releases the retry slot
+func (b *Breaker) ReleaseRetry() {
+	if b == nil {
+		return
+	}
+
+	b.m.Lock()
+	b.retries--
+	b.m.Unlock()
+}
+
+// AllowConnections returns how many of the n new connections can be opened
+// when there are already connected ones
+func (b *Breaker) AllowConnections(connected, n int) int {
+	if b == nil {
+		return n
+	}
+
+	allowed := b.cfg.MaxConnections - connected
+	if allowed < 0 {
+		allowed = 0
+	}
+
+	if allowed >= n {
+		return n
+	}
+
+	b.m.Lock()
+	b.trips.Connections += uint64(n - allowed)
+	b.m.Unlock()
+	return allowed
+}
+
+// Trips returns the times every threshold was reached
+func (b *Breaker) Trips() Trips {
+	if b == nil {
+		return Trips{}
+	}
+
+	b.m.Lock()
+	defer b.m.Unlock()
+	return b.trips
+}
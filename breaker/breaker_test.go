@@ -0,0 +1,70 @@
+package breaker
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/cperez08/h2-proxy/config"
+)
+
+func TestRequests(t *testing.T) {
+	maxPending := 1
+	b := New(&config.CircuitBreakersConfig{MaxRequests: 1, MaxPendingRequests: &maxPending})
+	assert.True(t, b.AcquireRequest())
+
+	// the requests over the thresholds fail fast
+	assert.False(t, b.AcquireRequest())
+	assert.True(t, b.AcquirePending())
+	assert.False(t, b.AcquirePending())
+
+	b.ReleaseRequest()
+	b.ReleasePending()
+	assert.True(t, b.AcquireRequest())
+	assert.True(t, b.AcquirePending())
+	assert.Equal(t, Trips{Requests: 1, PendingRequests: 1}, b.Trips())
+
+	// without pending requests the requests never wait
+	maxPending = 0
+	b = New(&config.CircuitBreakersConfig{MaxRequests: 1, MaxPendingRequests: &maxPending})
+	assert.False(t, b.AcquirePending())
+	assert.False(t, New(&config.CircuitBreakersConfig{}).AcquirePending())
+}
+
+func TestRetriesAndConnections(t *testing.T) {
+	b := New(&config.CircuitBreakersConfig{MaxRetries: 1, MaxConnections: 3})
+	assert.True(t, b.AcquireRetry())
+	assert.False(t, b.AcquireRetry())
+	b.ReleaseRetry()
+	assert.True(t, b.AcquireRetry())
+
+	assert.Equal(t, 2, b.AllowConnections(1, 2))
+	assert.Equal(t, 1, b.AllowConnections(2, 4))
+	assert.Equal(t, 0, b.AllowConnections(4, 1))
+	assert.Equal(t, Trips{Retries: 1, Connections: 4}, b.Trips())
+
+	// a nil breaker has no limits
+	var nb *Breaker
+	assert.True(t, nb.AcquireRequest())
+	nb.ReleaseRequest()
+	assert.True(t, nb.AcquirePending())
+	nb.ReleasePending()
+	assert.True(t, nb.AcquireRetry())
+	nb.ReleaseRetry()
+	assert.Equal(t, 5, nb.AllowConnections(10, 5))
+	assert.Equal(t, Trips{}, nb.Trips())
+}
+
+func TestRetryBudget(t *testing.T) {
+	b := New(&config.CircuitBreakersConfig{MaxRequests: 100, RetryBudget: 20, MinRetryConcurrency: 1})
+	// the min retry concurrency is allowed without active requests
+	assert.True(t, b.AcquireRetry())
+	assert.False(t, b.AcquireRetry())
+
+	for i := 0; i < 10; i++ {
+		assert.True(t, b.AcquireRequest())
+	}
+	assert.True(t, b.AcquireRetry())
+	assert.False(t, b.AcquireRetry())
+	assert.Equal(t, uint64(2), b.Trips().Retries)
+}
@@ -0,0 +1,69 @@
+package certs
+
+import (
+	"crypto/tls"
+	"fmt"
+	"strings"
+)
+
+const spiffeScheme = "spiffe"
+
+// Identity represents the verified identity of a client certificate
+type Identity struct {
+	Subject  string
+	URIs     []string
+	DNSNames []string
+}
+
+// PeerIdentity returns the identity of the verified client certificate,
+// nil is returned when the client did not present a verified certificate
+func PeerIdentity(state *tls.ConnectionState) *Identity {
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.PeerCertificates) == 0 {
+		return nil
+	}
+
+	cert := state.PeerCertificates[0]
+	id := &Identity{Subject: cert.Subject.String(), DNSNames: cert.DNSNames}
+	for _, u := range cert.URIs {
+		id.URIs = append(id.URIs, u.String())
+	}
+
+	return id
+}
+
+// SPIFFEID returns the first SPIFFE URI found in the certificate SANs
+func (i *Identity) SPIFFEID() string {
+	for _, u := range i.URIs {
+		if strings.HasPrefix(u, spiffeScheme+"://") {
+			return u
+		}
+	}
+
+	return ""
+}
+
+// ID returns a short representation of the identity, the SPIFFE ID
+// when present otherwise the certificate subject
+func (i *Identity) ID() string {
+	if id := i.SPIFFEID(); id != "" {
+		return id
+	}
+
+	return i.Subject
+}
+
+// String returns the identity in the format used to forward it to the target
+// e.g. Subject="CN=users,O=acme";URI=spiffe://cluster.local/ns/default/sa/users;DNS=users.svc
+func (i *Identity) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Subject=%q", i.Subject)
+	for _, u := range i.URIs {
+		b.WriteString(";URI=" + u)
+	}
+
+	for _, d := range i.DNSNames {
+		b.WriteString(";DNS=" + d)
+	}
+
+	return b.String()
+}
@@ -0,0 +1,52 @@
+package certs
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPeerIdentity(t *testing.T) {
+	assert.Nil(t, PeerIdentity(nil))
+	assert.Nil(t, PeerIdentity(&tls.ConnectionState{}))
+
+	cert := loadCert(t, "testdata/client.pem")
+	// not verified certificates are ignored
+	assert.Nil(t, PeerIdentity(&tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}))
+
+	id := PeerIdentity(&tls.ConnectionState{
+		PeerCertificates: []*x509.Certificate{cert},
+		VerifiedChains:   [][]*x509.Certificate{{cert}},
+	})
+	if id == nil {
+		t.Log("expecting identity")
+		t.FailNow()
+	}
+
+	assert.Equal(t, "CN=users-client,O=h2-proxy", id.Subject)
+	assert.Equal(t, "spiffe://cluster.local/ns/default/sa/users", id.SPIFFEID())
+	assert.Equal(t, "spiffe://cluster.local/ns/default/sa/users", id.ID())
+	assert.Equal(t, `Subject="CN=users-client,O=h2-proxy";URI=spiffe://cluster.local/ns/default/sa/users;DNS=users.default.svc`, id.String())
+
+	id = &Identity{Subject: "CN=other", URIs: []string{"https://other"}}
+	assert.Equal(t, "", id.SPIFFEID())
+	assert.Equal(t, "CN=other", id.ID())
+}
+
+func loadCert(t *testing.T, file string) *x509.Certificate {
+	pair, err := tls.LoadX509KeyPair(file, "testdata/client-key.pem")
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+
+	return cert
+}
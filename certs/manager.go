@@ -0,0 +1,199 @@
+package certs
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// Manager keeps the certificate and the CA bundle loaded from disk,
+// the files are watched and swapped atomically when they change
+type Manager struct {
+	certFile string
+	keyFile  string
+	caFile   string
+
+	m        sync.RWMutex
+	cert     *tls.Certificate
+	pool     *x509.CertPool
+	modTimes map[string]fileVersion
+}
+
+// fileVersion identifies a version of a file on disk
+type fileVersion struct {
+	modTime time.Time
+	size    int64
+}
+
+// NewManager returns a new Manager with the files already loaded, certFile/keyFile
+// and caFile are optional but at least one of them needs to be set
+func NewManager(certFile, keyFile, caFile string) (*Manager, error) {
+	if certFile == "" && keyFile == "" && caFile == "" {
+		return nil, errors.New("[h2-proxy]: no certificate files to manage")
+	}
+
+	m := &Manager{certFile: certFile, keyFile: keyFile, caFile: caFile}
+	if _, err := m.Reload(); err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+// Watch checks every interval if the files changed reloading them, it stops when ctx is done
+func (m *Manager) Watch(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			reloaded, err := m.Reload()
+			if err != nil {
+				// the previous certificates are kept until the files are valid again
+				log.Println("error reloading certificates", err)
+			} else if reloaded {
+				log.Println("certificates reloaded", m.certFile, m.caFile)
+			}
+		}
+	}
+}
+
+// Reload loads the files again if any of them changed since the last load
+func (m *Manager) Reload() (bool, error) {
+	versions, err := m.versions()
+	if err != nil {
+		return false, err
+	}
+
+	m.m.RLock()
+	changed := !sameVersions(versions, m.modTimes)
+	m.m.RUnlock()
+	if !changed {
+		return false, nil
+	}
+
+	var cert *tls.Certificate
+	if m.certFile != "" || m.keyFile != "" {
+		c, err := tls.LoadX509KeyPair(m.certFile, m.keyFile)
+		if err != nil {
+			return false, fmt.Errorf("[h2-proxy]: error loading certificate %w", err)
+		}
+		cert = &c
+	}
+
+	var pool *x509.CertPool
+	if m.caFile != "" {
+		if pool, err = loadCertPool(m.caFile); err != nil {
+			return false, err
+		}
+	}
+
+	m.m.Lock()
+	m.cert = cert
+	m.pool = pool
+	m.modTimes = versions
+	m.m.Unlock()
+
+	return true, nil
+}
+
+// Certificate returns the current certificate
+func (m *Manager) Certificate() *tls.Certificate {
+	m.m.RLock()
+	defer m.m.RUnlock()
+	return m.cert
+}
+
+// CertPool returns the current CA bundle, nil when no CA file is managed
+func (m *Manager) CertPool() *x509.CertPool {
+	m.m.RLock()
+	defer m.m.RUnlock()
+	return m.pool
+}
+
+// GetCertificate implements tls.Config.GetCertificate
+func (m *Manager) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if c := m.Certificate(); c != nil {
+		return c, nil
+	}
+
+	return nil, errors.New("[h2-proxy]: no certificate available")
+}
+
+// GetClientCertificate implements tls.Config.GetClientCertificate
+func (m *Manager) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	if c := m.Certificate(); c != nil {
+		return c, nil
+	}
+
+	// no certificate is sent to the server
+	return &tls.Certificate{}, nil
+}
+
+// VerifyPeerCertificate returns a tls.Config.VerifyPeerCertificate function that verifies
+// the server certificate against the current CA bundle, system pool is used when there is no CA
+func (m *Manager) VerifyPeerCertificate(serverName string) func([][]byte, [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return errors.New("[h2-proxy]: no certificate presented by the target")
+		}
+
+		opts := x509.VerifyOptions{Roots: m.CertPool(), DNSName: serverName, Intermediates: x509.NewCertPool()}
+		var leaf *x509.Certificate
+		for i, raw := range rawCerts {
+			c, err := x509.ParseCertificate(raw)
+			if err != nil {
+				return fmt.Errorf("[h2-proxy]: invalid target certificate %w", err)
+			}
+
+			if i == 0 {
+				leaf = c
+				continue
+			}
+			opts.Intermediates.AddCert(c)
+		}
+
+		_, err := leaf.Verify(opts)
+		return err
+	}
+}
+
+func (m *Manager) versions() (map[string]fileVersion, error) {
+	versions := make(map[string]fileVersion, 3)
+	for _, f := range []string{m.certFile, m.keyFile, m.caFile} {
+		if f == "" {
+			continue
+		}
+
+		info, err := os.Stat(f)
+		if err != nil {
+			return nil, fmt.Errorf("[h2-proxy]: error reading certificate file %w", err)
+		}
+		versions[f] = fileVersion{modTime: info.ModTime(), size: info.Size()}
+	}
+
+	return versions, nil
+}
+
+func sameVersions(a, b map[string]fileVersion) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for f, v := range a {
+		if o, ok := b[f]; !ok || !o.modTime.Equal(v.modTime) || o.size != v.size {
+			return false
+		}
+	}
+
+	return true
+}
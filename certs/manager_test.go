@@ -0,0 +1,169 @@
+package certs
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var copies int
+
+func TestNewManager(t *testing.T) {
+	_, err := NewManager("", "", "")
+	assert.Error(t, err)
+
+	_, err = NewManager(serverCert, "testdata/noexists.pem", "")
+	assert.Error(t, err)
+
+	_, err = NewManager(serverCert, serverKey, serverKey)
+	assert.Error(t, err)
+
+	m, err := NewManager("", "", "testdata/ca.pem")
+	if err != nil {
+		t.Log("unexpected error creating manager", err)
+		t.FailNow()
+	}
+
+	assert.NotNil(t, m.CertPool())
+	assert.Nil(t, m.Certificate())
+
+	_, err = m.GetCertificate(nil)
+	assert.Error(t, err)
+
+	// no client certificate is sent
+	c, err := m.GetClientCertificate(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(c.Certificate))
+}
+
+func TestManagerReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "h2-proxy-certs")
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	defer os.RemoveAll(dir)
+
+	cert, key := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	copyFile(t, serverCert, cert)
+	copyFile(t, serverKey, key)
+
+	m, err := NewManager(cert, key, "")
+	if err != nil {
+		t.Log("unexpected error creating manager", err)
+		t.FailNow()
+	}
+
+	assert.Equal(t, "server", leaf(t, m).Subject.CommonName)
+
+	reloaded, err := m.Reload()
+	assert.NoError(t, err)
+	assert.False(t, reloaded)
+
+	// a broken pair keeps the previous certificate
+	copyFile(t, "testdata/server2.pem", cert)
+	reloaded, err = m.Reload()
+	assert.Error(t, err)
+	assert.False(t, reloaded)
+	assert.Equal(t, "server", leaf(t, m).Subject.CommonName)
+
+	copyFile(t, "testdata/server2-key.pem", key)
+	reloaded, err = m.Reload()
+	assert.NoError(t, err)
+	assert.True(t, reloaded)
+	assert.Equal(t, "server2", leaf(t, m).Subject.CommonName)
+
+	os.Remove(key)
+	_, err = m.Reload()
+	assert.Error(t, err)
+	c, err := m.GetCertificate(nil)
+	assert.NoError(t, err)
+	assert.NotNil(t, c)
+}
+
+func TestManagerWatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "h2-proxy-certs")
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	defer os.RemoveAll(dir)
+
+	cert, key := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	copyFile(t, serverCert, cert)
+	copyFile(t, serverKey, key)
+
+	m, err := NewManager(cert, key, "")
+	if err != nil {
+		t.Log("unexpected error creating manager", err)
+		t.FailNow()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go m.Watch(ctx, 10*time.Millisecond)
+
+	copyFile(t, "testdata/server2-key.pem", key)
+	copyFile(t, "testdata/server2.pem", cert)
+
+	for i := 0; i < 100 && leaf(t, m).Subject.CommonName != "server2"; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	assert.Equal(t, "server2", leaf(t, m).Subject.CommonName)
+}
+
+func TestVerifyPeerCertificate(t *testing.T) {
+	m, err := NewManager("", "", "testdata/ca.pem")
+	if err != nil {
+		t.Log("unexpected error creating manager", err)
+		t.FailNow()
+	}
+
+	pair, err := tls.LoadX509KeyPair(serverCert, serverKey)
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+
+	assert.NoError(t, m.VerifyPeerCertificate("localhost")(pair.Certificate, nil))
+	assert.Error(t, m.VerifyPeerCertificate("other-host")(pair.Certificate, nil))
+	assert.Error(t, m.VerifyPeerCertificate("localhost")(nil, nil))
+	assert.Error(t, m.VerifyPeerCertificate("localhost")([][]byte{[]byte("invalid")}, nil))
+}
+
+func leaf(t *testing.T, m *Manager) *x509.Certificate {
+	c, err := x509.ParseCertificate(m.Certificate().Certificate[0])
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+
+	return c
+}
+
+// copyFile copies the file moving its modification time forward
+// to make sure the change is detected
+func copyFile(t *testing.T, src, dst string) {
+	b, err := ioutil.ReadFile(src)
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+
+	if err := ioutil.WriteFile(dst, b, 0600); err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+
+	copies++
+	next := time.Now().Add(time.Duration(copies) * time.Second)
+	os.Chtimes(dst, next, next)
+}
@@ -0,0 +1,186 @@
+package certs
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"golang.org/x/net/http2"
+
+	"github.com/cperez08/h2-proxy/config"
+)
+
+var versions = map[string]uint16{
+	"":    tls.VersionTLS12,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// NewServerTLSConfig returns the tls configuration used to terminate TLS
+// in the downstream listener, h2 is the only protocol negotiated via ALPN.
+// The certificate and the client CA bundle are reloaded when they change on disk
+func NewServerTLSConfig(ctx context.Context, cfg *config.TLSConfig) (*tls.Config, error) {
+	if cfg.CertFile == "" || cfg.KeyFile == "" {
+		return nil, errors.New("[h2-proxy]: tls cert_file and key_file are mandatory")
+	}
+
+	minVersion, err := parseVersion(cfg.MinVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	ciphers, err := parseCipherSuites(cfg.CipherSuites)
+	if err != nil {
+		return nil, err
+	}
+
+	clientAuth := tls.NoClientCert
+	if cfg.ClientCAFile != "" {
+		if clientAuth, err = parseClientAuth(cfg.ClientAuth); err != nil {
+			return nil, err
+		}
+	}
+
+	m, err := NewManager(cfg.CertFile, cfg.KeyFile, cfg.ClientCAFile)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsCfg := &tls.Config{
+		GetCertificate: m.GetCertificate,
+		MinVersion:     minVersion,
+		CipherSuites:   ciphers,
+		ClientAuth:     clientAuth,
+		NextProtos:     []string{http2.NextProtoTLS},
+	}
+
+	if cfg.ClientCAFile != "" {
+		base := tlsCfg.Clone()
+		// the client CA bundle can change so it is set on every handshake
+		tlsCfg.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			c := base.Clone()
+			c.ClientCAs = m.CertPool()
+			return c, nil
+		}
+	}
+
+	watch(ctx, m, cfg.ReloadInterval)
+	return tlsCfg, nil
+}
+
+// NewClientTLSConfig returns the tls configuration used to originate TLS
+// to the target, serverName is used for SNI unless it is overridden.
+// The client certificate and the CA bundle are reloaded when they change on disk
+func NewClientTLSConfig(ctx context.Context, cfg *config.UpstreamTLSConfig, serverName string) (*tls.Config, error) {
+	tlsCfg := &tls.Config{
+		ServerName:         serverName,
+		InsecureSkipVerify: cfg.InsecureSkipVerify,
+		MinVersion:         tls.VersionTLS12,
+		NextProtos:         []string{http2.NextProtoTLS},
+	}
+
+	if cfg.ServerName != "" {
+		tlsCfg.ServerName = cfg.ServerName
+	}
+
+	if cfg.CAFile == "" && cfg.CertFile == "" && cfg.KeyFile == "" {
+		return tlsCfg, nil
+	}
+
+	m, err := NewManager(cfg.CertFile, cfg.KeyFile, cfg.CAFile)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.CertFile != "" || cfg.KeyFile != "" {
+		tlsCfg.GetClientCertificate = m.GetClientCertificate
+	}
+
+	if cfg.CAFile != "" && !cfg.InsecureSkipVerify {
+		// the default verification is replaced by the one using
+		// the current CA bundle since it can change on disk
+		tlsCfg.InsecureSkipVerify = true
+		tlsCfg.VerifyPeerCertificate = m.VerifyPeerCertificate(tlsCfg.ServerName)
+	}
+
+	watch(ctx, m, cfg.ReloadInterval)
+	return tlsCfg, nil
+}
+
+// watch starts watching the manager files, a non positive interval disables it
+func watch(ctx context.Context, m *Manager, interval int) {
+	if interval > 0 {
+		go m.Watch(ctx, time.Second*time.Duration(interval))
+	}
+}
+
+func loadCertPool(file string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("[h2-proxy]: error reading CA bundle %w", err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("[h2-proxy]: no valid certificates found in %s", file)
+	}
+
+	return pool, nil
+}
+
+func parseClientAuth(a string) (tls.ClientAuthType, error) {
+	switch a {
+	case "", "require":
+		return tls.RequireAndVerifyClientCert, nil
+	case "optional":
+		return tls.VerifyClientCertIfGiven, nil
+	default:
+		return tls.NoClientCert, fmt.Errorf("[h2-proxy]: unsupported client auth %s", a)
+	}
+}
+
+func parseVersion(v string) (uint16, error) {
+	version, ok := versions[v]
+	if !ok {
+		return 0, fmt.Errorf("[h2-proxy]: unsupported tls version %s", v)
+	}
+
+	return version, nil
+}
+
+// parseCipherSuites maps the IANA names to the cipher suite ids, at least one of
+// the cipher suites required by http2 (RFC 7540 section 9.2.2) needs to be present
+func parseCipherSuites(names []string) ([]uint16, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+
+	available := make(map[string]uint16)
+	for _, c := range tls.CipherSuites() {
+		available[c.Name] = c.ID
+	}
+
+	var ids []uint16
+	var h2Compliant bool
+	for _, n := range names {
+		id, ok := available[n]
+		if !ok {
+			return nil, fmt.Errorf("[h2-proxy]: unsupported cipher suite %s", n)
+		}
+
+		if id == tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 || id == tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256 {
+			h2Compliant = true
+		}
+		ids = append(ids, id)
+	}
+
+	if !h2Compliant {
+		return nil, errors.New("[h2-proxy]: cipher suites must include TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 or TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256")
+	}
+
+	return ids, nil
+}
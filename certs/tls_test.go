@@ -0,0 +1,148 @@
+package certs
+
+import (
+	"context"
+	"crypto/tls"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/cperez08/h2-proxy/config"
+)
+
+var ctx = context.Background()
+
+const (
+	serverCert = "testdata/server.pem"
+	serverKey  = "testdata/server-key.pem"
+)
+
+func TestNewServerTLSConfig(t *testing.T) {
+	cfg, err := NewServerTLSConfig(ctx, &config.TLSConfig{CertFile: serverCert, KeyFile: serverKey})
+	if err != nil {
+		t.Log("unexpected error creating tls config", err)
+		t.FailNow()
+	}
+
+	cert, err := cfg.GetCertificate(nil)
+	assert.NoError(t, err)
+	assert.NotNil(t, cert)
+	assert.Equal(t, []string{"h2"}, cfg.NextProtos)
+	assert.Equal(t, uint16(tls.VersionTLS12), cfg.MinVersion)
+	assert.Nil(t, cfg.CipherSuites)
+
+	cfg, err = NewServerTLSConfig(ctx, &config.TLSConfig{
+		CertFile:     serverCert,
+		KeyFile:      serverKey,
+		MinVersion:   "1.3",
+		CipherSuites: []string{"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256", "TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384"},
+	})
+	if err != nil {
+		t.Log("unexpected error creating tls config", err)
+		t.FailNow()
+	}
+
+	assert.Equal(t, uint16(tls.VersionTLS13), cfg.MinVersion)
+	assert.Equal(t, []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384}, cfg.CipherSuites)
+	assert.Equal(t, tls.NoClientCert, cfg.ClientAuth)
+}
+
+func TestNewServerTLSConfigClientAuth(t *testing.T) {
+	cfg, err := NewServerTLSConfig(ctx, &config.TLSConfig{CertFile: serverCert, KeyFile: serverKey, ClientCAFile: "testdata/ca.pem"})
+	if err != nil {
+		t.Log("unexpected error creating tls config", err)
+		t.FailNow()
+	}
+
+	assert.Equal(t, tls.RequireAndVerifyClientCert, cfg.ClientAuth)
+	forClient, err := cfg.GetConfigForClient(nil)
+	assert.NoError(t, err)
+	assert.NotNil(t, forClient.ClientCAs)
+	assert.Equal(t, tls.RequireAndVerifyClientCert, forClient.ClientAuth)
+
+	cfg, err = NewServerTLSConfig(ctx, &config.TLSConfig{CertFile: serverCert, KeyFile: serverKey, ClientCAFile: "testdata/ca.pem", ClientAuth: "optional"})
+	if err != nil {
+		t.Log("unexpected error creating tls config", err)
+		t.FailNow()
+	}
+
+	assert.Equal(t, tls.VerifyClientCertIfGiven, cfg.ClientAuth)
+
+	_, err = NewServerTLSConfig(ctx, &config.TLSConfig{CertFile: serverCert, KeyFile: serverKey, ClientCAFile: "testdata/ca.pem", ClientAuth: "always"})
+	assert.Error(t, err)
+
+	_, err = NewServerTLSConfig(ctx, &config.TLSConfig{CertFile: serverCert, KeyFile: serverKey, ClientCAFile: "testdata/noexists.pem"})
+	assert.Error(t, err)
+}
+
+func TestNewServerTLSConfigErrors(t *testing.T) {
+	_, err := NewServerTLSConfig(ctx, &config.TLSConfig{CertFile: serverCert})
+	assert.Error(t, err)
+
+	_, err = NewServerTLSConfig(ctx, &config.TLSConfig{CertFile: serverCert, KeyFile: "testdata/noexists.pem"})
+	assert.Error(t, err)
+
+	_, err = NewServerTLSConfig(ctx, &config.TLSConfig{CertFile: serverCert, KeyFile: serverKey, MinVersion: "1.0"})
+	assert.Error(t, err)
+
+	_, err = NewServerTLSConfig(ctx, &config.TLSConfig{CertFile: serverCert, KeyFile: serverKey, CipherSuites: []string{"TLS_FAKE"}})
+	assert.Error(t, err)
+
+	// not allowed by http2
+	_, err = NewServerTLSConfig(ctx, &config.TLSConfig{CertFile: serverCert, KeyFile: serverKey, CipherSuites: []string{"TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384"}})
+	assert.Error(t, err)
+}
+
+func TestNewClientTLSConfig(t *testing.T) {
+	cfg, err := NewClientTLSConfig(ctx, &config.UpstreamTLSConfig{}, "my-target")
+	if err != nil {
+		t.Log("unexpected error creating tls config", err)
+		t.FailNow()
+	}
+
+	assert.Equal(t, "my-target", cfg.ServerName)
+	assert.Equal(t, []string{"h2"}, cfg.NextProtos)
+	assert.False(t, cfg.InsecureSkipVerify)
+	assert.Nil(t, cfg.GetClientCertificate)
+	assert.Nil(t, cfg.VerifyPeerCertificate)
+
+	cfg, err = NewClientTLSConfig(ctx, &config.UpstreamTLSConfig{
+		CAFile:             "testdata/ca.pem",
+		ServerName:         "localhost",
+		CertFile:           serverCert,
+		KeyFile:            serverKey,
+		InsecureSkipVerify: true,
+	}, "my-target")
+	if err != nil {
+		t.Log("unexpected error creating tls config", err)
+		t.FailNow()
+	}
+
+	assert.Equal(t, "localhost", cfg.ServerName)
+	assert.NotNil(t, cfg.GetClientCertificate)
+	assert.True(t, cfg.InsecureSkipVerify)
+	// verification disabled on purpose
+	assert.Nil(t, cfg.VerifyPeerCertificate)
+
+	cfg, err = NewClientTLSConfig(ctx, &config.UpstreamTLSConfig{CAFile: "testdata/ca.pem"}, "localhost")
+	if err != nil {
+		t.Log("unexpected error creating tls config", err)
+		t.FailNow()
+	}
+
+	// the target is verified against the managed CA bundle
+	assert.True(t, cfg.InsecureSkipVerify)
+	assert.NotNil(t, cfg.VerifyPeerCertificate)
+}
+
+func TestNewClientTLSConfigErrors(t *testing.T) {
+	_, err := NewClientTLSConfig(ctx, &config.UpstreamTLSConfig{CAFile: "testdata/noexists.pem"}, "")
+	assert.Error(t, err)
+
+	// a private key is not a valid CA bundle
+	_, err = NewClientTLSConfig(ctx, &config.UpstreamTLSConfig{CAFile: serverKey}, "")
+	assert.Error(t, err)
+
+	_, err = NewClientTLSConfig(ctx, &config.UpstreamTLSConfig{CertFile: serverCert}, "")
+	assert.Error(t, err)
+}
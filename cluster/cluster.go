@@ -0,0 +1,79 @@
+package cluster
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+
+	"golang.org/x/net/http2"
+
+	"github.com/cperez08/h2-proxy/breaker"
+	"github.com/cperez08/h2-proxy/certs"
+	"github.com/cperez08/h2-proxy/config"
+	"github.com/cperez08/h2-proxy/pool"
+)
+
+const (
+	httpScheme  = "http"
+	httpsScheme = "https"
+)
+
+// Cluster is a named group of upstream endpoints with its own
+// connection pool, balancer and DNS configuration
+type Cluster struct {
+	Name      string
+	Authority string // target host:port used in the proxied requests
+	Scheme    string
+	Client    *http.Client
+	Breaker   *breaker.Breaker // nil when the circuit breakers are not enabled
+}
+
+// NewCluster creates the transport and the connection pool for the cluster
+func NewCluster(ctx context.Context, cfg *config.ClusterConfig) (*Cluster, error) {
+	t := &http2.Transport{
+		DisableCompression: true,
+		AllowHTTP:          true,
+		DialTLS: func(netw, addr string, cfg *tls.Config) (net.Conn, error) {
+			return net.Dial(netw, addr)
+		},
+	}
+
+	scheme := httpScheme
+	if cfg.UpstreamTLS != nil {
+		tlsCfg, err := certs.NewClientTLSConfig(ctx, cfg.UpstreamTLS, cfg.TargetHost)
+		if err != nil {
+			return nil, err
+		}
+		t.TLSClientConfig = tlsCfg
+		scheme = httpsScheme
+	}
+
+	p, err := pool.NewConnectionPool(ctx, cfg, t)
+	if err != nil {
+		return nil, fmt.Errorf("[h2-proxy]: error creating cluster %s %w", cfg.Name, err)
+	}
+
+	return &Cluster{
+		Name:      cfg.Name,
+		Authority: net.JoinHostPort(cfg.TargetHost, cfg.TargetPort),
+		Scheme:    scheme,
+		Client:    &http.Client{Transport: t},
+		Breaker:   p.Breaker(),
+	}, nil
+}
+
+// NewClusters creates all the clusters indexed by name
+func NewClusters(ctx context.Context, cfgs []*config.ClusterConfig) (map[string]*Cluster, error) {
+	clusters := make(map[string]*Cluster, len(cfgs))
+	for _, cfg := range cfgs {
+		c, err := NewCluster(ctx, cfg)
+		if err != nil {
+			return nil, err
+		}
+		clusters[c.Name] = c
+	}
+
+	return clusters, nil
+}
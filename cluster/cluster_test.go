@@ -0,0 +1,52 @@
+package cluster
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/cperez08/h2-proxy/config"
+)
+
+func TestNewClusters(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	defer l.Close()
+
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	cfgs := []*config.ClusterConfig{
+		{Name: "users", TargetHost: "127.0.0.1", TargetPort: port},
+		{Name: "orders", TargetHost: "127.0.0.1", TargetPort: port},
+	}
+	for _, c := range cfgs {
+		c.SetDefaults()
+	}
+
+	clusters, err := NewClusters(ctx, cfgs)
+	if err != nil {
+		t.Log("unexpected error creating clusters", err)
+		t.FailNow()
+	}
+
+	assert.Equal(t, 2, len(clusters))
+	assert.Equal(t, "127.0.0.1:"+port, clusters["users"].Authority)
+	assert.Equal(t, "http", clusters["users"].Scheme)
+	assert.NotNil(t, clusters["users"].Client)
+
+	cfgs[1].TargetPort = "1"
+	_, err = NewClusters(ctx, cfgs)
+	assert.Error(t, err)
+
+	cfgs[1].TargetPort = port
+	cfgs[1].UpstreamTLS = &config.UpstreamTLSConfig{CAFile: "noexists.pem"}
+	_, err = NewClusters(ctx, cfgs)
+	assert.Error(t, err)
+}
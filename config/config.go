@@ -1,22 +1,259 @@
 package config
 
+import (
+	"math"
+	"net"
+)
+
+// DefaultCluster is the name of the cluster built from the target values
+const DefaultCluster = "default"
+
 // ProxyConfig ...
 type ProxyConfig struct {
-	ProxyName   string     `yaml:"proxy_name"`
-	ProxyAddres string     `yaml:"proxy_address"`
-	IdleTimeout int        `yaml:"idle_timeout"`
-	TargetHost  string     `yaml:"target_host"`
-	TargetPort  string     `yaml:"target_port"`
-	PrintLogs   bool       `yaml:"print_logs"`
-	CompactLogs bool       `yaml:"compact_logs"`
-	DNSConfig   *DNSConfig `yaml:"dns_config"`
+	ProxyName        string                  `yaml:"proxy_name"`
+	ProxyAddres      string                  `yaml:"proxy_address"`
+	IdleTimeout      int                     `yaml:"idle_timeout"`
+	MaxConnections   int                     `yaml:"max_connections"` // maximum number of concurrent downstream connections, 0 means unlimited
+	TargetHost       string                  `yaml:"target_host"`
+	TargetPort       string                  `yaml:"target_port"`
+	PrintLogs        bool                    `yaml:"print_logs"`
+	CompactLogs      bool                    `yaml:"compact_logs"`
+	DNSConfig        *DNSConfig              `yaml:"dns_config"`
+	TLS              *TLSConfig              `yaml:"tls"`               // enables TLS termination in the downstream listener
+	UpstreamTLS      *UpstreamTLSConfig      `yaml:"upstream_tls"`      // enables TLS in the connections to the target
+	Clusters         []*ClusterConfig        `yaml:"clusters"`          // upstream clusters, by default one cluster is built with the target values
+	Routes           []*RouteConfig          `yaml:"routes"`            // routes evaluated in order, by default everything goes to the first cluster
+	VirtualHosts     []*VirtualHostConfig    `yaml:"virtual_hosts"`     // route tables selected by the :authority, routes are used when no virtual host matches
+	Zone             string                  `yaml:"zone"`              // zone where the proxy runs, used by the zone aware balancing
+	HealthCheck      *HealthCheckConfig      `yaml:"health_check"`      // enables the active health checking of the targets
+	OutlierDetection *OutlierDetectionConfig `yaml:"outlier_detection"` // ejects temporarily the targets failing the requests
+	CircuitBreakers  *CircuitBreakersConfig  `yaml:"circuit_breakers"`  // limits the requests and connections to the target
+	RateLimit        *RateLimitConfig        `yaml:"rate_limit"`        // limits the requests per second of the listener
+	GlobalRateLimit  *GlobalRateLimitConfig  `yaml:"global_rate_limit"` // rate limit service shared by the proxy replicas
+}
+
+// GlobalRateLimitConfig the routes with rate limit descriptors ask the rate limit service, speaking the
+// Envoy ratelimit gRPC protocol, whether the request is over the limit
+type GlobalRateLimitConfig struct {
+	Cluster     string `yaml:"cluster"`      // cluster of the rate limit service, mandatory
+	Domain      string `yaml:"domain"`       // domain of the descriptors in the rate limit service, mandatory
+	Timeout     int    `yaml:"timeout"`      // value in milliseconds, default value is 100
+	FailureMode string `yaml:"failure_mode"` // allow (fail open) or deny (fail closed) the requests when the service fails, default allow
+	CacheTTL    int    `yaml:"cache_ttl"`    // milliseconds an over limit answer is cached when the service does not send the reset time, default value is 1000, a negative value disables the cache
+}
+
+// VirtualHostConfig ...
+type VirtualHostConfig struct {
+	Name         string         `yaml:"name"`
+	Domains      []string       `yaml:"domains"`       // exact (api.example.com), wildcard suffix (*.example.com) or * (default)
+	Routes       []*RouteConfig `yaml:"routes"`        // routes evaluated in order
+	PreserveHost bool           `yaml:"preserve_host"` // sends the client :authority to the target instead of the cluster host
+}
+
+// ClusterConfig ...
+type ClusterConfig struct {
+	Name             string                  `yaml:"name"`
+	TargetHost       string                  `yaml:"target_host"`
+	TargetPort       string                  `yaml:"target_port"`
+	DNSConfig        *DNSConfig              `yaml:"dns_config"`
+	UpstreamTLS      *UpstreamTLSConfig      `yaml:"upstream_tls"`
+	Endpoints        []*EndpointConfig       `yaml:"endpoints"` // static list of target addresses, the target host is not resolved
+	HealthCheck      *HealthCheckConfig      `yaml:"health_check"`
+	OutlierDetection *OutlierDetectionConfig `yaml:"outlier_detection"`
+	CircuitBreakers  *CircuitBreakersConfig  `yaml:"circuit_breakers"`
+}
+
+// CircuitBreakersConfig the requests over the thresholds fail fast with UNAVAILABLE (503)
+type CircuitBreakersConfig struct {
+	MaxRequests         int     `yaml:"max_requests"`          // concurrent requests to the cluster, default value is 1024
+	MaxPendingRequests  *int    `yaml:"max_pending_requests"`  // requests waiting for a free stream in the connections, default value is 1024, 0 fails them right away
+	MaxRetries          int     `yaml:"max_retries"`           // concurrent retries to the cluster, default value is 3
+	MaxConnections      int     `yaml:"max_connections"`       // connections to the targets of the cluster, default value is 1024
+	RetryBudget         float64 `yaml:"retry_budget"`          // percentage of the active requests that can be retries, replaces max_retries when set
+	MinRetryConcurrency int     `yaml:"min_retry_concurrency"` // concurrent retries allowed by the retry budget regardless of the active requests, default value is 3
+}
+
+// OutlierDetectionConfig the targets failing the proxied requests are ejected from the balancing,
+// every time a target is ejected again the ejection time is doubled
+type OutlierDetectionConfig struct {
+	Consecutive5xx             int     `yaml:"consecutive_5xx"`              // consecutive 5xx responses, default value is 5
+	ConsecutiveGRPCErrors      int     `yaml:"consecutive_grpc_errors"`      // consecutive UNAVAILABLE or INTERNAL statuses, default value is 5
+	ConsecutiveConnectFailures int     `yaml:"consecutive_connect_failures"` // consecutive requests not sent to the target, default value is 5
+	Interval                   int     `yaml:"interval"`                     // seconds between the success rate analysis, default value is 10
+	BaseEjectionTime           int     `yaml:"base_ejection_time"`           // value in seconds, default value is 30
+	MaxEjectionTime            int     `yaml:"max_ejection_time"`            // value in seconds, default value is 300
+	MaxEjectionPercent         float64 `yaml:"max_ejection_percent"`         // maximum percentage of the targets ejected, default value is 10
+	SuccessRateMinHosts        int     `yaml:"success_rate_min_hosts"`       // targets with enough requests to analyze the success rate, default value is 5
+	SuccessRateRequestVolume   int     `yaml:"success_rate_request_volume"`  // requests in the interval to include a target, default value is 100
+	SuccessRateStdevFactor     float64 `yaml:"success_rate_stdev_factor"`    // targets below mean - factor * stdev are ejected, default value is 1.9
+}
+
+// HealthCheckConfig the targets are probed periodically and the unhealthy ones are not balanced
+type HealthCheckConfig struct {
+	Type               string `yaml:"type"`                // grpc (grpc.health.v1.Health/Check), http (GET path) or tcp (connect), default grpc
+	Interval           int    `yaml:"interval"`            // value in seconds, default value is 10
+	Timeout            int    `yaml:"timeout"`             // value in milliseconds, default value is 1000
+	HealthyThreshold   int    `yaml:"healthy_threshold"`   // consecutive successes to mark an unhealthy target healthy, default value is 2
+	UnhealthyThreshold int    `yaml:"unhealthy_threshold"` // consecutive failures to mark a healthy target unhealthy, default value is 3
+	Path               string `yaml:"path"`                // path of the http probe, default value is /health
+	Service            string `yaml:"service"`             // service of the gRPC probe, empty checks the whole server
+}
+
+// EndpointConfig ...
+type EndpointConfig struct {
+	Address  string            `yaml:"address"`  // host:port
+	Weight   int               `yaml:"weight"`   // used by the weighted balancers, default value is 1
+	Zone     string            `yaml:"zone"`     // used by the zone aware balancing
+	Metadata map[string]string `yaml:"metadata"` // key/values e.g. version or shard, used by the route subsets
+}
+
+// RouteConfig ...
+type RouteConfig struct {
+	Match                *RouteMatch            `yaml:"match"`
+	Cluster              string                 `yaml:"cluster"`
+	WeightedClusters     []*WeightedCluster     `yaml:"weighted_clusters"`      // splits the traffic between clusters, alternative to cluster
+	HashPolicy           *HashPolicy            `yaml:"hash_policy"`            // makes the weighted cluster choice sticky, random by default
+	Mirror               *MirrorPolicy          `yaml:"mirror"`                 // sends a copy of the requests to a shadow cluster
+	Subset               *SubsetPolicy          `yaml:"subset"`                 // sends the requests to the cluster endpoints with the metadata in the request headers
+	Retry                *RetryPolicy           `yaml:"retry"`                  // retries the failed requests in a different target
+	Timeout              int                    `yaml:"timeout"`                // request deadline in milliseconds including the response body, 0 means no deadline
+	MaxGRPCTimeout       int                    `yaml:"max_grpc_timeout"`       // caps the grpc-timeout header in milliseconds, 0 means no cap
+	Idempotent           bool                   `yaml:"idempotent"`             // the requests can be sent more than once, required by hedge
+	Hedge                *HedgePolicy           `yaml:"hedge"`                  // sends a copy of the slow requests to other target
+	RateLimit            *RateLimitConfig       `yaml:"rate_limit"`             // limits the requests per second of the route
+	RateLimitDescriptors []*RateLimitDescriptor `yaml:"rate_limit_descriptors"` // sent to the global rate limit service
+}
+
+// RateLimitDescriptor is sent to the rate limit service, it is not sent when the request
+// has no value for some of the entries
+type RateLimitDescriptor struct {
+	Entries []*DescriptorEntry `yaml:"entries"`
+}
+
+// DescriptorEntry the value is static or taken from the request, only one of them can be set
+type DescriptorEntry struct {
+	Key      string `yaml:"key"`
+	Value    string `yaml:"value"`     // static value
+	Header   string `yaml:"header"`    // http header or gRPC metadata key
+	Path     bool   `yaml:"path"`      // request :path
+	ClientIP bool   `yaml:"client_ip"` // downstream client IP
+	Identity bool   `yaml:"identity"`  // verified client certificate identity (SPIFFE ID or subject)
+}
+
+// RateLimitConfig the requests over the limit are rejected with RESOURCE_EXHAUSTED (429), every
+// client and gRPC method can have its own token bucket
+type RateLimitConfig struct {
+	RequestsPerSecond float64    `yaml:"requests_per_second"`
+	Burst             int        `yaml:"burst"`      // requests allowed at once, default value is requests_per_second rounded up
+	PerMethod         bool       `yaml:"per_method"` // one bucket per gRPC method (:path)
+	ClientKey         *ClientKey `yaml:"client_key"` // one bucket per client
+}
+
+// ClientKey identifies the client, only one of them can be set
+type ClientKey struct {
+	Header   string `yaml:"header"`    // http header or gRPC metadata key
+	ClientIP bool   `yaml:"client_ip"` // downstream client IP
+	Identity bool   `yaml:"identity"`  // verified client certificate identity (SPIFFE ID or subject)
+}
+
+// HedgePolicy a copy of the request is sent to other target when there is no response after
+// the delay, the first response is returned and the other request is canceled
+type HedgePolicy struct {
+	Delay      int     `yaml:"delay"`      // value in milliseconds, when it is 0 the percentile of the route latency is used
+	Percentile float64 `yaml:"percentile"` // percentile of the latency of the recent requests used as delay, default value is 95
+}
+
+// RetryPolicy the request is retried while the failure is one of retry_on, the body
+// is buffered to replay it and the requests with larger bodies are not retried
+type RetryPolicy struct {
+	RetryOn      []string `yaml:"retry_on"`      // connect_failure, refused_stream, goaway, 503 and the gRPC codes unavailable, resource_exhausted, internal, deadline_exceeded, cancelled (default connect_failure, refused_stream, goaway)
+	MaxAttempts  int      `yaml:"max_attempts"`  // attempts including the first one, default value is 3
+	BaseInterval int      `yaml:"base_interval"` // backoff before the first retry in milliseconds, doubled on every retry and jittered, default value is 25
+	MaxInterval  int      `yaml:"max_interval"`  // maximum backoff in milliseconds, default value is 10 times the base interval
+}
+
+// SubsetPolicy the subset of the request are the endpoints having the metadata values in its headers
+type SubsetPolicy struct {
+	Headers       map[string]string `yaml:"headers"`        // request header to endpoint metadata key, e.g. x-version: version
+	Fallback      string            `yaml:"fallback"`       // any_endpoint, no_fallback, default_subset (default any_endpoint)
+	DefaultSubset map[string]string `yaml:"default_subset"` // metadata of the endpoints used by the default_subset fallback
+}
+
+// MirrorPolicy the shadow responses are discarded and never affect the client
+type MirrorPolicy struct {
+	Cluster    string  `yaml:"cluster"`
+	Percentage float64 `yaml:"percentage"` // percentage of the requests mirrored, default value is 100
+}
+
+// WeightedCluster ...
+type WeightedCluster struct {
+	Name   string `yaml:"name"`
+	Weight int    `yaml:"weight"`
+}
+
+// HashPolicy indicates the request attribute hashed, only one of them can be set
+type HashPolicy struct {
+	Header   string `yaml:"header"`    // http header or gRPC metadata key
+	Path     bool   `yaml:"path"`      // request :path
+	ClientIP bool   `yaml:"client_ip"` // downstream client IP
+}
+
+// RouteMatch only one of the matchers can be set
+type RouteMatch struct {
+	Prefix  string `yaml:"prefix"`  // :path prefix
+	Service string `yaml:"service"` // gRPC service e.g. user.UserService
+	Method  string `yaml:"method"`  // gRPC method e.g. CreateUser, requires service
+	Regex   string `yaml:"regex"`   // regular expression matching the whole :path
 }
 
 // DNSConfig ...
 type DNSConfig struct {
-	RefreshRate int    `yaml:"refresh_rate"`
-	NeedRefresh bool   `yaml:"need_refresh"`
-	BalancerAlg string `yaml:"balancer_alg"` // none, random, round_robin (default none)
+	RefreshRate int              `yaml:"refresh_rate"`
+	NeedRefresh bool             `yaml:"need_refresh"`
+	BalancerAlg string           `yaml:"balancer_alg"` // none, random, round_robin, least_request, peak_ewma, weighted_round_robin, ring_hash, maglev (default none)
+	SRV         bool             `yaml:"srv"`          // the target host is a SRV record name, the records give the ports and weights
+	HashPolicy  *HashPolicy      `yaml:"hash_policy"`  // request attribute hashed by ring_hash and maglev
+	SlowStart   *SlowStartConfig `yaml:"slow_start"`   // ramp up of the new targets, used by weighted_round_robin and least_request
+	ZoneAware   *ZoneAwareConfig `yaml:"zone_aware"`   // prefers the targets in the proxy zone
+}
+
+// ZoneAwareConfig the targets in the local zone are used while enough of them are
+// healthy, the zone of every target comes from the endpoints, the zones file or the zone pattern
+type ZoneAwareConfig struct {
+	LocalZone         string  `yaml:"local_zone"`          // default value is the proxy zone
+	MinHealthyPercent float64 `yaml:"min_healthy_percent"` // below it the traffic spills over all the zones, default value is 70
+	ZonesFile         string  `yaml:"zones_file"`          // yaml file mapping target hosts or addresses to zones, read on every refresh
+	ZonePattern       string  `yaml:"zone_pattern"`        // regular expression with one group extracting the zone from the target host
+}
+
+// SlowStartConfig the targets added by the domain refresh receive a growing
+// share of the traffic during the window
+type SlowStartConfig struct {
+	Window           int     `yaml:"window"`             // value in seconds
+	Aggression       float64 `yaml:"aggression"`         // 1 is linear, higher values give more traffic at the beginning, default value is 1
+	MinWeightPercent float64 `yaml:"min_weight_percent"` // share of the weight at the beginning of the window, default value is 10
+}
+
+// TLSConfig ...
+type TLSConfig struct {
+	CertFile       string   `yaml:"cert_file"`
+	KeyFile        string   `yaml:"key_file"`
+	MinVersion     string   `yaml:"min_version"`     // 1.2, 1.3 (default 1.2)
+	CipherSuites   []string `yaml:"cipher_suites"`   // IANA names, only applies to TLS 1.2 (default go cipher suites)
+	ClientCAFile   string   `yaml:"client_ca_file"`  // enables client certificate verification against the CA bundle
+	ClientAuth     string   `yaml:"client_auth"`     // optional, require (default require when client_ca_file is set)
+	IdentityHeader string   `yaml:"identity_header"` // header used to forward the verified client identity (default X-Forwarded-Client-Cert)
+	ReloadInterval int      `yaml:"reload_interval"` // seconds between checks for certificate changes on disk, negative disables it (default 60)
+}
+
+// UpstreamTLSConfig ...
+type UpstreamTLSConfig struct {
+	CAFile             string `yaml:"ca_file"`              // CA bundle used to verify the target, system pool by default
+	ServerName         string `yaml:"server_name"`          // SNI and verified name, target host by default
+	CertFile           string `yaml:"cert_file"`            // optional client certificate
+	KeyFile            string `yaml:"key_file"`             // optional client certificate key
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify"` // only for testing purposes
+	ReloadInterval     int    `yaml:"reload_interval"`      // seconds between checks for certificate changes on disk, negative disables it (default 60)
 }
 
 // SetDefaults sets default values
@@ -34,12 +271,269 @@ func (c *ProxyConfig) SetDefaults() {
 		c.IdleTimeout = 300
 	}
 
-	if c.DNSConfig == nil {
-		c.DNSConfig = &DNSConfig{
+	if c.TLS != nil {
+		if c.TLS.IdentityHeader == "" {
+			c.TLS.IdentityHeader = "X-Forwarded-Client-Cert"
+		}
+
+		if c.TLS.ReloadInterval == 0 {
 			// value in seconds
-			RefreshRate: 60,
-			NeedRefresh: true,
-			BalancerAlg: "none",
+			c.TLS.ReloadInterval = 60
+		}
+	}
+
+	if c.DNSConfig == nil {
+		c.DNSConfig = defaultDNSConfig()
+	}
+
+	if rl := c.RateLimit; rl != nil {
+		rl.setDefaults()
+	}
+
+	if g := c.GlobalRateLimit; g != nil {
+		g.setDefaults()
+	}
+
+	if len(c.Clusters) == 0 && c.TargetHost != "" {
+		c.Clusters = []*ClusterConfig{{
+			Name:             DefaultCluster,
+			TargetHost:       c.TargetHost,
+			TargetPort:       c.TargetPort,
+			DNSConfig:        c.DNSConfig,
+			UpstreamTLS:      c.UpstreamTLS,
+			HealthCheck:      c.HealthCheck,
+			OutlierDetection: c.OutlierDetection,
+			CircuitBreakers:  c.CircuitBreakers,
+		}}
+	}
+
+	for _, cl := range c.Clusters {
+		cl.SetDefaults()
+		if za := cl.DNSConfig.ZoneAware; za != nil && za.LocalZone == "" {
+			za.LocalZone = c.Zone
+		}
+	}
+
+	if len(c.Routes) == 0 && len(c.VirtualHosts) == 0 && len(c.Clusters) > 0 {
+		c.Routes = []*RouteConfig{{Match: &RouteMatch{Prefix: "/"}, Cluster: c.Clusters[0].Name}}
+	}
+
+	for _, r := range c.Routes {
+		r.SetDefaults()
+	}
+
+	for _, vh := range c.VirtualHosts {
+		for _, r := range vh.Routes {
+			r.SetDefaults()
 		}
 	}
 }
+
+// SetDefaults sets default values
+func (r *RouteConfig) SetDefaults() {
+	if r.Mirror != nil && r.Mirror.Percentage == 0 {
+		r.Mirror.Percentage = 100
+	}
+
+	if r.Subset != nil && r.Subset.Fallback == "" {
+		r.Subset.Fallback = "any_endpoint"
+	}
+
+	if rp := r.Retry; rp != nil {
+		rp.setDefaults()
+	}
+
+	if h := r.Hedge; h != nil && h.Delay == 0 && h.Percentile == 0 {
+		h.Percentile = 95
+	}
+
+	if rl := r.RateLimit; rl != nil {
+		rl.setDefaults()
+	}
+}
+
+func (g *GlobalRateLimitConfig) setDefaults() {
+	if g.Timeout == 0 {
+		// value in milliseconds
+		g.Timeout = 100
+	}
+
+	if g.FailureMode == "" {
+		g.FailureMode = "allow"
+	}
+
+	if g.CacheTTL == 0 {
+		// value in milliseconds
+		g.CacheTTL = 1000
+	}
+}
+
+func (rl *RateLimitConfig) setDefaults() {
+	if rl.Burst == 0 {
+		rl.Burst = int(math.Ceil(rl.RequestsPerSecond))
+	}
+}
+
+func (rp *RetryPolicy) setDefaults() {
+	if len(rp.RetryOn) == 0 {
+		rp.RetryOn = []string{"connect_failure", "refused_stream", "goaway"}
+	}
+
+	if rp.MaxAttempts == 0 {
+		rp.MaxAttempts = 3
+	}
+
+	if rp.BaseInterval == 0 {
+		// value in milliseconds
+		rp.BaseInterval = 25
+	}
+
+	if rp.MaxInterval == 0 {
+		rp.MaxInterval = 10 * rp.BaseInterval
+	}
+}
+
+// SetDefaults sets default values
+func (c *ClusterConfig) SetDefaults() {
+	if c.DNSConfig == nil {
+		c.DNSConfig = defaultDNSConfig()
+	}
+
+	if ss := c.DNSConfig.SlowStart; ss != nil {
+		if ss.Aggression == 0 {
+			ss.Aggression = 1
+		}
+
+		if ss.MinWeightPercent == 0 {
+			ss.MinWeightPercent = 10
+		}
+	}
+
+	if za := c.DNSConfig.ZoneAware; za != nil && za.MinHealthyPercent == 0 {
+		za.MinHealthyPercent = 70
+	}
+
+	if hc := c.HealthCheck; hc != nil {
+		hc.setDefaults()
+	}
+
+	if od := c.OutlierDetection; od != nil {
+		od.setDefaults()
+	}
+
+	if cb := c.CircuitBreakers; cb != nil {
+		cb.setDefaults()
+	}
+
+	for _, e := range c.Endpoints {
+		if e.Weight == 0 {
+			e.Weight = 1
+		}
+	}
+
+	// the first endpoint is used as :authority and server name when there is no target
+	if c.TargetHost == "" && len(c.Endpoints) > 0 {
+		if host, port, err := net.SplitHostPort(c.Endpoints[0].Address); err == nil {
+			c.TargetHost, c.TargetPort = host, port
+		}
+	}
+
+	if c.UpstreamTLS != nil && c.UpstreamTLS.ReloadInterval == 0 {
+		// value in seconds
+		c.UpstreamTLS.ReloadInterval = 60
+	}
+}
+
+func (hc *HealthCheckConfig) setDefaults() {
+	if hc.Type == "" {
+		hc.Type = "grpc"
+	}
+
+	if hc.Interval == 0 {
+		// value in seconds
+		hc.Interval = 10
+	}
+
+	if hc.Timeout == 0 {
+		// value in milliseconds
+		hc.Timeout = 1000
+	}
+
+	if hc.HealthyThreshold == 0 {
+		hc.HealthyThreshold = 2
+	}
+
+	if hc.UnhealthyThreshold == 0 {
+		hc.UnhealthyThreshold = 3
+	}
+
+	if hc.Path == "" {
+		hc.Path = "/health"
+	}
+}
+
+func (od *OutlierDetectionConfig) setDefaults() {
+	for _, v := range []*int{&od.Consecutive5xx, &od.ConsecutiveGRPCErrors, &od.ConsecutiveConnectFailures, &od.SuccessRateMinHosts} {
+		if *v == 0 {
+			*v = 5
+		}
+	}
+
+	if od.Interval == 0 {
+		// value in seconds
+		od.Interval = 10
+	}
+
+	if od.BaseEjectionTime == 0 {
+		// value in seconds
+		od.BaseEjectionTime = 30
+	}
+
+	if od.MaxEjectionTime == 0 {
+		// value in seconds
+		od.MaxEjectionTime = 300
+	}
+
+	if od.MaxEjectionPercent == 0 {
+		od.MaxEjectionPercent = 10
+	}
+
+	if od.SuccessRateRequestVolume == 0 {
+		od.SuccessRateRequestVolume = 100
+	}
+
+	if od.SuccessRateStdevFactor == 0 {
+		od.SuccessRateStdevFactor = 1.9
+	}
+}
+
+func (cb *CircuitBreakersConfig) setDefaults() {
+	for _, v := range []*int{&cb.MaxRequests, &cb.MaxConnections} {
+		if *v == 0 {
+			*v = 1024
+		}
+	}
+
+	// an explicit 0 disables the pending requests
+	if cb.MaxPendingRequests == nil {
+		maxPending := 1024
+		cb.MaxPendingRequests = &maxPending
+	}
+
+	if cb.MaxRetries == 0 {
+		cb.MaxRetries = 3
+	}
+
+	if cb.MinRetryConcurrency == 0 {
+		cb.MinRetryConcurrency = 3
+	}
+}
+
+func defaultDNSConfig() *DNSConfig {
+	return &DNSConfig{
+		// value in seconds
+		RefreshRate: 60,
+		NeedRefresh: true,
+		BalancerAlg: "none",
+	}
+}
@@ -0,0 +1,432 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+)
+
+// Validate checks the configuration is consistent, SetDefaults
+// needs to be called before
+func (c *ProxyConfig) Validate() error {
+	if len(c.Clusters) == 0 {
+		return errors.New("target host and target port are mandatory")
+	}
+
+	if rl := c.RateLimit; rl != nil {
+		if err := rl.validate(); err != nil {
+			return err
+		}
+	}
+
+	names := make(map[string]*ClusterConfig, len(c.Clusters))
+	for _, cl := range c.Clusters {
+		if cl.Name == "" {
+			return errors.New("cluster name is mandatory")
+		}
+
+		if names[cl.Name] != nil {
+			return fmt.Errorf("cluster %s is duplicated", cl.Name)
+		}
+
+		if cl.DNSConfig.HashPolicy != nil {
+			if err := cl.DNSConfig.HashPolicy.validate(); err != nil {
+				return fmt.Errorf("cluster %s: %w", cl.Name, err)
+			}
+		}
+
+		if ss := cl.DNSConfig.SlowStart; ss != nil {
+			if ss.Window <= 0 || ss.Aggression <= 0 || ss.MinWeightPercent < 0 || ss.MinWeightPercent > 100 {
+				return fmt.Errorf("cluster %s: slow start window and aggression must be greater than 0 and min_weight_percent between 0 and 100", cl.Name)
+			}
+		}
+
+		if za := cl.DNSConfig.ZoneAware; za != nil {
+			if err := za.validate(); err != nil {
+				return fmt.Errorf("cluster %s: %w", cl.Name, err)
+			}
+		}
+
+		if hc := cl.HealthCheck; hc != nil {
+			if err := hc.validate(); err != nil {
+				return fmt.Errorf("cluster %s: %w", cl.Name, err)
+			}
+		}
+
+		if od := cl.OutlierDetection; od != nil {
+			if err := od.validate(); err != nil {
+				return fmt.Errorf("cluster %s: %w", cl.Name, err)
+			}
+		}
+
+		if cb := cl.CircuitBreakers; cb != nil {
+			if cb.MaxRequests < 0 || (cb.MaxPendingRequests != nil && *cb.MaxPendingRequests < 0) || cb.MaxRetries < 0 || cb.MaxConnections < 0 {
+				return fmt.Errorf("cluster %s: circuit breakers thresholds can not be negative", cl.Name)
+			}
+
+			if cb.RetryBudget < 0 || cb.RetryBudget > 100 || cb.MinRetryConcurrency < 0 {
+				return fmt.Errorf("cluster %s: retry_budget must be between 0 and 100 and min_retry_concurrency can not be negative", cl.Name)
+			}
+		}
+
+		for _, e := range cl.Endpoints {
+			if _, _, err := net.SplitHostPort(e.Address); err != nil {
+				return fmt.Errorf("cluster %s: invalid endpoint address %s", cl.Name, e.Address)
+			}
+
+			if e.Weight < 0 {
+				return fmt.Errorf("cluster %s: endpoint weight can not be negative", cl.Name)
+			}
+		}
+
+		if cl.TargetHost == "" || cl.TargetPort == "" {
+			return fmt.Errorf("target host and target port are mandatory for cluster %s", cl.Name)
+		}
+		names[cl.Name] = cl
+	}
+
+	if g := c.GlobalRateLimit; g != nil {
+		if err := g.validate(names); err != nil {
+			return err
+		}
+	}
+
+	if err := validateRoutes(c.Routes, names); err != nil {
+		return err
+	}
+
+	domains := make(map[string]bool)
+	for _, vh := range c.VirtualHosts {
+		if vh.Name == "" {
+			return errors.New("virtual host name is mandatory")
+		}
+
+		if len(vh.Domains) == 0 {
+			return fmt.Errorf("virtual host %s: domains are mandatory", vh.Name)
+		}
+
+		for _, d := range vh.Domains {
+			d = strings.ToLower(d)
+			if domains[d] {
+				return fmt.Errorf("virtual host %s: domain %s is duplicated", vh.Name, d)
+			}
+
+			if strings.Contains(d, "*") && d != "*" && (!strings.HasPrefix(d, "*.") || strings.Count(d, "*") > 1) {
+				return fmt.Errorf("virtual host %s: invalid wildcard domain %s", vh.Name, d)
+			}
+			domains[d] = true
+		}
+
+		if err := validateRoutes(vh.Routes, names); err != nil {
+			return fmt.Errorf("virtual host %s: %w", vh.Name, err)
+		}
+	}
+
+	return nil
+}
+
+func validateRoutes(routes []*RouteConfig, clusters map[string]*ClusterConfig) error {
+	for i, r := range routes {
+		if err := r.validate(clusters); err != nil {
+			return fmt.Errorf("route %d: %w", i, err)
+		}
+	}
+
+	return nil
+}
+
+func (r *RouteConfig) validate(clusters map[string]*ClusterConfig) error {
+	if (r.Cluster == "") == (len(r.WeightedClusters) == 0) {
+		return errors.New("exactly one of cluster or weighted_clusters is required")
+	}
+
+	if r.Cluster != "" && clusters[r.Cluster] == nil {
+		return fmt.Errorf("unknown cluster %s", r.Cluster)
+	}
+
+	for _, wc := range r.WeightedClusters {
+		if clusters[wc.Name] == nil {
+			return fmt.Errorf("unknown cluster %s", wc.Name)
+		}
+
+		if wc.Weight <= 0 {
+			return fmt.Errorf("weight for cluster %s must be greater than 0", wc.Name)
+		}
+	}
+
+	if r.HashPolicy != nil {
+		if err := r.HashPolicy.validate(); err != nil {
+			return err
+		}
+	}
+
+	if r.Mirror != nil {
+		if clusters[r.Mirror.Cluster] == nil {
+			return fmt.Errorf("unknown mirror cluster %s", r.Mirror.Cluster)
+		}
+
+		if r.Mirror.Percentage < 0 || r.Mirror.Percentage > 100 {
+			return errors.New("mirror percentage must be between 0 and 100")
+		}
+	}
+
+	if r.Subset != nil {
+		if err := r.Subset.validate(); err != nil {
+			return err
+		}
+
+		// the metadata of the targets is only known for the static endpoints
+		names := []string{r.Cluster}
+		if r.Cluster == "" {
+			names = names[:0]
+			for _, wc := range r.WeightedClusters {
+				names = append(names, wc.Name)
+			}
+		}
+
+		for _, n := range names {
+			if len(clusters[n].Endpoints) == 0 {
+				return fmt.Errorf("subset requires endpoints in cluster %s", n)
+			}
+		}
+	}
+
+	if r.Timeout < 0 || r.MaxGRPCTimeout < 0 {
+		return errors.New("timeout and max_grpc_timeout can not be negative")
+	}
+
+	if h := r.Hedge; h != nil {
+		if !r.Idempotent {
+			return errors.New("hedge requires an idempotent route")
+		}
+
+		if h.Delay < 0 || h.Percentile < 0 || h.Percentile > 100 {
+			return errors.New("hedge delay can not be negative and percentile must be between 0 and 100")
+		}
+	}
+
+	if r.RateLimit != nil {
+		if err := r.RateLimit.validate(); err != nil {
+			return err
+		}
+	}
+
+	for _, d := range r.RateLimitDescriptors {
+		if err := d.validate(); err != nil {
+			return err
+		}
+	}
+
+	if r.Retry != nil {
+		if err := r.Retry.validate(); err != nil {
+			return err
+		}
+	}
+
+	if r.Match == nil {
+		return errors.New("match is mandatory")
+	}
+
+	return r.Match.validate()
+}
+
+func (s *SubsetPolicy) validate() error {
+	if len(s.Headers) == 0 {
+		return errors.New("subset headers are mandatory")
+	}
+
+	switch s.Fallback {
+	case "any_endpoint", "no_fallback":
+	case "default_subset":
+		if len(s.DefaultSubset) == 0 {
+			return errors.New("default_subset fallback requires the default subset")
+		}
+	default:
+		return fmt.Errorf("invalid subset fallback %s", s.Fallback)
+	}
+
+	return nil
+}
+
+func (rp *RetryPolicy) validate() error {
+	for _, on := range rp.RetryOn {
+		switch on {
+		case "connect_failure", "refused_stream", "goaway", "503",
+			"unavailable", "resource_exhausted", "internal", "deadline_exceeded", "cancelled":
+		default:
+			return fmt.Errorf("invalid retry_on condition %s", on)
+		}
+	}
+
+	if rp.MaxAttempts <= 0 || rp.BaseInterval < 0 || rp.MaxInterval < rp.BaseInterval {
+		return errors.New("retry max_attempts must be greater than 0 and max_interval can not be lower than base_interval")
+	}
+
+	return nil
+}
+
+func (g *GlobalRateLimitConfig) validate(clusters map[string]*ClusterConfig) error {
+	if clusters[g.Cluster] == nil {
+		return fmt.Errorf("unknown global rate limit cluster %s", g.Cluster)
+	}
+
+	if g.Domain == "" {
+		return errors.New("global rate limit domain is mandatory")
+	}
+
+	if g.Timeout <= 0 {
+		return errors.New("global rate limit timeout must be greater than 0")
+	}
+
+	if g.FailureMode != "allow" && g.FailureMode != "deny" {
+		return fmt.Errorf("invalid global rate limit failure mode %s", g.FailureMode)
+	}
+
+	return nil
+}
+
+func (d *RateLimitDescriptor) validate() error {
+	if len(d.Entries) == 0 {
+		return errors.New("rate limit descriptor entries are mandatory")
+	}
+
+	for _, e := range d.Entries {
+		if e.Key == "" {
+			return errors.New("rate limit descriptor entry key is mandatory")
+		}
+
+		var set int
+		for _, b := range []bool{e.Value != "", e.Header != "", e.Path, e.ClientIP, e.Identity} {
+			if b {
+				set++
+			}
+		}
+
+		if set != 1 {
+			return fmt.Errorf("exactly one of value, header, path, client_ip or identity is required in the descriptor entry %s", e.Key)
+		}
+	}
+
+	return nil
+}
+
+func (rl *RateLimitConfig) validate() error {
+	if rl.RequestsPerSecond <= 0 || rl.Burst <= 0 {
+		return errors.New("rate limit requests_per_second and burst must be greater than 0")
+	}
+
+	if ck := rl.ClientKey; ck != nil {
+		var set int
+		for _, b := range []bool{ck.Header != "", ck.ClientIP, ck.Identity} {
+			if b {
+				set++
+			}
+		}
+
+		if set != 1 {
+			return errors.New("exactly one of header, client_ip or identity is required in the rate limit client key")
+		}
+	}
+
+	return nil
+}
+
+func (hc *HealthCheckConfig) validate() error {
+	switch hc.Type {
+	case "grpc", "http", "tcp":
+	default:
+		return fmt.Errorf("invalid health check type %s", hc.Type)
+	}
+
+	if hc.Interval <= 0 || hc.Timeout <= 0 || hc.HealthyThreshold <= 0 || hc.UnhealthyThreshold <= 0 {
+		return errors.New("health check interval, timeout and thresholds must be greater than 0")
+	}
+
+	if !strings.HasPrefix(hc.Path, "/") {
+		return errors.New("health check path must start with /")
+	}
+
+	return nil
+}
+
+func (od *OutlierDetectionConfig) validate() error {
+	for _, v := range []int{od.Consecutive5xx, od.ConsecutiveGRPCErrors, od.ConsecutiveConnectFailures, od.Interval,
+		od.BaseEjectionTime, od.SuccessRateMinHosts, od.SuccessRateRequestVolume} {
+		if v <= 0 {
+			return errors.New("outlier detection thresholds, interval and ejection time must be greater than 0")
+		}
+	}
+
+	if od.MaxEjectionTime < od.BaseEjectionTime {
+		return errors.New("max_ejection_time can not be lower than base_ejection_time")
+	}
+
+	if od.MaxEjectionPercent < 0 || od.MaxEjectionPercent > 100 {
+		return errors.New("max_ejection_percent must be between 0 and 100")
+	}
+
+	if od.SuccessRateStdevFactor <= 0 {
+		return errors.New("success_rate_stdev_factor must be greater than 0")
+	}
+
+	return nil
+}
+
+func (z *ZoneAwareConfig) validate() error {
+	if z.LocalZone == "" {
+		return errors.New("zone aware balancing requires the proxy zone")
+	}
+
+	if z.MinHealthyPercent < 0 || z.MinHealthyPercent > 100 {
+		return errors.New("min_healthy_percent must be between 0 and 100")
+	}
+
+	if z.ZonePattern != "" {
+		re, err := regexp.Compile(z.ZonePattern)
+		if err != nil {
+			return fmt.Errorf("invalid zone pattern %w", err)
+		}
+
+		if re.NumSubexp() != 1 {
+			return errors.New("zone pattern must have one group")
+		}
+	}
+
+	return nil
+}
+
+func (h *HashPolicy) validate() error {
+	var set int
+	for _, b := range []bool{h.Header != "", h.Path, h.ClientIP} {
+		if b {
+			set++
+		}
+	}
+
+	if set != 1 {
+		return errors.New("exactly one of header, path or client_ip is required in the hash policy")
+	}
+
+	return nil
+}
+
+func (m *RouteMatch) validate() error {
+	var set int
+	for _, v := range []string{m.Prefix, m.Service, m.Regex} {
+		if v != "" {
+			set++
+		}
+	}
+
+	if set != 1 {
+		return errors.New("exactly one of prefix, service or regex is required")
+	}
+
+	if m.Method != "" && m.Service == "" {
+		return errors.New("method requires service")
+	}
+
+	return nil
+}
@@ -1,19 +1,69 @@
 package conn
 
 import (
+	"crypto/tls"
 	"fmt"
 	"log"
 	"net"
+	"sync/atomic"
+	"time"
 
 	"golang.org/x/net/http2"
 )
 
 // Connection represents the connection for an specific Address
 type Connection struct {
-	Address     string
-	Conn        *http2.ClientConn
-	IsConnected bool // used to init the connection after rehresing the ips
-	IsActive    bool // indicates if the connection is active, can be deactivated/remmoved in case of multiple failures (TODO: circuit break)
+	activeRequests int64 // requests in flight, first field to keep it 64 bit aligned for atomic operations
+	ejected        int32 // set by the outlier detection, accessed atomically
+	Address        string
+	Conn           *http2.ClientConn
+	IsConnected    bool              // used to init the connection after rehresing the ips
+	IsActive       bool              // indicates if the connection is active, deactivated by the health checks
+	Weight         int               // used by the weighted balancers, 0 is handled as 1
+	AddedAt        time.Time         // when the connection was added by a refresh, zero for the initial ones
+	Zone           string            // zone of the target, used by the zone aware balancing
+	Metadata       map[string]string // key/values of the target e.g. version or shard, used by the subset balancing
+	latency        latency
+}
+
+// ObserveLatency records the latency of a response received through the connection
+func (c *Connection) ObserveLatency(d time.Duration) {
+	c.latency.observe(d, time.Now())
+}
+
+// Latency returns the peak EWMA of the response latency
+func (c *Connection) Latency() time.Duration {
+	return time.Duration(c.latency.value(time.Now()))
+}
+
+// IsAvailable indicates if the balancers can pick the connection
+func (c *Connection) IsAvailable() bool {
+	return c.IsActive && c.IsConnected && !c.Ejected()
+}
+
+// Ejected indicates if the connection was ejected by the outlier detection
+func (c *Connection) Ejected() bool {
+	return atomic.LoadInt32(&c.ejected) == 1
+}
+
+// SetEjected ejects the connection from the balancing or brings it back
+func (c *Connection) SetEjected(ejected bool) {
+	var v int32
+	if ejected {
+		v = 1
+	}
+	atomic.StoreInt32(&c.ejected, v)
+}
+
+// Endpoint is a target address with its weight
+type Endpoint struct {
+	Address string
+	Weight  int
+}
+
+// ActiveRequests returns the number of requests in flight using the connection
+func (c *Connection) ActiveRequests() int64 {
+	return atomic.LoadInt64(&c.activeRequests)
 }
 
 // AddConnection adds a new connection to the pool
@@ -33,29 +83,52 @@ func AddConnection(pool *[]*Connection, con *Connection) {
 }
 
 // ConnectPool creates the actual connections available in the pool
-// for those connections marked as active and not connected
+// for those connections marked as active and not connected, the
+// connections failing are left not connected and the first error is returned
 func ConnectPool(t *http2.Transport, pool []*Connection) error {
+	var first error
 	for _, p := range pool {
 		if p.IsActive && !p.IsConnected {
 			c, err := Connect(t, p.Address)
 			if err != nil {
-				return err
+				if first == nil {
+					first = err
+				}
+				continue
 			}
 			p.IsConnected = true
 			p.Conn = c
 		}
 	}
 
-	return nil
+	return first
 }
 
-// Connect creates a new connection
+// Connect creates a new connection, TLS is used when
+// the transport has a tls client configuration
 func Connect(t *http2.Transport, host string) (*http2.ClientConn, error) {
-	c, err := net.Dial("tcp", host)
+	return ConnectTimeout(t, host, 0)
+}
+
+// ConnectTimeout same as Connect but the dial and the TLS handshake
+// fail after the timeout, 0 means no timeout
+func ConnectTimeout(t *http2.Transport, host string, timeout time.Duration) (*http2.ClientConn, error) {
+	c, err := net.DialTimeout("tcp", host, timeout)
 	if err != nil {
 		return nil, fmt.Errorf("[h2-proxy]: %w ", err)
 	}
 
+	if t.TLSClientConfig != nil {
+		if timeout > 0 {
+			c.SetDeadline(time.Now().Add(timeout))
+		}
+
+		if c, err = handshake(c, t.TLSClientConfig); err != nil {
+			return nil, err
+		}
+		c.SetDeadline(time.Time{})
+	}
+
 	h2conn, err := t.NewClientConn(c)
 	if err != nil {
 		return nil, fmt.Errorf("[h2-proxy]: %w", err)
@@ -64,6 +137,22 @@ func Connect(t *http2.Transport, host string) (*http2.ClientConn, error) {
 	return h2conn, nil
 }
 
+// handshake completes the tls handshake against the target making sure h2 was negotiated
+func handshake(c net.Conn, cfg *tls.Config) (net.Conn, error) {
+	tc := tls.Client(c, cfg)
+	if err := tc.Handshake(); err != nil {
+		c.Close()
+		return nil, fmt.Errorf("[h2-proxy]: %w", err)
+	}
+
+	if p := tc.ConnectionState().NegotiatedProtocol; p != http2.NextProtoTLS {
+		tc.Close()
+		return nil, fmt.Errorf("[h2-proxy]: unexpected protocol %q negotiated with the target", p)
+	}
+
+	return tc, nil
+}
+
 // RefreshConnections compares the refreshed IPs removing the non existing ones
 // and creating the new ones
 func RefreshConnections(pool *[]*Connection, refreshedAddrs []string) {
@@ -87,7 +176,23 @@ func RefreshConnections(pool *[]*Connection, refreshedAddrs []string) {
 	}
 
 	for k := range refreshedMap {
-		*pool = append(*pool, &Connection{Address: k, IsActive: true, IsConnected: false})
+		*pool = append(*pool, &Connection{Address: k, IsActive: true, IsConnected: false, AddedAt: time.Now()})
+	}
+}
+
+// RefreshEndpoints same as RefreshConnections but it also
+// updates the weight of the existing connections
+func RefreshEndpoints(pool *[]*Connection, endpoints []Endpoint) {
+	addrs := make([]string, 0, len(endpoints))
+	weights := make(map[string]int, len(endpoints))
+	for _, e := range endpoints {
+		addrs = append(addrs, e.Address)
+		weights[e.Address] = e.Weight
+	}
+
+	RefreshConnections(pool, addrs)
+	for _, c := range *pool {
+		c.Weight = weights[c.Address]
 	}
 }
 
@@ -105,6 +210,10 @@ func removeConnection(pool *[]*Connection, Address string) {
 // CloseAllConnections closes all connections in the pool
 func CloseAllConnections(pool *[]*Connection) {
 	for _, c := range *pool {
+		if c.Conn == nil {
+			continue
+		}
+
 		if err := c.Conn.Close(); err != nil {
 			log.Println("error closing connection ", err)
 		}
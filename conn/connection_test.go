@@ -91,6 +91,55 @@ func TestConnect(t *testing.T) {
 	}
 }
 
+func TestConnectTLS(t *testing.T) {
+	cert, err := tls.LoadX509KeyPair("../certs/testdata/server.pem", "../certs/testdata/server-key.pem")
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}, NextProtos: []string{http2.NextProtoTLS}})
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	defer l.Close()
+
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go c.(*tls.Conn).Handshake()
+		}
+	}()
+
+	tr := getTransport()
+	tr.TLSClientConfig = &tls.Config{InsecureSkipVerify: true, NextProtos: []string{http2.NextProtoTLS}}
+	c, err := Connect(tr, l.Addr().String())
+	if c == nil || err != nil {
+		t.Log("error connecting", err)
+		t.Fail()
+	}
+
+	// the target certificate is not trusted
+	tr.TLSClientConfig = &tls.Config{ServerName: "localhost", NextProtos: []string{http2.NextProtoTLS}}
+	c, err = Connect(tr, l.Addr().String())
+	if c != nil || err == nil {
+		t.Log("connection should fail")
+		t.Fail()
+	}
+
+	// h2 is not negotiated
+	tr.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	c, err = Connect(tr, l.Addr().String())
+	if c != nil || err == nil {
+		t.Log("connection should fail")
+		t.Fail()
+	}
+}
+
 func TestRefreshConnections(t *testing.T) {
 	tr := getTransport()
 	l := fakeListener("8081")
@@ -122,6 +171,26 @@ func TestRefreshConnections(t *testing.T) {
 	assert.Equal(t, 0, len(pool))
 }
 
+func TestRefreshEndpoints(t *testing.T) {
+	pool := []*Connection{{Address: defaultAddr, Weight: 1}}
+
+	RefreshEndpoints(&pool, []Endpoint{{Address: defaultAddr, Weight: 3}, {Address: "localhost:8090", Weight: 2}})
+	assert.Equal(t, 2, len(pool))
+	for _, c := range pool {
+		if c.Address == defaultAddr {
+			assert.Equal(t, 3, c.Weight)
+		} else {
+			assert.Equal(t, 2, c.Weight)
+			assert.False(t, c.IsConnected)
+			assert.False(t, c.AddedAt.IsZero())
+		}
+	}
+
+	RefreshEndpoints(&pool, []Endpoint{{Address: "localhost:8090", Weight: 5}})
+	assert.Equal(t, 1, len(pool))
+	assert.Equal(t, 5, pool[0].Weight)
+}
+
 func TestRemoveConnection(t *testing.T) {
 	tr := getTransport()
 	l := fakeListener("8081")
@@ -202,3 +271,16 @@ func getTransport() *http2.Transport {
 		},
 	}
 }
+
+func TestIsAvailable(t *testing.T) {
+	c := &Connection{IsActive: true, IsConnected: true}
+	assert.True(t, c.IsAvailable())
+
+	c.SetEjected(true)
+	assert.True(t, c.Ejected())
+	assert.False(t, c.IsAvailable())
+
+	c.SetEjected(false)
+	c.IsActive = false
+	assert.False(t, c.IsAvailable())
+}
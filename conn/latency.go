@@ -0,0 +1,56 @@
+package conn
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	// latencyDecay time it takes to forget the previous latencies
+	latencyDecay = 10 * time.Second
+	// defaultLatency used for connections without responses yet
+	defaultLatency = 30 * time.Millisecond
+)
+
+// latency keeps the peak EWMA of the response latency, a latency higher than the
+// average replaces it right away while lower ones are averaged, the average
+// decays to 0 with the time so slow connections are tried again
+type latency struct {
+	m        sync.Mutex
+	ewma     float64 // nanoseconds
+	observed time.Time
+}
+
+func (l *latency) observe(d time.Duration, now time.Time) {
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	rtt := float64(d)
+	if l.observed.IsZero() || rtt > l.ewma {
+		l.ewma = rtt
+	} else {
+		w := decay(now.Sub(l.observed))
+		l.ewma = l.ewma*w + rtt*(1-w)
+	}
+	l.observed = now
+}
+
+func (l *latency) value(now time.Time) float64 {
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	if l.observed.IsZero() {
+		return float64(defaultLatency)
+	}
+
+	return l.ewma * decay(now.Sub(l.observed))
+}
+
+func decay(elapsed time.Duration) float64 {
+	if elapsed < 0 {
+		elapsed = 0
+	}
+
+	return math.Exp(-float64(elapsed) / float64(latencyDecay))
+}
@@ -0,0 +1,31 @@
+package conn
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLatency(t *testing.T) {
+	l := &latency{}
+	now := time.Now()
+	assert.Equal(t, float64(defaultLatency), l.value(now))
+
+	l.observe(10*time.Millisecond, now)
+	assert.Equal(t, float64(10*time.Millisecond), l.value(now))
+
+	// peaks replace the average right away
+	l.observe(100*time.Millisecond, now)
+	assert.Equal(t, float64(100*time.Millisecond), l.value(now))
+
+	// lower latencies are averaged, the older the average the more they count
+	l.observe(10*time.Millisecond, now.Add(time.Millisecond))
+	assert.InDelta(t, float64(100*time.Millisecond), l.value(now.Add(time.Millisecond)), float64(time.Millisecond))
+
+	l.observe(10*time.Millisecond, now.Add(time.Minute))
+	assert.InDelta(t, float64(10*time.Millisecond), l.value(now.Add(time.Minute)), float64(time.Millisecond))
+
+	// without new responses the average decays
+	assert.Less(t, l.value(now.Add(2*time.Minute)), float64(time.Millisecond))
+}
@@ -0,0 +1,205 @@
+package conn
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type streamKey struct{}
+
+// Stream tracks the connection used by a proxied request, it travels in the
+// request context so the pool can attach the connection it picked for the request
+type Stream struct {
+	m        sync.Mutex
+	conn     *Connection
+	observer ResultObserver
+	done     bool
+	tried    []*Connection // connections of the previous attempts of the request
+	onDone   []func()
+	pending  func() // releases the circuit breaker pending request while waiting for a free stream
+}
+
+// Result is the outcome of a request sent through a connection
+type Result int
+
+// all possible results
+const (
+	Success        Result = iota
+	ServerError           // 5xx response
+	GRPCError             // gRPC UNAVAILABLE or INTERNAL status
+	ConnectFailure        // the request could not be sent or the connection failed
+)
+
+// ResultObserver is notified of the results of the requests, e.g. by the outlier detection
+type ResultObserver interface {
+	ObserveResult(c *Connection, r Result)
+}
+
+// WithStream returns a copy of ctx carrying the stream
+func WithStream(ctx context.Context, s *Stream) context.Context {
+	return context.WithValue(ctx, streamKey{}, s)
+}
+
+// StreamFromContext returns the stream in ctx, nil if there is none
+func StreamFromContext(ctx context.Context) *Stream {
+	s, _ := ctx.Value(streamKey{}).(*Stream)
+	return s
+}
+
+// Attach counts the request as active in the connection, the transport can ask for
+// a connection more than once for the same request so the previous one is released
+func (s *Stream) Attach(c *Connection) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if s.done {
+		return
+	}
+
+	if s.conn != nil {
+		atomic.AddInt64(&s.conn.activeRequests, -1)
+	}
+
+	atomic.AddInt64(&c.activeRequests, 1)
+	s.conn = c
+}
+
+// Connection returns the connection attached to the stream, nil if there is none
+func (s *Stream) Connection() *Connection {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return s.conn
+}
+
+// SetObserver sets the observer notified of the result of the request
+func (s *Stream) SetObserver(o ResultObserver) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.observer = o
+}
+
+// ObserveResult notifies the observer about the result of the request in the attached connection
+func (s *Stream) ObserveResult(r Result) {
+	s.m.Lock()
+	c, o := s.conn, s.observer
+	s.m.Unlock()
+
+	if c != nil && o != nil {
+		o.ObserveResult(c, r)
+	}
+}
+
+// ObserveLatency records the response latency in the attached connection
+func (s *Stream) ObserveLatency(d time.Duration) {
+	if c := s.Connection(); c != nil {
+		c.ObserveLatency(d)
+	}
+}
+
+// Retry returns the stream of the next attempt of the request, the pool avoids
+// the connections of the previous attempts. The current stream is done
+func (s *Stream) Retry() *Stream {
+	s.Done()
+	return s.Hedge()
+}
+
+// Hedge returns the stream of a copy of the request sent while the current one is
+// in flight, the pool avoids the connections of the current and previous attempts
+func (s *Stream) Hedge() *Stream {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	next := &Stream{tried: s.tried}
+	if s.conn != nil {
+		next.tried = append(s.tried[:len(s.tried):len(s.tried)], s.conn)
+	}
+
+	return next
+}
+
+// Tried returns true when the connection was used by a previous attempt of the request
+func (s *Stream) Tried(c *Connection) bool {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	for _, tc := range s.tried {
+		if tc == c {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Waiting returns true while the request waits for a free stream in the connections
+func (s *Stream) Waiting() bool {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return s.pending != nil
+}
+
+// Wait marks the request as waiting for a free stream in the connections, release is
+// called once the request gets one or the stream is done
+func (s *Stream) Wait(release func()) {
+	s.m.Lock()
+	if !s.done {
+		s.pending = release
+		s.m.Unlock()
+		return
+	}
+	s.m.Unlock()
+
+	release()
+}
+
+// Dispatch marks the request as sent to a connection with a free stream
+func (s *Stream) Dispatch() {
+	s.m.Lock()
+	release := s.pending
+	s.pending = nil
+	s.m.Unlock()
+
+	if release != nil {
+		release()
+	}
+}
+
+// OnDone registers f to be called once the stream is done, e.g. to release the circuit
+// breaker retry taken by the attempt. f is called right away when the stream is already done
+func (s *Stream) OnDone(f func()) {
+	s.m.Lock()
+	if !s.done {
+		s.onDone = append(s.onDone, f)
+		s.m.Unlock()
+		return
+	}
+	s.m.Unlock()
+
+	f()
+}
+
+// Done releases the connection once the response is completed, calling it more than once is a no op
+func (s *Stream) Done() {
+	s.m.Lock()
+	if s.done {
+		s.m.Unlock()
+		return
+	}
+
+	s.done = true
+	if s.conn != nil {
+		atomic.AddInt64(&s.conn.activeRequests, -1)
+	}
+	onDone := s.onDone
+	if s.pending != nil {
+		onDone = append(onDone, s.pending)
+	}
+	s.onDone, s.pending = nil, nil
+	s.m.Unlock()
+
+	for _, f := range onDone {
+		f()
+	}
+}
@@ -0,0 +1,108 @@
+package conn
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStream(t *testing.T) {
+	assert.Nil(t, StreamFromContext(context.Background()))
+
+	s := &Stream{}
+	ctx := WithStream(context.Background(), s)
+	assert.Equal(t, s, StreamFromContext(ctx))
+
+	c1, c2 := &Connection{Address: "localhost:8070"}, &Connection{Address: "localhost:8080"}
+	s.Attach(c1)
+	assert.Equal(t, int64(1), c1.ActiveRequests())
+	assert.Equal(t, c1, s.Connection())
+
+	// the transport asked again for a connection, the first one is released
+	s.Attach(c2)
+	assert.Equal(t, int64(0), c1.ActiveRequests())
+	assert.Equal(t, int64(1), c2.ActiveRequests())
+
+	s.ObserveLatency(5 * time.Millisecond)
+	assert.InDelta(t, float64(5*time.Millisecond), float64(c2.Latency()), float64(time.Millisecond))
+	assert.Equal(t, defaultLatency, c1.Latency())
+
+	o := &fakeObserver{}
+	s.ObserveResult(ServerError)
+	s.SetObserver(o)
+	s.ObserveResult(GRPCError)
+	assert.Equal(t, []Result{GRPCError}, o.results)
+
+	s.Done()
+	s.Done()
+	assert.Equal(t, int64(0), c2.ActiveRequests())
+
+	// nothing is attached after the stream is done
+	s.Attach(c1)
+	assert.Equal(t, int64(0), c1.ActiveRequests())
+}
+
+func TestStreamRetry(t *testing.T) {
+	c1, c2 := &Connection{Address: "localhost:8070"}, &Connection{Address: "localhost:8080"}
+	s := &Stream{}
+	s.Attach(c1)
+
+	next := s.Retry()
+	assert.Equal(t, int64(0), c1.ActiveRequests())
+	assert.True(t, next.Tried(c1))
+	assert.False(t, next.Tried(c2))
+
+	next.Attach(c2)
+	last := next.Retry()
+	assert.True(t, last.Tried(c1))
+	assert.True(t, last.Tried(c2))
+	assert.False(t, next.Tried(c2))
+
+	// the hedged stream keeps the current one active
+	last.Attach(c1)
+	hedged := last.Hedge()
+	assert.True(t, hedged.Tried(c1))
+	assert.Equal(t, int64(1), c1.ActiveRequests())
+
+	// the callbacks run once when the stream is done
+	var calls int
+	hedged.OnDone(func() { calls++ })
+	hedged.Done()
+	hedged.Done()
+	assert.Equal(t, 1, calls)
+
+	hedged.OnDone(func() { calls++ })
+	assert.Equal(t, 2, calls)
+}
+
+func TestStreamWait(t *testing.T) {
+	var released int
+	s := &Stream{}
+	s.Wait(func() { released++ })
+	assert.True(t, s.Waiting())
+
+	// the pending request is released once when the request gets a stream
+	s.Dispatch()
+	s.Dispatch()
+	assert.False(t, s.Waiting())
+	assert.Equal(t, 1, released)
+
+	// or when the stream is done
+	s.Wait(func() { released++ })
+	s.Done()
+	assert.False(t, s.Waiting())
+	assert.Equal(t, 2, released)
+
+	s.Wait(func() { released++ })
+	assert.Equal(t, 3, released)
+}
+
+type fakeObserver struct {
+	results []Result
+}
+
+func (o *fakeObserver) ObserveResult(c *Connection, r Result) {
+	o.results = append(o.results, r)
+}
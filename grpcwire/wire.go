@@ -0,0 +1,150 @@
+package grpcwire
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+)
+
+// Wire types of the protobuf fields decoded
+const (
+	VarintType = 0
+	BytesType  = 2
+)
+
+var errMalformed = errors.New("[h2-proxy]: malformed protobuf message")
+
+// Field is a decoded protobuf field, Varint is the value of the varint fields
+// and Bytes the value of the length delimited ones
+type Field struct {
+	Num    uint64
+	Type   uint64
+	Varint uint64
+	Bytes  []byte
+}
+
+// Invoke calls the unary gRPC method in url with the encoded message returning the encoded
+// response, the messages the proxy sends itself (e.g. health checks) are small enough to be
+// encoded without the protobuf runtime
+func Invoke(ctx context.Context, rt http.RoundTripper, url string, msg []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(Frame(msg)))
+	if err != nil {
+		return nil, fmt.Errorf("[h2-proxy]: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("TE", "trailers")
+
+	rs, err := rt.RoundTrip(req)
+	if err != nil {
+		return nil, fmt.Errorf("[h2-proxy]: %w", err)
+	}
+	defer rs.Body.Close()
+
+	body, err := ioutil.ReadAll(rs.Body)
+	if err != nil {
+		return nil, fmt.Errorf("[h2-proxy]: %w", err)
+	}
+
+	// trailers only responses have the status in the headers
+	code := rs.Trailer.Get("grpc-status")
+	if code == "" {
+		code = rs.Header.Get("grpc-status")
+	}
+
+	if rs.StatusCode != http.StatusOK || code != "0" {
+		return nil, fmt.Errorf("[h2-proxy]: %s failed with status %d and grpc-status %s", req.URL.Path, rs.StatusCode, code)
+	}
+
+	return ReadFrame(body)
+}
+
+// Frame returns the message prefixed with the uncompressed flag and its length
+func Frame(msg []byte) []byte {
+	b := make([]byte, 5, 5+len(msg))
+	binary.BigEndian.PutUint32(b[1:], uint32(len(msg)))
+	return append(b, msg...)
+}
+
+// ReadFrame returns the message of the first frame in the body
+func ReadFrame(body []byte) ([]byte, error) {
+	if len(body) < 5 {
+		return nil, errors.New("[h2-proxy]: gRPC response without message")
+	}
+
+	if body[0] != 0 {
+		return nil, errors.New("[h2-proxy]: compressed gRPC response")
+	}
+
+	l := binary.BigEndian.Uint32(body[1:5])
+	if uint32(len(body)-5) < l {
+		return nil, errors.New("[h2-proxy]: truncated gRPC response")
+	}
+
+	return body[5 : 5+l], nil
+}
+
+// Fields decodes the fields of the message, the fixed size fields are skipped
+func Fields(msg []byte) ([]Field, error) {
+	var fields []Field
+	for len(msg) > 0 {
+		tag, n := binary.Uvarint(msg)
+		if n <= 0 {
+			return nil, errMalformed
+		}
+		msg = msg[n:]
+
+		f := Field{Num: tag >> 3, Type: tag & 7}
+		switch f.Type {
+		case VarintType:
+			if f.Varint, n = binary.Uvarint(msg); n <= 0 {
+				return nil, errMalformed
+			}
+			msg = msg[n:]
+		case BytesType:
+			l, n := binary.Uvarint(msg)
+			if n <= 0 || uint64(len(msg)-n) < l {
+				return nil, errMalformed
+			}
+			f.Bytes = msg[n : n+int(l)]
+			msg = msg[n+int(l):]
+		case 1, 5:
+			// 64 and 32 bit fields
+			size := 8
+			if f.Type == 5 {
+				size = 4
+			}
+
+			if len(msg) < size {
+				return nil, errMalformed
+			}
+			msg = msg[size:]
+			continue
+		default:
+			return nil, errMalformed
+		}
+		fields = append(fields, f)
+	}
+
+	return fields, nil
+}
+
+// AppendBytes appends a length delimited field
+func AppendBytes(b []byte, num uint64, v []byte) []byte {
+	b = AppendVarint(b, num<<3|BytesType)
+	b = AppendVarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+// AppendVarint appends v encoded as a varint
+func AppendVarint(b []byte, v uint64) []byte {
+	for v >= 0x80 {
+		b = append(b, byte(v)|0x80)
+		v >>= 7
+	}
+
+	return append(b, byte(v))
+}
@@ -0,0 +1,41 @@
+package grpcwire
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFields(t *testing.T) {
+	msg := AppendVarint([]byte{1 << 3}, 300)
+	msg = AppendBytes(msg, 2, []byte("users"))
+	// the fixed size fields are skipped
+	msg = append(msg, 3<<3|1, 0, 0, 0, 0, 0, 0, 0, 0, 4<<3|5, 0, 0, 0, 0)
+
+	fields, err := Fields(msg)
+	assert.NoError(t, err)
+	assert.Equal(t, []Field{
+		{Num: 1, Type: VarintType, Varint: 300},
+		{Num: 2, Type: BytesType, Bytes: []byte("users")},
+	}, fields)
+
+	for _, malformed := range [][]byte{{2<<3 | 2, 5, 'a'}, {1 << 3}, {1 << 3, 0x80}, {3<<3 | 1, 0}, {1<<3 | 3}} {
+		_, err := Fields(malformed)
+		assert.Error(t, err, malformed)
+	}
+}
+
+func TestFrame(t *testing.T) {
+	msg, err := ReadFrame(Frame([]byte{1 << 3, 1}))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{1 << 3, 1}, msg)
+
+	_, err = ReadFrame([]byte{0, 0, 0})
+	assert.Error(t, err)
+
+	_, err = ReadFrame([]byte{1, 0, 0, 0, 1, 1})
+	assert.Error(t, err)
+
+	_, err = ReadFrame([]byte{0, 0, 0, 0, 2, 1})
+	assert.Error(t, err)
+}
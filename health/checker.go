@@ -0,0 +1,150 @@
+package health
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"time"
+
+	"golang.org/x/net/http2"
+
+	"github.com/cperez08/h2-proxy/config"
+	"github.com/cperez08/h2-proxy/conn"
+)
+
+// Probe types
+const (
+	GRPC = "grpc"
+	HTTP = "http"
+	TCP  = "tcp"
+)
+
+// Checker probes the endpoints of a cluster, an endpoint becomes unhealthy after
+// unhealthy_threshold consecutive failures and healthy again after healthy_threshold
+// consecutive successes. Every probe uses its own connection so the result does not
+// depend on the state of the pooled ones
+type Checker struct {
+	cfg       *config.HealthCheckConfig
+	t         *http2.Transport
+	scheme    string
+	authority string
+	results   map[string]*result
+}
+
+// result keeps the consecutive probes with the same result of an endpoint
+type result struct {
+	healthy bool
+	count   int
+}
+
+// NewChecker returns a new checker, authority is sent in the http and gRPC probes. The probes
+// use a transport with the same settings as t but without its ConnPool, the pool is notified
+// about every connection of its transport closed
+func NewChecker(cfg *config.HealthCheckConfig, t *http2.Transport, authority string) *Checker {
+	scheme := "http"
+	if t.TLSClientConfig != nil {
+		scheme = "https"
+	}
+
+	pt := &http2.Transport{
+		TLSClientConfig:            t.TLSClientConfig,
+		DisableCompression:         t.DisableCompression,
+		AllowHTTP:                  t.AllowHTTP,
+		MaxHeaderListSize:          t.MaxHeaderListSize,
+		StrictMaxConcurrentStreams: t.StrictMaxConcurrentStreams,
+	}
+
+	return &Checker{cfg: cfg, t: pt, scheme: scheme, authority: authority, results: make(map[string]*result)}
+}
+
+// Interval returns the time between the probes
+func (c *Checker) Interval() time.Duration {
+	return time.Duration(c.cfg.Interval) * time.Second
+}
+
+// Probe probes the endpoint address, nil is returned when it is healthy
+func (c *Checker) Probe(addr string) error {
+	timeout := time.Duration(c.cfg.Timeout) * time.Millisecond
+	if c.cfg.Type == TCP {
+		nc, err := net.DialTimeout("tcp", addr, timeout)
+		if err != nil {
+			return fmt.Errorf("[h2-proxy]: %w", err)
+		}
+
+		return nc.Close()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	cc, err := conn.ConnectTimeout(c.t, addr, timeout)
+	if err != nil {
+		return err
+	}
+	defer cc.Close()
+
+	if c.cfg.Type == HTTP {
+		return c.probeHTTP(ctx, cc)
+	}
+
+	return c.probeGRPC(ctx, cc)
+}
+
+// Observe records the result of a probe of the endpoint returning if it is healthy,
+// healthy is the current state that only changes when the threshold is reached
+func (c *Checker) Observe(addr string, err error, healthy bool) bool {
+	ok := err == nil
+	r, found := c.results[addr]
+	if !found || r.healthy != ok {
+		r = &result{healthy: ok}
+		c.results[addr] = r
+	}
+	r.count++
+
+	switch {
+	case ok && !healthy && r.count >= c.cfg.HealthyThreshold:
+		return true
+	case !ok && healthy && r.count >= c.cfg.UnhealthyThreshold:
+		return false
+	default:
+		return healthy
+	}
+}
+
+// Forget removes the results of the endpoints not in addrs
+func (c *Checker) Forget(addrs []string) {
+	keep := make(map[string]bool, len(addrs))
+	for _, a := range addrs {
+		keep[a] = true
+	}
+
+	for a := range c.results {
+		if !keep[a] {
+			delete(c.results, a)
+		}
+	}
+}
+
+// probeHTTP expects a 200 response to a GET of the path
+func (c *Checker) probeHTTP(ctx context.Context, cc *http2.ClientConn) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.scheme+"://"+c.authority+c.cfg.Path, nil)
+	if err != nil {
+		return fmt.Errorf("[h2-proxy]: %w", err)
+	}
+
+	rs, err := cc.RoundTrip(req)
+	if err != nil {
+		return fmt.Errorf("[h2-proxy]: %w", err)
+	}
+	io.Copy(ioutil.Discard, rs.Body)
+	rs.Body.Close()
+
+	if rs.StatusCode != http.StatusOK {
+		return fmt.Errorf("[h2-proxy]: unexpected health check status %d", rs.StatusCode)
+	}
+
+	return nil
+}
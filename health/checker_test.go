@@ -0,0 +1,132 @@
+package health
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/http2"
+
+	"github.com/cperez08/h2-proxy/config"
+	"github.com/cperez08/h2-proxy/grpcwire"
+)
+
+func TestProbe(t *testing.T) {
+	var serving uint64 = servingStatus
+	lis := fakeServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/health":
+			w.WriteHeader(http.StatusOK)
+		case healthCheckPath:
+			b, _ := ioutil.ReadAll(r.Body)
+			msg, _ := grpcwire.ReadFrame(b)
+			if string(msg) != string(checkRequest("user.UserService")) {
+				w.Header().Set("grpc-status", "5")
+				return
+			}
+
+			w.Header().Set("Content-Type", "application/grpc")
+			w.Header().Set("Trailer", "grpc-status")
+			w.Write(grpcwire.Frame(grpcwire.AppendVarint([]byte{1 << 3}, serving)))
+			w.Header().Set("grpc-status", "0")
+		default:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer lis.Close()
+	addr := lis.Addr().String()
+
+	cfg := &config.HealthCheckConfig{Type: GRPC, Service: "user.UserService"}
+	cfg.Timeout, cfg.Path = 1000, "/health"
+	c := NewChecker(cfg, getTransport(), "localhost")
+	assert.NoError(t, c.Probe(addr))
+
+	serving = 2
+	assert.Error(t, c.Probe(addr))
+
+	cfg.Service = "order.OrderService"
+	assert.Error(t, c.Probe(addr))
+
+	cfg.Type = HTTP
+	assert.NoError(t, c.Probe(addr))
+
+	cfg.Path = "/other"
+	assert.Error(t, c.Probe(addr))
+
+	cfg.Type = TCP
+	assert.NoError(t, c.Probe(addr))
+
+	lis.Close()
+	assert.Error(t, c.Probe(addr))
+}
+
+func TestObserve(t *testing.T) {
+	c := NewChecker(&config.HealthCheckConfig{HealthyThreshold: 2, UnhealthyThreshold: 3}, getTransport(), "localhost")
+	errProbe := net.UnknownNetworkError("probe")
+
+	healthy := true
+	for i, expected := range []bool{true, true, false, false} {
+		healthy = c.Observe("a", errProbe, healthy)
+		assert.Equal(t, expected, healthy, i)
+	}
+
+	// a success resets the failures
+	healthy = c.Observe("a", nil, healthy)
+	assert.False(t, healthy)
+	healthy = c.Observe("a", errProbe, healthy)
+	healthy = c.Observe("a", nil, healthy)
+	assert.False(t, healthy)
+	healthy = c.Observe("a", nil, healthy)
+	assert.True(t, healthy)
+
+	c.Forget([]string{"b"})
+	assert.Empty(t, c.results)
+}
+
+func TestCheckResponseStatus(t *testing.T) {
+	assert.Equal(t, uint64(1), checkResponseStatus([]byte{1 << 3, 1}))
+	// unknown fields are skipped
+	assert.Equal(t, uint64(2), checkResponseStatus([]byte{2<<3 | 2, 1, 'a', 1 << 3, 2}))
+	assert.Equal(t, uint64(0), checkResponseStatus(nil))
+	assert.Equal(t, uint64(0), checkResponseStatus([]byte{2<<3 | 2, 5, 'a'}))
+
+	assert.Nil(t, checkRequest(""))
+	assert.Equal(t, []byte{1<<3 | 2, 1, 'a'}, checkRequest("a"))
+}
+
+func fakeServer(t *testing.T, h http.Handler) net.Listener {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+
+	go func() {
+		server := http2.Server{}
+		for {
+			c, err := lis.Accept()
+			if err != nil {
+				log.Println("error accepting new connection ", err)
+				return
+			}
+
+			go server.ServeConn(c, &http2.ServeConnOpts{Handler: h, BaseConfig: &http.Server{}})
+		}
+	}()
+
+	return lis
+}
+
+func getTransport() *http2.Transport {
+	return &http2.Transport{
+		DisableCompression: true,
+		AllowHTTP:          true,
+		DialTLS: func(netw, addr string, cfg *tls.Config) (net.Conn, error) {
+			return net.Dial(netw, addr)
+		},
+	}
+}
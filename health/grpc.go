@@ -0,0 +1,57 @@
+package health
+
+import (
+	"context"
+	"fmt"
+
+	"golang.org/x/net/http2"
+
+	"github.com/cperez08/h2-proxy/grpcwire"
+)
+
+const (
+	healthCheckPath = "/grpc.health.v1.Health/Check"
+	// servingStatus is HealthCheckResponse.ServingStatus SERVING
+	servingStatus = 1
+)
+
+// probeGRPC calls grpc.health.v1.Health/Check expecting the SERVING status
+func (c *Checker) probeGRPC(ctx context.Context, cc *http2.ClientConn) error {
+	msg, err := grpcwire.Invoke(ctx, cc, c.scheme+"://"+c.authority+healthCheckPath, checkRequest(c.cfg.Service))
+	if err != nil {
+		return err
+	}
+
+	if status := checkResponseStatus(msg); status != servingStatus {
+		return fmt.Errorf("[h2-proxy]: health check serving status %d", status)
+	}
+
+	return nil
+}
+
+// checkRequest encodes HealthCheckRequest, service is the field 1
+func checkRequest(service string) []byte {
+	if service == "" {
+		return nil
+	}
+
+	return grpcwire.AppendBytes(nil, 1, []byte(service))
+}
+
+// checkResponseStatus decodes the status (field 1) of HealthCheckResponse,
+// 0 (UNKNOWN) is returned when it is missing or the message is malformed
+func checkResponseStatus(msg []byte) uint64 {
+	fields, err := grpcwire.Fields(msg)
+	if err != nil {
+		return 0
+	}
+
+	var status uint64
+	for _, f := range fields {
+		if f.Num == 1 && f.Type == grpcwire.VarintType {
+			status = f.Varint
+		}
+	}
+
+	return status
+}
@@ -1,15 +1,24 @@
 package lb
 
-import "log"
+import (
+	"log"
+
+	"github.com/cperez08/h2-proxy/config"
+)
 
 // Balancer custom balancer type
 type Balancer string
 
 // all available balancer
 const (
-	None       Balancer = "none"
-	RoundRobin Balancer = "round_robin"
-	Random     Balancer = "random"
+	None               Balancer = "none"
+	RoundRobin         Balancer = "round_robin"
+	Random             Balancer = "random"
+	LeastRequest       Balancer = "least_request"
+	WeightedRoundRobin Balancer = "weighted_round_robin"
+	RingHash           Balancer = "ring_hash"
+	Maglev             Balancer = "maglev"
+	PeakEWMA           Balancer = "peak_ewma"
 )
 
 // GetBalancer returns a new balancer instance
@@ -21,8 +30,41 @@ func GetBalancer(b Balancer) LoadBalancer {
 		return &RoundRobinLB{}
 	case Random:
 		return &RandomLB{}
+	case LeastRequest:
+		return &LeastRequestLB{}
+	case WeightedRoundRobin:
+		return &WeightedRoundRobinLB{}
+	case PeakEWMA:
+		return &PeakEWMALB{}
+	case RingHash:
+		return NewRingHash(nil)
+	case Maglev:
+		return NewMaglev(nil)
 	default:
 		log.Println("invalid balancer ", b, " defult set up")
 		return &NoBalancer{}
 	}
 }
+
+// NewBalancer returns a new instance of the balancer in the DNS configuration,
+// the hash policy is used by the consistent hash balancers and the slow
+// start by the weighted round robin and least request ones, the balancer
+// is wrapped by the zone aware one when it is enabled
+func NewBalancer(cfg *config.DNSConfig) LoadBalancer {
+	if cfg.ZoneAware != nil {
+		return NewZoneAware(cfg)
+	}
+
+	switch Balancer(cfg.BalancerAlg) {
+	case LeastRequest:
+		return NewLeastRequest(cfg.SlowStart)
+	case WeightedRoundRobin:
+		return NewWeightedRoundRobin(cfg.SlowStart)
+	case RingHash:
+		return NewRingHash(cfg.HashPolicy)
+	case Maglev:
+		return NewMaglev(cfg.HashPolicy)
+	default:
+		return GetBalancer(Balancer(cfg.BalancerAlg))
+	}
+}
@@ -21,6 +21,24 @@ func TestGetBalancer(t *testing.T) {
 		t.Fail()
 	}
 
+	b = GetBalancer(LeastRequest)
+	if _, ok := b.(*LeastRequestLB); !ok {
+		t.Log("should return least request balancer")
+		t.Fail()
+	}
+
+	b = GetBalancer(WeightedRoundRobin)
+	if _, ok := b.(*WeightedRoundRobinLB); !ok {
+		t.Log("should return weighted round robin balancer")
+		t.Fail()
+	}
+
+	b = GetBalancer(PeakEWMA)
+	if _, ok := b.(*PeakEWMALB); !ok {
+		t.Log("should return peak ewma balancer")
+		t.Fail()
+	}
+
 	b = GetBalancer(Balancer("other"))
 	if _, ok := b.(*NoBalancer); !ok {
 		t.Log("should return no balancer")
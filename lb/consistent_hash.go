@@ -0,0 +1,44 @@
+package lb
+
+import (
+	"math/rand"
+	"net/http"
+
+	"github.com/cperez08/h2-proxy/config"
+	"github.com/cperez08/h2-proxy/conn"
+)
+
+// requestKey returns the hash of the request attribute, requests without the
+// attribute (or no request) get a random key so they are spread across the connections
+func requestKey(r *http.Request, p *config.HashPolicy) uint64 {
+	if r == nil {
+		return rand.Uint64()
+	}
+
+	if h, ok := RequestHash(r, p); ok {
+		return h
+	}
+
+	return rand.Uint64()
+}
+
+// available returns the first active connection starting at the position i and
+// probing the next ones, at returns the connection in a position
+func available(n, i int, at func(int) *conn.Connection) *conn.Connection {
+	for j := 0; j < n; j++ {
+		if c := at((i + j) % n); c.IsAvailable() {
+			return c
+		}
+	}
+
+	return nil
+}
+
+// weight returns the connection weight, connections without weight count as 1
+func weight(c *conn.Connection) int {
+	if c.Weight <= 0 {
+		return 1
+	}
+
+	return c.Weight
+}
@@ -0,0 +1,51 @@
+package lb
+
+import (
+	"hash/fnv"
+	"net"
+	"net/http"
+
+	"github.com/cperez08/h2-proxy/config"
+)
+
+// RequestHash returns the hash of the request attribute selected by the policy,
+// false is returned when the request does not have the attribute
+func RequestHash(r *http.Request, p *config.HashPolicy) (uint64, bool) {
+	if p == nil {
+		return 0, false
+	}
+
+	var key string
+	switch {
+	case p.Header != "":
+		key = r.Header.Get(p.Header)
+	case p.Path:
+		key = r.URL.Path
+	case p.ClientIP:
+		key = r.RemoteAddr
+		if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+			key = host
+		}
+	}
+
+	if key == "" {
+		return 0, false
+	}
+
+	return Hash(key), true
+}
+
+// Hash returns the 64 bits FNV-1a hash of the key, the result is mixed (murmur3 finalizer)
+// since FNV alone does not spread well keys that only differ in the last characters
+func Hash(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
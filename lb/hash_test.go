@@ -0,0 +1,35 @@
+package lb
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/cperez08/h2-proxy/config"
+)
+
+func TestRequestHash(t *testing.T) {
+	r, _ := http.NewRequest(http.MethodPost, "http://localhost/user.UserService/GetUser", nil)
+	r.Header.Set("x-user-id", "123")
+	r.RemoteAddr = "10.0.0.1:53000"
+
+	_, ok := RequestHash(r, nil)
+	assert.False(t, ok)
+
+	h, ok := RequestHash(r, &config.HashPolicy{Header: "x-user-id"})
+	assert.True(t, ok)
+	assert.Equal(t, Hash("123"), h)
+
+	_, ok = RequestHash(r, &config.HashPolicy{Header: "x-other"})
+	assert.False(t, ok)
+
+	h, ok = RequestHash(r, &config.HashPolicy{Path: true})
+	assert.True(t, ok)
+	assert.Equal(t, Hash("/user.UserService/GetUser"), h)
+
+	// the port is not part of the hash
+	h, ok = RequestHash(r, &config.HashPolicy{ClientIP: true})
+	assert.True(t, ok)
+	assert.Equal(t, Hash("10.0.0.1"), h)
+}
@@ -0,0 +1,69 @@
+package lb
+
+import (
+	"math/rand"
+	"time"
+
+	"github.com/cperez08/h2-proxy/config"
+	"github.com/cperez08/h2-proxy/conn"
+)
+
+// LeastRequestLB picks the connection with fewer requests in flight between
+// two random connections (power of two choices), it avoids sending more requests
+// to slow targets without the cost of checking the whole pool
+type LeastRequestLB struct {
+	slowStart *config.SlowStartConfig
+}
+
+// NewLeastRequest returns a new least request balancer,
+// the new connections are ramped up when slow start is set
+func NewLeastRequest(slowStart *config.SlowStartConfig) LoadBalancer {
+	return &LeastRequestLB{slowStart: slowStart}
+}
+
+// PickConnection picks the least loaded of two random active connections, the load
+// of the connections in slow start is increased according to their share of the weight
+func (l *LeastRequestLB) PickConnection(pool []*conn.Connection) *conn.Connection {
+	now := time.Now()
+	return pickTwo(pool, func(c *conn.Connection) float64 {
+		return float64(c.ActiveRequests()+1) / slowStartFactor(c, l.slowStart, now)
+	})
+}
+
+// RebuildBalancer useless for this balancer
+func (l *LeastRequestLB) RebuildBalancer(pool []*conn.Connection) {}
+
+// pickTwo picks two different random connections and returns the active one with the
+// lowest cost, when only one of them is active it is returned
+func pickTwo(pool []*conn.Connection, cost func(*conn.Connection) float64) *conn.Connection {
+	// avoid error in rand.Intn with 0 value
+	if len(pool) == 0 {
+		return nil
+	}
+
+	n := len(pool)
+	for i := 0; i < MaxRetries; i++ {
+		x := rand.Intn(n)
+		y := x
+		if n > 1 {
+			// a different connection is always picked as second choice
+			y = (x + 1 + rand.Intn(n-1)) % n
+		}
+
+		a, b := pool[x], pool[y]
+		aOk, bOk := a.IsAvailable(), b.IsAvailable()
+		switch {
+		case aOk && bOk:
+			if cost(b) < cost(a) {
+				return b
+			}
+			return a
+		case aOk:
+			return a
+		case bOk:
+			return b
+		}
+	}
+
+	return nil
+}
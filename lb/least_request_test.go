@@ -0,0 +1,76 @@
+package lb
+
+import (
+	"testing"
+
+	"github.com/cperez08/h2-proxy/conn"
+)
+
+func TestPickConnectionFromLeastRequestBalancer(t *testing.T) {
+	b := GetBalancer(LeastRequest)
+	if _, ok := b.(*LeastRequestLB); !ok {
+		t.Log("should return least request balancer")
+		t.Fail()
+	}
+
+	pool := []*conn.Connection{
+		{
+			Address:     "localhost:8070",
+			IsActive:    true,
+			IsConnected: true,
+		},
+		{
+			Address:     "localhost:8080",
+			IsActive:    true,
+			IsConnected: true,
+		},
+	}
+
+	// the first connection has requests in flight
+	streams := make([]*conn.Stream, 3)
+	for i := range streams {
+		streams[i] = &conn.Stream{}
+		streams[i].Attach(pool[0])
+	}
+
+	for i := 0; i < 100; i++ {
+		if c := b.PickConnection(pool); c != pool[1] {
+			t.Log("return unexpected connection", c.Address)
+			t.FailNow()
+		}
+	}
+
+	// once the requests are completed both connections are picked
+	for _, s := range streams {
+		s.Done()
+	}
+
+	picked := map[*conn.Connection]bool{}
+	for i := 0; i < 100; i++ {
+		picked[b.PickConnection(pool)] = true
+	}
+
+	if !picked[pool[0]] || !picked[pool[1]] {
+		t.Log("expecting both connections picked")
+		t.Fail()
+	}
+
+	pool[1].IsConnected = false
+	if c := b.PickConnection(pool); c != pool[0] {
+		t.Log("return unexpected connection")
+		t.Fail()
+	}
+
+	pool[0].IsActive = false
+	if c := b.PickConnection(pool); c != nil {
+		t.Log("return unexpected connection")
+		t.Fail()
+	}
+
+	if c := b.PickConnection([]*conn.Connection{}); c != nil {
+		t.Log("return unexpected connection")
+		t.Fail()
+	}
+
+	b.RebuildBalancer(pool) // increase coverage this does not do anything
+}
@@ -0,0 +1,92 @@
+package lb
+
+import (
+	"net/http"
+	"sync"
+
+	"github.com/cperez08/h2-proxy/config"
+	"github.com/cperez08/h2-proxy/conn"
+)
+
+// maglevTableSize is prime as required by the permutations
+const maglevTableSize = 65537
+
+// MaglevLB builds a lookup table where every connection fills positions following
+// its own permutation (Maglev, Google NSDI 2016), the request key indexes the table.
+// Picks are O(1) and the changes in the connections remap a minimal number of keys
+type MaglevLB struct {
+	policy *config.HashPolicy
+	m      sync.RWMutex
+	table  []*conn.Connection
+}
+
+// NewMaglev returns a new maglev balancer hashing the request attribute
+// selected by the policy, without policy the connections are picked randomly
+func NewMaglev(p *config.HashPolicy) LoadBalancer {
+	return &MaglevLB{policy: p}
+}
+
+// PickConnection picks a random connection since there is no request key
+func (l *MaglevLB) PickConnection(pool []*conn.Connection) *conn.Connection {
+	return l.PickConnectionForRequest(pool, nil)
+}
+
+// PickConnectionForRequest picks the connection in the table position of the request key,
+// the next positions are probed when the connection is not available
+func (l *MaglevLB) PickConnectionForRequest(pool []*conn.Connection, r *http.Request) *conn.Connection {
+	l.m.RLock()
+	defer l.m.RUnlock()
+
+	if len(l.table) == 0 {
+		return nil
+	}
+
+	i := int(requestKey(r, l.policy) % uint64(len(l.table)))
+	return available(len(l.table), i, func(i int) *conn.Connection { return l.table[i] })
+}
+
+// RebuildBalancer fills the table with the current connections, in every round each
+// connection takes the next free position of its permutation proportionally to its weight
+func (l *MaglevLB) RebuildBalancer(pool []*conn.Connection) {
+	if len(pool) == 0 {
+		l.m.Lock()
+		l.table = nil
+		l.m.Unlock()
+		return
+	}
+
+	offsets := make([]uint64, len(pool))
+	skips := make([]uint64, len(pool))
+	next := make([]uint64, len(pool))
+	credits := make([]float64, len(pool))
+	var maxWeight int
+	for i, c := range pool {
+		offsets[i] = Hash("offset:"+c.Address) % maglevTableSize
+		skips[i] = Hash("skip:"+c.Address)%(maglevTableSize-1) + 1
+		if w := weight(c); w > maxWeight {
+			maxWeight = w
+		}
+	}
+
+	table := make([]*conn.Connection, maglevTableSize)
+	for filled := 0; filled < maglevTableSize; {
+		for i, c := range pool {
+			credits[i] += float64(weight(c)) / float64(maxWeight)
+			for ; credits[i] >= 1 && filled < maglevTableSize; credits[i]-- {
+				pos := (offsets[i] + next[i]*skips[i]) % maglevTableSize
+				for table[pos] != nil {
+					next[i]++
+					pos = (offsets[i] + next[i]*skips[i]) % maglevTableSize
+				}
+
+				table[pos] = c
+				next[i]++
+				filled++
+			}
+		}
+	}
+
+	l.m.Lock()
+	l.table = table
+	l.m.Unlock()
+}
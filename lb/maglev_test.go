@@ -0,0 +1,34 @@
+package lb
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/cperez08/h2-proxy/config"
+)
+
+func TestPickConnectionFromMaglevBalancer(t *testing.T) {
+	b := NewBalancer(&config.DNSConfig{BalancerAlg: string(Maglev), HashPolicy: &config.HashPolicy{Header: "x-user-id"}})
+	if _, ok := b.(*MaglevLB); !ok {
+		t.Log("should return maglev balancer")
+		t.FailNow()
+	}
+
+	testConsistentHash(t, b.(RequestBalancer))
+}
+
+func TestMaglevWeights(t *testing.T) {
+	b := NewMaglev(nil).(*MaglevLB)
+	pool := newHashPool(2)
+	pool[0].Weight = 3
+	b.RebuildBalancer(pool)
+
+	counts := make(map[string]int)
+	for _, c := range b.table {
+		counts[c.Address]++
+	}
+
+	assert.InDelta(t, maglevTableSize*3/4, counts[pool[0].Address], 100)
+	assert.InDelta(t, maglevTableSize/4, counts[pool[1].Address], 100)
+}
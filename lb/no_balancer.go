@@ -9,7 +9,7 @@ type NoBalancer struct{}
 // PickConnection return the first active connection found
 func (l *NoBalancer) PickConnection(pool []*conn.Connection) *conn.Connection {
 	for i := 0; i < len(pool); i++ {
-		if pool[i].IsActive && pool[i].IsConnected {
+		if pool[i].IsAvailable() {
 			return pool[i]
 		}
 	}
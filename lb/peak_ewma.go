@@ -0,0 +1,21 @@
+package lb
+
+import (
+	"github.com/cperez08/h2-proxy/conn"
+)
+
+// PeakEWMALB picks between two random connections the one with the lowest cost, the
+// cost is the peak EWMA of the response latency multiplied by the requests in flight,
+// the traffic naturally prefers the fastest targets while the slow ones are still probed
+type PeakEWMALB struct{}
+
+// PickConnection picks the cheapest of two random active connections
+func (l *PeakEWMALB) PickConnection(pool []*conn.Connection) *conn.Connection {
+	return pickTwo(pool, func(c *conn.Connection) float64 {
+		// 1ns is added so the connections with no latency are compared by load
+		return (float64(c.Latency()) + 1) * float64(c.ActiveRequests()+1)
+	})
+}
+
+// RebuildBalancer useless for this balancer
+func (l *PeakEWMALB) RebuildBalancer(pool []*conn.Connection) {}
@@ -0,0 +1,69 @@
+package lb
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cperez08/h2-proxy/conn"
+)
+
+func TestPickConnectionFromPeakEWMABalancer(t *testing.T) {
+	b := GetBalancer(PeakEWMA)
+	if _, ok := b.(*PeakEWMALB); !ok {
+		t.Log("should return peak ewma balancer")
+		t.Fail()
+	}
+
+	pool := []*conn.Connection{
+		{
+			Address:     "localhost:8070",
+			IsActive:    true,
+			IsConnected: true,
+		},
+		{
+			Address:     "localhost:8080",
+			IsActive:    true,
+			IsConnected: true,
+		},
+	}
+
+	// the first connection is in a far zone
+	pool[0].ObserveLatency(80 * time.Millisecond)
+	pool[1].ObserveLatency(5 * time.Millisecond)
+
+	for i := 0; i < 100; i++ {
+		if c := b.PickConnection(pool); c != pool[1] {
+			t.Log("return unexpected connection", c.Address)
+			t.FailNow()
+		}
+	}
+
+	// the fast connection is used until its load makes it more expensive
+	streams := make([]*conn.Stream, 20)
+	for i := range streams {
+		streams[i] = &conn.Stream{}
+		streams[i].Attach(pool[1])
+	}
+
+	if c := b.PickConnection(pool); c != pool[0] {
+		t.Log("return unexpected connection", c.Address)
+		t.Fail()
+	}
+
+	for _, s := range streams {
+		s.Done()
+	}
+
+	pool[1].IsConnected = false
+	if c := b.PickConnection(pool); c != pool[0] {
+		t.Log("return unexpected connection")
+		t.Fail()
+	}
+
+	if c := b.PickConnection([]*conn.Connection{}); c != nil {
+		t.Log("return unexpected connection")
+		t.Fail()
+	}
+
+	b.RebuildBalancer(pool) // increase coverage this does not do anything
+}
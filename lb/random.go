@@ -18,7 +18,7 @@ func (l *RandomLB) PickConnection(pool []*conn.Connection) *conn.Connection {
 
 	for i := 0; i < MaxRetries; i++ {
 		r := rand.Intn(len(pool))
-		if pool[r].IsActive && pool[r].IsConnected {
+		if pool[r].IsAvailable() {
 			return pool[r]
 		}
 	}
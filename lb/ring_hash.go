@@ -0,0 +1,72 @@
+package lb
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+
+	"github.com/cperez08/h2-proxy/config"
+	"github.com/cperez08/h2-proxy/conn"
+)
+
+// ringReplicas number of virtual nodes of a connection per unit of weight
+const ringReplicas = 128
+
+// RingHashLB places every connection several times in a hash ring (proportionally to its
+// weight) and picks the first connection after the hash of the request key, when the
+// connections change only the keys of the added or removed ones are remapped
+type RingHashLB struct {
+	policy *config.HashPolicy
+	m      sync.RWMutex
+	ring   []ringEntry // sorted by hash
+}
+
+type ringEntry struct {
+	hash uint64
+	conn *conn.Connection
+}
+
+// NewRingHash returns a new ring hash balancer hashing the request attribute
+// selected by the policy, without policy the connections are picked randomly
+func NewRingHash(p *config.HashPolicy) LoadBalancer {
+	return &RingHashLB{policy: p}
+}
+
+// PickConnection picks a random connection since there is no request key
+func (l *RingHashLB) PickConnection(pool []*conn.Connection) *conn.Connection {
+	return l.PickConnectionForRequest(pool, nil)
+}
+
+// PickConnectionForRequest picks the connection owning the request key in the ring,
+// the next active connection in the ring is used when it is not available
+func (l *RingHashLB) PickConnectionForRequest(pool []*conn.Connection, r *http.Request) *conn.Connection {
+	l.m.RLock()
+	defer l.m.RUnlock()
+
+	if len(l.ring) == 0 {
+		return nil
+	}
+
+	key := requestKey(r, l.policy)
+	i := sort.Search(len(l.ring), func(i int) bool { return l.ring[i].hash >= key })
+	return available(len(l.ring), i, func(i int) *conn.Connection { return l.ring[i].conn })
+}
+
+// RebuildBalancer builds the ring with the current connections
+func (l *RingHashLB) RebuildBalancer(pool []*conn.Connection) {
+	var ring []ringEntry
+	for _, c := range pool {
+		// the virtual nodes only depend on the address and the weight so
+		// they do not move when other connections are added or removed
+		for i := 0; i < ringReplicas*weight(c); i++ {
+			ring = append(ring, ringEntry{hash: Hash(fmt.Sprintf("%s_%d", c.Address, i)), conn: c})
+		}
+	}
+
+	sort.Slice(ring, func(i, j int) bool { return ring[i].hash < ring[j].hash })
+
+	l.m.Lock()
+	l.ring = ring
+	l.m.Unlock()
+}
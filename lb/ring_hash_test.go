@@ -0,0 +1,92 @@
+package lb
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/cperez08/h2-proxy/config"
+	"github.com/cperez08/h2-proxy/conn"
+)
+
+func TestPickConnectionFromRingHashBalancer(t *testing.T) {
+	b := NewBalancer(&config.DNSConfig{BalancerAlg: string(RingHash), HashPolicy: &config.HashPolicy{Header: "x-user-id"}})
+	if _, ok := b.(*RingHashLB); !ok {
+		t.Log("should return ring hash balancer")
+		t.FailNow()
+	}
+
+	testConsistentHash(t, b.(RequestBalancer))
+}
+
+// testConsistentHash checks the keys are sticky, only the keys of a removed
+// connection are remapped and unavailable connections are skipped
+func testConsistentHash(t *testing.T, b RequestBalancer) {
+	pool := newHashPool(5)
+	b.RebuildBalancer(pool)
+
+	picked := make(map[string]*conn.Connection)
+	counts := make(map[*conn.Connection]int)
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("user-%d", i)
+		c := b.PickConnectionForRequest(pool, hashRequest(key))
+		assert.Equal(t, c, b.PickConnectionForRequest(pool, hashRequest(key)), key)
+		picked[key] = c
+		counts[c]++
+	}
+
+	// every connection owns a fair part of the keys
+	for _, c := range pool {
+		assert.InDelta(t, 200, counts[c], 100, c.Address)
+	}
+
+	removed := pool[2]
+	pool = append(pool[:2:2], pool[3:]...)
+	b.RebuildBalancer(pool)
+
+	var moved int
+	for key, c := range picked {
+		now := b.PickConnectionForRequest(pool, hashRequest(key))
+		assert.NotEqual(t, removed, now)
+		if c != removed && c != now {
+			moved++
+		}
+	}
+	assert.LessOrEqual(t, moved, 20)
+
+	// the keys of an unavailable connection go to other connections without rebuilding
+	pool[0].IsConnected = false
+	for i := 0; i < 100; i++ {
+		c := b.PickConnectionForRequest(pool, hashRequest(fmt.Sprintf("user-%d", i)))
+		if assert.NotNil(t, c) {
+			assert.NotEqual(t, pool[0], c)
+		}
+	}
+
+	// requests without key and calls without request are spread
+	assert.NotNil(t, b.PickConnection(pool))
+	assert.NotNil(t, b.PickConnectionForRequest(pool, hashRequest("")))
+
+	b.RebuildBalancer(nil)
+	assert.Nil(t, b.PickConnection(nil))
+}
+
+func newHashPool(n int) []*conn.Connection {
+	pool := make([]*conn.Connection, n)
+	for i := range pool {
+		pool[i] = &conn.Connection{Address: fmt.Sprintf("10.0.0.%d:50051", i+1), IsActive: true, IsConnected: true}
+	}
+
+	return pool
+}
+
+func hashRequest(userID string) *http.Request {
+	r, _ := http.NewRequest(http.MethodPost, "http://localhost/user.UserService/GetUser", nil)
+	if userID != "" {
+		r.Header.Set("x-user-id", userID)
+	}
+
+	return r
+}
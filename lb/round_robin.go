@@ -24,10 +24,16 @@ func NewRoundRobin() LoadBalancer {
 func (l *RoundRobinLB) PickConnection(pool []*conn.Connection) *conn.Connection {
 	l.m.Lock()
 	defer l.m.Unlock()
+	// the balancer can be used with several pools e.g. by the zone aware balancer
+	if len(pool) == 0 {
+		return nil
+	}
+
+	l.next %= len(pool)
 	for i := 0; i < MaxRetries; i++ {
 		p := pool[l.next]
 		l.next = (l.next + 1) % len(pool)
-		if p.IsActive && p.IsConnected {
+		if p.IsAvailable() {
 			return p
 		}
 	}
@@ -1,6 +1,8 @@
 package lb
 
 import (
+	"net/http"
+
 	"github.com/cperez08/h2-proxy/conn"
 )
 
@@ -15,3 +17,21 @@ type LoadBalancer interface {
 	// RebuildBalancer notify the balancer about changes in the pool
 	RebuildBalancer(pool []*conn.Connection)
 }
+
+// RequestBalancer is implemented by the balancers that need the request to pick
+// the connection, e.g. the ones hashing a request attribute
+type RequestBalancer interface {
+	LoadBalancer
+	// PickConnectionForRequest returns the balanced connection for the request
+	PickConnectionForRequest(pool []*conn.Connection, r *http.Request) *conn.Connection
+}
+
+// Pick returns the connection picked by the balancer, the request is
+// only used when the balancer is a RequestBalancer
+func Pick(b LoadBalancer, pool []*conn.Connection, r *http.Request) *conn.Connection {
+	if rb, ok := b.(RequestBalancer); ok {
+		return rb.PickConnectionForRequest(pool, r)
+	}
+
+	return b.PickConnection(pool)
+}
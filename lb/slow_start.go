@@ -0,0 +1,27 @@
+package lb
+
+import (
+	"math"
+	"time"
+
+	"github.com/cperez08/h2-proxy/config"
+	"github.com/cperez08/h2-proxy/conn"
+)
+
+// slowStartFactor returns the share of its weight a connection receives, the connections
+// added by a refresh start with the minimum share and reach the full weight at the end of
+// the window following (elapsed / window) ^ (1 / aggression)
+func slowStartFactor(c *conn.Connection, cfg *config.SlowStartConfig, now time.Time) float64 {
+	if cfg == nil || c.AddedAt.IsZero() {
+		return 1
+	}
+
+	window := time.Duration(cfg.Window) * time.Second
+	elapsed := now.Sub(c.AddedAt)
+	if elapsed >= window {
+		return 1
+	}
+
+	factor := math.Pow(float64(elapsed)/float64(window), 1/cfg.Aggression)
+	return math.Max(factor, cfg.MinWeightPercent/100)
+}
@@ -0,0 +1,60 @@
+package lb
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/cperez08/h2-proxy/config"
+	"github.com/cperez08/h2-proxy/conn"
+)
+
+func TestSlowStartFactor(t *testing.T) {
+	now := time.Now()
+	cfg := &config.SlowStartConfig{Window: 100, Aggression: 1, MinWeightPercent: 10}
+
+	// the initial connections and the ones out of the window have the full weight
+	assert.Equal(t, 1.0, slowStartFactor(&conn.Connection{}, cfg, now))
+	assert.Equal(t, 1.0, slowStartFactor(&conn.Connection{AddedAt: now.Add(-time.Hour)}, cfg, now))
+	assert.Equal(t, 1.0, slowStartFactor(&conn.Connection{AddedAt: now}, nil, now))
+
+	assert.Equal(t, 0.1, slowStartFactor(&conn.Connection{AddedAt: now}, cfg, now))
+	assert.InDelta(t, 0.5, slowStartFactor(&conn.Connection{AddedAt: now.Add(-50 * time.Second)}, cfg, now), 0.001)
+
+	// higher aggression ramps up faster
+	cfg.Aggression = 2
+	assert.InDelta(t, 0.707, slowStartFactor(&conn.Connection{AddedAt: now.Add(-50 * time.Second)}, cfg, now), 0.001)
+}
+
+func TestSlowStartBalancers(t *testing.T) {
+	slowStart := &config.SlowStartConfig{Window: 60, Aggression: 1, MinWeightPercent: 10}
+	newPool := func() []*conn.Connection {
+		return []*conn.Connection{
+			{Address: "localhost:8070", IsActive: true, IsConnected: true},
+			{Address: "localhost:8080", IsActive: true, IsConnected: true, AddedAt: time.Now()},
+		}
+	}
+
+	pool := newPool()
+	b := NewBalancer(&config.DNSConfig{BalancerAlg: string(WeightedRoundRobin), SlowStart: slowStart})
+	picked := map[*conn.Connection]int{}
+	for i := 0; i < 110; i++ {
+		picked[b.PickConnection(pool)]++
+	}
+	assert.InDelta(t, 100, picked[pool[0]], 2)
+	assert.InDelta(t, 10, picked[pool[1]], 2)
+
+	// the warming up connection has fewer requests in flight but it is not picked yet
+	pool = newPool()
+	b = NewBalancer(&config.DNSConfig{BalancerAlg: string(LeastRequest), SlowStart: slowStart})
+	s := &conn.Stream{}
+	s.Attach(pool[0])
+	defer s.Done()
+	for i := 0; i < 10; i++ {
+		if c := b.PickConnection(pool); c != pool[0] {
+			t.Log("return unexpected connection", c.Address)
+			t.Fail()
+		}
+	}
+}
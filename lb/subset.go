@@ -0,0 +1,161 @@
+package lb
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/cperez08/h2-proxy/conn"
+)
+
+// SubsetFallback indicates the connections used when the subset of the request is empty
+type SubsetFallback string
+
+// all available fallback policies
+const (
+	AnyEndpoint   SubsetFallback = "any_endpoint"
+	NoFallback    SubsetFallback = "no_fallback"
+	DefaultSubset SubsetFallback = "default_subset"
+)
+
+type subsetKey struct{}
+
+// Subset selects the connections having all the metadata values
+type Subset struct {
+	Metadata map[string]string
+	Fallback SubsetFallback
+	Default  map[string]string // metadata of the default_subset fallback
+}
+
+// WithSubset returns a copy of ctx carrying the subset selected for the request
+func WithSubset(ctx context.Context, s *Subset) context.Context {
+	return context.WithValue(ctx, subsetKey{}, s)
+}
+
+// SubsetFromContext returns the subset in ctx, nil if there is none
+func SubsetFromContext(ctx context.Context) *Subset {
+	s, _ := ctx.Value(subsetKey{}).(*Subset)
+	return s
+}
+
+// SubsetLB picks the connection in the subset of the request, every subset is balanced
+// by its own instance of the configured balancer, requests without subset use the whole pool
+type SubsetLB struct {
+	newBalancer func() LoadBalancer
+	all         LoadBalancer
+
+	m       sync.Mutex
+	pool    []*conn.Connection
+	subsets map[string]*subsetPool
+}
+
+// subsetPool is a non empty subset of the connections with its balancer
+type subsetPool struct {
+	pool     []*conn.Connection
+	balancer LoadBalancer
+}
+
+// NewSubset returns a new subset balancer, newBalancer returns the balancer of every subset
+func NewSubset(newBalancer func() LoadBalancer) LoadBalancer {
+	return &SubsetLB{newBalancer: newBalancer, all: newBalancer(), subsets: make(map[string]*subsetPool)}
+}
+
+// PickConnection picks a connection from the whole pool
+func (l *SubsetLB) PickConnection(pool []*conn.Connection) *conn.Connection {
+	return l.PickConnectionForRequest(pool, nil)
+}
+
+// PickConnectionForRequest picks a connection in the subset of the request,
+// the fallback policy is applied when the subset has no active connections
+func (l *SubsetLB) PickConnectionForRequest(pool []*conn.Connection, r *http.Request) *conn.Connection {
+	var s *Subset
+	if r != nil {
+		s = SubsetFromContext(r.Context())
+	}
+
+	if s == nil {
+		return Pick(l.all, pool, r)
+	}
+
+	if c := l.pickSubset(s.Metadata, r); c != nil {
+		return c
+	}
+
+	switch s.Fallback {
+	case NoFallback:
+		return nil
+	case DefaultSubset:
+		return l.pickSubset(s.Default, r)
+	default:
+		return Pick(l.all, pool, r)
+	}
+}
+
+// RebuildBalancer rebuilds the balancer of the whole pool, the subsets are built again when used
+func (l *SubsetLB) RebuildBalancer(pool []*conn.Connection) {
+	l.m.Lock()
+	l.pool = pool
+	l.subsets = make(map[string]*subsetPool)
+	l.all.RebuildBalancer(pool)
+	l.m.Unlock()
+}
+
+// pickSubset picks a connection in the subset matching the metadata, only the non empty
+// subsets are kept so the values sent by the clients can not grow them without limit
+func (l *SubsetLB) pickSubset(metadata map[string]string, r *http.Request) *conn.Connection {
+	if len(metadata) == 0 {
+		return nil
+	}
+
+	key := subsetKeyOf(metadata)
+
+	l.m.Lock()
+	sp, ok := l.subsets[key]
+	if !ok {
+		var pool []*conn.Connection
+		for _, c := range l.pool {
+			if matchMetadata(c.Metadata, metadata) {
+				pool = append(pool, c)
+			}
+		}
+
+		if len(pool) > 0 {
+			sp = &subsetPool{pool: pool, balancer: l.newBalancer()}
+			sp.balancer.RebuildBalancer(pool)
+			l.subsets[key] = sp
+		}
+	}
+	l.m.Unlock()
+
+	if sp == nil {
+		return nil
+	}
+
+	return Pick(sp.balancer, sp.pool, r)
+}
+
+// matchMetadata indicates if the connection metadata has all the selected values
+func matchMetadata(metadata, selector map[string]string) bool {
+	for k, v := range selector {
+		if mv, ok := metadata[k]; !ok || mv != v {
+			return false
+		}
+	}
+
+	return true
+}
+
+// subsetKeyOf returns the metadata sorted by key as k="v" pairs, the values
+// come from the request headers so they are quoted to keep the keys unique
+func subsetKeyOf(metadata map[string]string) string {
+	pairs := make([]string, 0, len(metadata))
+	for k, v := range metadata {
+		pairs = append(pairs, k+"="+strconv.Quote(v))
+	}
+	sort.Strings(pairs)
+
+	return strings.Join(pairs, ",")
+}
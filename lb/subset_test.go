@@ -0,0 +1,65 @@
+package lb
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/cperez08/h2-proxy/conn"
+)
+
+func TestPickConnectionFromSubsetBalancer(t *testing.T) {
+	b := NewSubset(NewRoundRobin).(RequestBalancer)
+	pool := []*conn.Connection{
+		{Address: "10.0.0.1:8080", IsActive: true, IsConnected: true, Metadata: map[string]string{"version": "v1", "shard": "1"}},
+		{Address: "10.0.0.2:8080", IsActive: true, IsConnected: true, Metadata: map[string]string{"version": "v1", "shard": "2"}},
+		{Address: "10.0.0.3:8080", IsActive: true, IsConnected: true, Metadata: map[string]string{"version": "v2", "shard": "1"}},
+	}
+	b.RebuildBalancer(pool)
+
+	// requests without subset use the whole pool
+	picked := map[string]int{}
+	for i := 0; i < 30; i++ {
+		picked[b.PickConnection(pool).Address]++
+	}
+	assert.Equal(t, map[string]int{"10.0.0.1:8080": 10, "10.0.0.2:8080": 10, "10.0.0.3:8080": 10}, picked)
+
+	picked = map[string]int{}
+	for i := 0; i < 30; i++ {
+		picked[b.PickConnectionForRequest(pool, subsetRequest(&Subset{Metadata: map[string]string{"version": "v1"}})).Address]++
+	}
+	assert.Equal(t, map[string]int{"10.0.0.1:8080": 15, "10.0.0.2:8080": 15}, picked)
+
+	c := b.PickConnectionForRequest(pool, subsetRequest(&Subset{Metadata: map[string]string{"version": "v1", "shard": "2"}}))
+	assert.Equal(t, pool[1], c)
+
+	// the subset without active connections applies the fallback
+	pool[2].IsActive = false
+	v2 := map[string]string{"version": "v2"}
+	assert.Nil(t, b.PickConnectionForRequest(pool, subsetRequest(&Subset{Metadata: v2, Fallback: NoFallback})))
+	assert.NotNil(t, b.PickConnectionForRequest(pool, subsetRequest(&Subset{Metadata: v2, Fallback: AnyEndpoint})))
+
+	c = b.PickConnectionForRequest(pool, subsetRequest(&Subset{Metadata: v2, Fallback: DefaultSubset, Default: map[string]string{"shard": "2"}}))
+	assert.Equal(t, pool[1], c)
+
+	// requests without metadata apply the fallback too
+	assert.Nil(t, b.PickConnectionForRequest(pool, subsetRequest(&Subset{Fallback: NoFallback})))
+
+	// the subsets are built again with the new connections
+	pool = append(pool, &conn.Connection{Address: "10.0.0.4:8080", IsActive: true, IsConnected: true, Metadata: v2})
+	b.RebuildBalancer(pool)
+	c = b.PickConnectionForRequest(pool, subsetRequest(&Subset{Metadata: v2, Fallback: NoFallback}))
+	assert.Equal(t, pool[3], c)
+}
+
+func TestSubsetKeyOf(t *testing.T) {
+	assert.Equal(t, subsetKeyOf(map[string]string{"a": "1", "b": "2"}), subsetKeyOf(map[string]string{"b": "2", "a": "1"}))
+	assert.NotEqual(t, subsetKeyOf(map[string]string{"a": "1,b=2"}), subsetKeyOf(map[string]string{"a": "1", "b": "2"}))
+}
+
+func subsetRequest(s *Subset) *http.Request {
+	r, _ := http.NewRequestWithContext(WithSubset(context.Background(), s), http.MethodGet, "http://localhost", nil)
+	return r
+}
@@ -0,0 +1,64 @@
+package lb
+
+import (
+	"sync"
+	"time"
+
+	"github.com/cperez08/h2-proxy/config"
+	"github.com/cperez08/h2-proxy/conn"
+)
+
+// WeightedRoundRobinLB is the smooth weighted round robin used by nginx, every
+// connection receives requests proportionally to its weight and the picks of the
+// heavy connections are spread instead of sent in bursts
+type WeightedRoundRobinLB struct {
+	slowStart *config.SlowStartConfig
+	m         sync.Mutex
+	current   map[*conn.Connection]float64
+}
+
+// NewWeightedRoundRobin returns a new weighted round robin balancer,
+// the new connections are ramped up when slow start is set
+func NewWeightedRoundRobin(slowStart *config.SlowStartConfig) LoadBalancer {
+	return &WeightedRoundRobinLB{slowStart: slowStart}
+}
+
+// PickConnection increases the current weight of every active connection by its weight,
+// the one with the highest current weight is picked and its current weight is decreased by the total
+func (l *WeightedRoundRobinLB) PickConnection(pool []*conn.Connection) *conn.Connection {
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	if l.current == nil {
+		l.current = make(map[*conn.Connection]float64, len(pool))
+	}
+
+	now := time.Now()
+	var picked *conn.Connection
+	var total float64
+	for _, c := range pool {
+		if !c.IsAvailable() {
+			continue
+		}
+
+		w := float64(weight(c)) * slowStartFactor(c, l.slowStart, now)
+		l.current[c] += w
+		total += w
+		if picked == nil || l.current[c] > l.current[picked] {
+			picked = c
+		}
+	}
+
+	if picked != nil {
+		l.current[picked] -= total
+	}
+
+	return picked
+}
+
+// RebuildBalancer starts the weights from scratch forgetting the removed connections
+func (l *WeightedRoundRobinLB) RebuildBalancer(pool []*conn.Connection) {
+	l.m.Lock()
+	defer l.m.Unlock()
+	l.current = make(map[*conn.Connection]float64, len(pool))
+}
@@ -0,0 +1,49 @@
+package lb
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/cperez08/h2-proxy/conn"
+)
+
+func TestPickConnectionFromWeightedRoundRobinBalancer(t *testing.T) {
+	b := GetBalancer(WeightedRoundRobin)
+	if _, ok := b.(*WeightedRoundRobinLB); !ok {
+		t.Log("should return weighted round robin balancer")
+		t.Fail()
+	}
+
+	pool := []*conn.Connection{
+		{Address: "a:8080", IsActive: true, IsConnected: true, Weight: 5},
+		{Address: "b:8080", IsActive: true, IsConnected: true, Weight: 1},
+		{Address: "c:8080", IsActive: true, IsConnected: true, Weight: 1},
+	}
+
+	// smooth weighted round robin spreads the picks of the heavy connection
+	var picks []string
+	for i := 0; i < 7; i++ {
+		picks = append(picks, b.PickConnection(pool).Address)
+	}
+	assert.Equal(t, []string{"a:8080", "a:8080", "b:8080", "a:8080", "c:8080", "a:8080", "a:8080"}, picks)
+
+	// connections without weight are handled as weight 1, inactive ones are skipped
+	pool = []*conn.Connection{
+		{Address: "a:8080", IsActive: true, IsConnected: true, Weight: 3},
+		{Address: "b:8080", IsActive: true, IsConnected: true},
+		{Address: "c:8080", IsActive: false, IsConnected: true, Weight: 10},
+	}
+	b.RebuildBalancer(pool)
+
+	picked := map[string]int{}
+	for i := 0; i < 400; i++ {
+		picked[b.PickConnection(pool).Address]++
+	}
+	assert.Equal(t, map[string]int{"a:8080": 300, "b:8080": 100}, picked)
+
+	if c := b.PickConnection([]*conn.Connection{{Address: "a:8080"}}); c != nil {
+		t.Log("return unexpected connection")
+		t.Fail()
+	}
+}
@@ -0,0 +1,89 @@
+package lb
+
+import (
+	"net/http"
+	"sync"
+
+	"github.com/cperez08/h2-proxy/config"
+	"github.com/cperez08/h2-proxy/conn"
+)
+
+// ZoneAwareLB sends the requests to the connections in the local zone while the healthy
+// part of their weight is above the threshold, otherwise the requests spill over all the
+// zones. Each group of connections is balanced by its own instance of the configured balancer
+type ZoneAwareLB struct {
+	localZone  string
+	minHealthy float64
+	local      LoadBalancer
+	all        LoadBalancer
+
+	m         sync.RWMutex
+	localPool []*conn.Connection
+}
+
+// NewZoneAware returns a new zone aware balancer wrapping the configured balancer
+func NewZoneAware(cfg *config.DNSConfig) LoadBalancer {
+	inner := *cfg
+	inner.ZoneAware = nil
+
+	return &ZoneAwareLB{
+		localZone:  cfg.ZoneAware.LocalZone,
+		minHealthy: cfg.ZoneAware.MinHealthyPercent,
+		local:      NewBalancer(&inner),
+		all:        NewBalancer(&inner),
+	}
+}
+
+// PickConnection picks a connection without request
+func (l *ZoneAwareLB) PickConnection(pool []*conn.Connection) *conn.Connection {
+	return l.PickConnectionForRequest(pool, nil)
+}
+
+// PickConnectionForRequest picks a connection in the local zone when it has enough
+// healthy capacity, otherwise from all the zones
+func (l *ZoneAwareLB) PickConnectionForRequest(pool []*conn.Connection, r *http.Request) *conn.Connection {
+	l.m.RLock()
+	local := l.localPool
+	l.m.RUnlock()
+
+	if healthyPercent(local) >= l.minHealthy {
+		if c := Pick(l.local, local, r); c != nil {
+			return c
+		}
+	}
+
+	return Pick(l.all, pool, r)
+}
+
+// RebuildBalancer splits the connections by zone rebuilding the inner balancers
+func (l *ZoneAwareLB) RebuildBalancer(pool []*conn.Connection) {
+	var local []*conn.Connection
+	for _, c := range pool {
+		if c.Zone == l.localZone {
+			local = append(local, c)
+		}
+	}
+
+	l.m.Lock()
+	l.localPool = local
+	l.local.RebuildBalancer(local)
+	l.all.RebuildBalancer(pool)
+	l.m.Unlock()
+}
+
+// healthyPercent returns the percentage of the weight in available connections, 0 when empty
+func healthyPercent(pool []*conn.Connection) float64 {
+	var total, healthy int
+	for _, c := range pool {
+		total += weight(c)
+		if c.IsAvailable() {
+			healthy += weight(c)
+		}
+	}
+
+	if total == 0 {
+		return 0
+	}
+
+	return float64(healthy) * 100 / float64(total)
+}
@@ -0,0 +1,72 @@
+package lb
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/cperez08/h2-proxy/config"
+	"github.com/cperez08/h2-proxy/conn"
+)
+
+func TestPickConnectionFromZoneAwareBalancer(t *testing.T) {
+	b := NewBalancer(&config.DNSConfig{
+		BalancerAlg: string(RoundRobin),
+		ZoneAware:   &config.ZoneAwareConfig{LocalZone: "zone-a", MinHealthyPercent: 70},
+	})
+	if _, ok := b.(*ZoneAwareLB); !ok {
+		t.Log("should return zone aware balancer")
+		t.FailNow()
+	}
+
+	pool := []*conn.Connection{
+		{Address: "10.0.0.1:8080", IsActive: true, IsConnected: true, Zone: "zone-a"},
+		{Address: "10.0.0.2:8080", IsActive: true, IsConnected: true, Zone: "zone-a"},
+		{Address: "10.0.0.3:8080", IsActive: true, IsConnected: true, Zone: "zone-a"},
+		{Address: "10.0.1.1:8080", IsActive: true, IsConnected: true, Zone: "zone-b"},
+		{Address: "10.0.1.2:8080", IsActive: true, IsConnected: true, Zone: "zone-b"},
+	}
+	b.RebuildBalancer(pool)
+
+	picked := map[string]int{}
+	for i := 0; i < 30; i++ {
+		picked[b.PickConnection(pool).Zone]++
+	}
+	assert.Equal(t, map[string]int{"zone-a": 30}, picked)
+
+	// 66% of the local zone is healthy, the traffic spills over all the zones
+	pool[0].IsConnected = false
+	picked = map[string]int{}
+	for i := 0; i < 40; i++ {
+		picked[b.PickConnection(pool).Zone]++
+	}
+	assert.Equal(t, 20, picked["zone-a"])
+	assert.Equal(t, 20, picked["zone-b"])
+
+	// the connections without zone are not local
+	pool = []*conn.Connection{{Address: "10.0.1.1:8080", IsActive: true, IsConnected: true}}
+	b.RebuildBalancer(pool)
+	assert.Equal(t, pool[0], b.PickConnection(pool))
+
+	b.RebuildBalancer(nil)
+	assert.Nil(t, b.PickConnection(nil))
+}
+
+func TestZoneAwareRequestBalancer(t *testing.T) {
+	b := NewBalancer(&config.DNSConfig{
+		BalancerAlg: string(RingHash),
+		HashPolicy:  &config.HashPolicy{Header: "x-user-id"},
+		ZoneAware:   &config.ZoneAwareConfig{LocalZone: "zone-a", MinHealthyPercent: 70},
+	}).(RequestBalancer)
+
+	pool := newHashPool(4)
+	pool[0].Zone, pool[1].Zone = "zone-a", "zone-a"
+	b.RebuildBalancer(pool)
+
+	// the inner balancer keeps the affinity inside the local zone
+	c := b.PickConnectionForRequest(pool, hashRequest("user-1"))
+	assert.Equal(t, "zone-a", c.Zone)
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, c, b.PickConnectionForRequest(pool, hashRequest("user-1")))
+	}
+}
@@ -0,0 +1,242 @@
+package listener
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/net/http2"
+
+	"github.com/cperez08/h2-proxy/config"
+)
+
+const (
+	// maxAcceptDelay is the maximum time to wait before accepting again
+	// after a temporary accept error
+	maxAcceptDelay = time.Second
+	// handshakeTimeout is the maximum time a client has to complete the tls handshake
+	handshakeTimeout = 10 * time.Second
+)
+
+// ErrListenerClosed is returned by Serve after Close or Shutdown are called
+var ErrListenerClosed = errors.New("[h2-proxy]: listener closed")
+
+// Listener accepts downstream connections and serves each one
+// in its own goroutine
+type Listener struct {
+	l              net.Listener
+	server         *http2.Server
+	hs             *http.Server // tracks the connections served to send them a GOAWAY on Shutdown
+	handler        http.Handler
+	tlsConfig      *tls.Config
+	maxConnections int
+	printLogs      bool
+
+	m        sync.Mutex
+	conns    map[net.Conn]struct{}
+	wg       sync.WaitGroup
+	closed   bool
+	accepted uint64
+	rejected uint64
+}
+
+// NewListener returns a new Listener serving the connections accepted by l
+// with the given http2 server and handler, when tlsConfig is not nil TLS
+// is terminated before serving the connection otherwise h2c is expected
+func NewListener(l net.Listener, cfg *config.ProxyConfig, server *http2.Server, handler http.Handler, tlsConfig *tls.Config) *Listener {
+	hs := &http.Server{}
+	if err := http2.ConfigureServer(hs, server); err != nil {
+		log.Println("error configuring http2 server", err)
+	}
+
+	return &Listener{
+		l:              l,
+		server:         server,
+		hs:             hs,
+		handler:        handler,
+		tlsConfig:      tlsConfig,
+		maxConnections: cfg.MaxConnections,
+		printLogs:      cfg.PrintLogs,
+		conns:          make(map[net.Conn]struct{}),
+	}
+}
+
+// Serve accepts new connections until the listener is closed,
+// it always returns a non nil error, ErrListenerClosed after Close or Shutdown
+func (l *Listener) Serve() error {
+	var delay time.Duration
+	for {
+		c, err := l.l.Accept()
+		if err != nil {
+			if l.isClosed() {
+				return ErrListenerClosed
+			}
+
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				delay = nextDelay(delay)
+				log.Println("error accepting new connection, retrying in", delay, err)
+				time.Sleep(delay)
+				continue
+			}
+
+			return err
+		}
+
+		delay = 0
+		if !l.trackConn(c) {
+			continue
+		}
+
+		go l.serveConn(c)
+	}
+}
+
+// ActiveConnections returns the number of connections currently served
+func (l *Listener) ActiveConnections() int {
+	l.m.Lock()
+	defer l.m.Unlock()
+	return len(l.conns)
+}
+
+// Stats returns the number of accepted and rejected connections
+func (l *Listener) Stats() (accepted, rejected uint64) {
+	l.m.Lock()
+	defer l.m.Unlock()
+	return l.accepted, l.rejected
+}
+
+// Close stops accepting new connections, the connections
+// already accepted keep being served
+func (l *Listener) Close() error {
+	l.m.Lock()
+	if l.closed {
+		l.m.Unlock()
+		return nil
+	}
+	l.closed = true
+	l.m.Unlock()
+
+	return l.l.Close()
+}
+
+// Shutdown stops accepting new connections and sends a GOAWAY to the active ones, they are
+// closed once their streams finish. Once ctx is done the remaining connections are closed
+func (l *Listener) Shutdown(ctx context.Context) error {
+	err := l.Close()
+	if serr := l.hs.Shutdown(ctx); err == nil {
+		err = serr
+	}
+
+	done := make(chan struct{})
+	go func() {
+		l.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		l.m.Lock()
+		for c := range l.conns {
+			c.Close()
+		}
+		l.m.Unlock()
+		<-done
+	}
+
+	return err
+}
+
+func (l *Listener) serveConn(c net.Conn) {
+	defer l.untrackConn(c)
+	defer c.Close()
+
+	if l.printLogs {
+		log.Println("accepted new connection from", c.RemoteAddr().String())
+	}
+
+	if l.tlsConfig != nil {
+		tc, err := l.handshake(c)
+		if err != nil {
+			if l.printLogs {
+				log.Println("tls handshake error from", c.RemoteAddr().String(), err)
+			}
+			return
+		}
+		c = tc
+	}
+
+	l.server.ServeConn(c, &http2.ServeConnOpts{
+		Handler:    l.handler,
+		BaseConfig: l.hs,
+	})
+}
+
+// handshake completes the tls handshake making sure h2 was negotiated
+func (l *Listener) handshake(c net.Conn) (*tls.Conn, error) {
+	tc := tls.Server(c, l.tlsConfig)
+	tc.SetDeadline(time.Now().Add(handshakeTimeout))
+	if err := tc.Handshake(); err != nil {
+		return nil, err
+	}
+	tc.SetDeadline(time.Time{})
+
+	if p := tc.ConnectionState().NegotiatedProtocol; p != http2.NextProtoTLS {
+		return nil, fmt.Errorf("[h2-proxy]: unsupported protocol %q, only h2 is allowed", p)
+	}
+
+	return tc, nil
+}
+
+// trackConn registers the connection, if the max connections limit
+// is reached the connection is closed and false is returned
+func (l *Listener) trackConn(c net.Conn) bool {
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	if l.closed || (l.maxConnections > 0 && len(l.conns) >= l.maxConnections) {
+		l.rejected++
+		c.Close()
+		if l.printLogs {
+			log.Println("max connections reached, rejecting connection from", c.RemoteAddr().String())
+		}
+		return false
+	}
+
+	l.accepted++
+	l.conns[c] = struct{}{}
+	l.wg.Add(1)
+	return true
+}
+
+func (l *Listener) untrackConn(c net.Conn) {
+	l.m.Lock()
+	delete(l.conns, c)
+	l.m.Unlock()
+	l.wg.Done()
+}
+
+func (l *Listener) isClosed() bool {
+	l.m.Lock()
+	defer l.m.Unlock()
+	return l.closed
+}
+
+func nextDelay(d time.Duration) time.Duration {
+	if d == 0 {
+		return 5 * time.Millisecond
+	}
+
+	d *= 2
+	if d > maxAcceptDelay {
+		return maxAcceptDelay
+	}
+
+	return d
+}
@@ -0,0 +1,239 @@
+package listener
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/http2"
+
+	"github.com/cperez08/h2-proxy/certs"
+	"github.com/cperez08/h2-proxy/config"
+)
+
+func TestServeConcurrentConnections(t *testing.T) {
+	release := make(chan struct{})
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/block" {
+			<-release
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+
+	lis, addr := newTestListener(t, &config.ProxyConfig{}, handler)
+	go lis.Serve()
+	defer lis.Close()
+
+	blocked := make(chan error, 1)
+	go func() {
+		_, err := doRequest(addr, "/block")
+		blocked <- err
+	}()
+
+	// the second client must be served while the first one is still waiting
+	rs, err := doRequest(addr, "/ok")
+	if err != nil {
+		t.Log("error performing request", err)
+		t.FailNow()
+	}
+
+	assert.Equal(t, http.StatusOK, rs.StatusCode)
+	assert.Equal(t, 2, lis.ActiveConnections())
+
+	close(release)
+	assert.NoError(t, <-blocked)
+}
+
+func TestMaxConnections(t *testing.T) {
+	lis, addr := newTestListener(t, &config.ProxyConfig{MaxConnections: 1}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	go lis.Serve()
+	defer lis.Close()
+
+	c1, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Log("error connecting", err)
+		t.FailNow()
+	}
+	defer c1.Close()
+
+	waitFor(t, func() bool { return lis.ActiveConnections() == 1 })
+
+	c2, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Log("error connecting", err)
+		t.FailNow()
+	}
+	defer c2.Close()
+
+	// the second connection is closed by the proxy
+	c2.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = c2.Read(make([]byte, 1))
+	assert.Error(t, err)
+
+	accepted, rejected := lis.Stats()
+	assert.Equal(t, uint64(1), accepted)
+	assert.Equal(t, uint64(1), rejected)
+}
+
+func TestShutdown(t *testing.T) {
+	lis, addr := newTestListener(t, &config.ProxyConfig{}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	served := make(chan error, 1)
+	go func() { served <- lis.Serve() }()
+
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Log("error connecting", err)
+		t.FailNow()
+	}
+	defer c.Close()
+
+	waitFor(t, func() bool { return lis.ActiveConnections() == 1 })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.NoError(t, lis.Shutdown(ctx))
+	assert.Equal(t, ErrListenerClosed, <-served)
+	assert.Equal(t, 0, lis.ActiveConnections())
+
+	// closing twice is a no op
+	assert.NoError(t, lis.Close())
+}
+
+func TestShutdownGoAway(t *testing.T) {
+	lis, addr := newTestListener(t, &config.ProxyConfig{}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	go lis.Serve()
+
+	// the idle connection is closed at most a second after the GOAWAY without waiting for ctx
+	if _, err := doRequest(addr, "/ok"); err != nil {
+		t.Log("error performing request", err)
+		t.FailNow()
+	}
+	assert.Equal(t, 1, lis.ActiveConnections())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	start := time.Now()
+	assert.NoError(t, lis.Shutdown(ctx))
+	assert.True(t, time.Since(start) < 3*time.Second)
+	assert.Equal(t, 0, lis.ActiveConnections())
+}
+
+func TestServeTLS(t *testing.T) {
+	cfg := &config.ProxyConfig{TLS: &config.TLSConfig{CertFile: "../certs/testdata/server.pem", KeyFile: "../certs/testdata/server-key.pem"}}
+	lis, addr := newTestListener(t, cfg, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS == nil {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	go lis.Serve()
+	defer lis.Close()
+
+	cli := &http.Client{Transport: &http2.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	rs, err := cli.Get("https://" + addr + "/ok")
+	if err != nil {
+		t.Log("error performing request", err)
+		t.FailNow()
+	}
+	assert.Equal(t, http.StatusOK, rs.StatusCode)
+
+	// clients not negotiating h2 are rejected
+	c, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"http/1.1"}})
+	if err != nil {
+		t.Log("error connecting", err)
+		t.FailNow()
+	}
+	defer c.Close()
+
+	c.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = c.Read(make([]byte, 1))
+	assert.Error(t, err)
+}
+
+func TestServeMutualTLS(t *testing.T) {
+	cfg := &config.ProxyConfig{TLS: &config.TLSConfig{
+		CertFile:     "../certs/testdata/server.pem",
+		KeyFile:      "../certs/testdata/server-key.pem",
+		ClientCAFile: "../certs/testdata/ca.pem",
+	}}
+
+	lis, addr := newTestListener(t, cfg, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if certs.PeerIdentity(r.TLS) == nil {
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	go lis.Serve()
+	defer lis.Close()
+
+	// without client certificate the handshake fails
+	cli := &http.Client{Transport: &http2.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	if _, err := cli.Get("https://" + addr + "/ok"); err == nil {
+		t.Log("expecting handshake error")
+		t.Fail()
+	}
+
+	cert, err := tls.LoadX509KeyPair("../certs/testdata/client.pem", "../certs/testdata/client-key.pem")
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+
+	cli = &http.Client{Transport: &http2.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true, Certificates: []tls.Certificate{cert}}}}
+	rs, err := cli.Get("https://" + addr + "/ok")
+	if err != nil {
+		t.Log("error performing request", err)
+		t.FailNow()
+	}
+	assert.Equal(t, http.StatusOK, rs.StatusCode)
+}
+
+func TestNextDelay(t *testing.T) {
+	assert.Equal(t, 5*time.Millisecond, nextDelay(0))
+	assert.Equal(t, 10*time.Millisecond, nextDelay(5*time.Millisecond))
+	assert.Equal(t, maxAcceptDelay, nextDelay(maxAcceptDelay))
+}
+
+func newTestListener(t *testing.T, cfg *config.ProxyConfig, h http.Handler) (*Listener, string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+
+	var tlsCfg *tls.Config
+	if cfg.TLS != nil {
+		if tlsCfg, err = certs.NewServerTLSConfig(context.Background(), cfg.TLS); err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+	}
+
+	return NewListener(l, cfg, &http2.Server{}, h, tlsCfg), l.Addr().String()
+}
+
+func doRequest(addr, path string) (*http.Response, error) {
+	// a new transport per request forces a new connection per client
+	cli := &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLS: func(netw, addr string, cfg *tls.Config) (net.Conn, error) {
+			return net.Dial(netw, addr)
+		},
+	}}
+
+	return cli.Get("http://" + addr + path)
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	for i := 0; i < 100; i++ {
+		if cond() {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Log("condition not met")
+	t.FailNow()
+}
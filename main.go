@@ -5,7 +5,6 @@ import (
 	"crypto/tls"
 	"log"
 	"net"
-	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
@@ -13,12 +12,18 @@ import (
 
 	"golang.org/x/net/http2"
 
+	"github.com/cperez08/h2-proxy/certs"
+	"github.com/cperez08/h2-proxy/cluster"
 	"github.com/cperez08/h2-proxy/config"
-	"github.com/cperez08/h2-proxy/pool"
+	"github.com/cperez08/h2-proxy/listener"
 	"github.com/cperez08/h2-proxy/proxy"
+	"github.com/cperez08/h2-proxy/router"
 )
 
-const configDefaultLocation = "/etc/h2-proxy/config.yaml"
+const (
+	configDefaultLocation = "/etc/h2-proxy/config.yaml"
+	shutdownTimeout       = 10 * time.Second
+)
 
 var sigs = make(chan os.Signal, 1)
 
@@ -29,41 +34,46 @@ func main() {
 		log.Fatal("error loading yaml config", err)
 	}
 
-	server, cli := initClientAndServer(ctx, cfg)
+	server := initServer(cfg)
+	rt := initRouter(ctx, cfg)
 
 	l, err := net.Listen("tcp", cfg.ProxyAddres)
 	if err != nil {
 		log.Fatalln(err)
 	}
 
+	var tlsCfg *tls.Config
+	if cfg.TLS != nil {
+		if tlsCfg, err = certs.NewServerTLSConfig(ctx, cfg.TLS); err != nil {
+			log.Fatalln(err)
+		}
+	}
+
+	lis := listener.NewListener(l, cfg, server, proxy.Handler(cfg, rt), tlsCfg)
+
 	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
 
+	done := make(chan struct{})
 	go func() {
+		defer close(done)
 		sig := <-sigs
 		log.Println(sig)
 		log.Println("shutting down proxy")
-		cancel()
-		if err := l.Close(); err != nil {
-			log.Println("error closing listener")
-			os.Exit(1)
+		shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer shutdownCancel()
+		if err := lis.Shutdown(shutdownCtx); err != nil {
+			log.Println("error closing listener", err)
 		}
-		os.Exit(0)
+		cancel()
 	}()
 
 	log.Println("starting proxy on ", cfg.ProxyAddres)
 
-	for {
-		conn, err := l.Accept()
-		if err != nil {
-			log.Fatalln("error accepting new connection ", err)
-		}
-
-		log.Println("accepted new connection from", conn.RemoteAddr().String())
-		server.ServeConn(conn, &http2.ServeConnOpts{
-			Handler:    proxy.Handler(cfg, cli),
-			BaseConfig: &http.Server{},
-		})
+	if err := lis.Serve(); err != listener.ErrListenerClosed {
+		log.Fatalln("error accepting new connection ", err)
 	}
+
+	<-done
 }
 
 func getFileLocation() string {
@@ -75,26 +85,22 @@ func getFileLocation() string {
 	return location
 }
 
-func initClientAndServer(ctx context.Context, cfg *config.ProxyConfig) (*http2.Server, *http.Client) {
-	t := &http2.Transport{
-		DisableCompression: true,
-		AllowHTTP:          true,
-		DialTLS: func(netw, addr string, cfg *tls.Config) (net.Conn, error) {
-			return net.Dial(netw, addr)
-		},
+func initServer(cfg *config.ProxyConfig) *http2.Server {
+	return &http2.Server{
+		IdleTimeout: time.Second * time.Duration(cfg.IdleTimeout),
 	}
+}
 
-	pool, err := pool.NewConnectionPool(ctx, cfg, t)
+func initRouter(ctx context.Context, cfg *config.ProxyConfig) *router.Router {
+	clusters, err := cluster.NewClusters(ctx, cfg.Clusters)
 	if err != nil {
 		log.Fatalln(err)
 	}
 
-	t.ConnPool = pool
-	cli := &http.Client{Transport: t}
-
-	server := &http2.Server{
-		IdleTimeout: time.Second * time.Duration(cfg.IdleTimeout),
+	rt, err := router.NewRouter(cfg, clusters)
+	if err != nil {
+		log.Fatalln(err)
 	}
 
-	return server, cli
+	return rt
 }
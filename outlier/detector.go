@@ -0,0 +1,202 @@
+package outlier
+
+import (
+	"log"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/cperez08/h2-proxy/config"
+	"github.com/cperez08/h2-proxy/conn"
+)
+
+// Detector watches the results of the proxied requests and ejects the connections
+// with consecutive failures right away, the ones with a success rate far below the
+// rest of the pool are ejected every interval. The ejected connections are not picked
+// by the balancers until the ejection time, doubled on every ejection, is over
+type Detector struct {
+	cfg *config.OutlierDetectionConfig
+
+	m     sync.Mutex
+	pool  []*conn.Connection
+	stats map[*conn.Connection]*stats
+}
+
+// stats of a connection since the last interval
+type stats struct {
+	consecutive  map[conn.Result]int
+	total        int
+	success      int
+	ejections    int // times ejected, decreased every interval without ejection
+	ejectedUntil time.Time
+}
+
+// NewDetector returns a new outlier detector
+func NewDetector(cfg *config.OutlierDetectionConfig) *Detector {
+	return &Detector{cfg: cfg, stats: make(map[*conn.Connection]*stats)}
+}
+
+// Interval returns the time between the success rate analysis
+func (d *Detector) Interval() time.Duration {
+	return time.Duration(d.cfg.Interval) * time.Second
+}
+
+// Rebuild notifies the detector about changes in the pool
+func (d *Detector) Rebuild(pool []*conn.Connection) {
+	d.m.Lock()
+	defer d.m.Unlock()
+
+	d.pool = append(d.pool[:0:0], pool...)
+	current := make(map[*conn.Connection]bool, len(pool))
+	for _, c := range pool {
+		current[c] = true
+	}
+
+	for c := range d.stats {
+		if !current[c] {
+			delete(d.stats, c)
+		}
+	}
+}
+
+// ObserveResult records the result of a request ejecting the connection when
+// the consecutive failures of the same kind reach the threshold
+func (d *Detector) ObserveResult(c *conn.Connection, r conn.Result) {
+	d.m.Lock()
+	defer d.m.Unlock()
+
+	s := d.statsOf(c)
+	s.total++
+	if r == conn.Success {
+		s.success++
+		s.consecutive = make(map[conn.Result]int)
+		return
+	}
+
+	s.consecutive[r]++
+	if s.consecutive[r] >= d.threshold(r) {
+		s.consecutive = make(map[conn.Result]int)
+		d.eject(c, s, time.Now())
+	}
+}
+
+// Evaluate brings back the connections whose ejection time is over and ejects
+// the ones with a low success rate, it is called every interval
+func (d *Detector) Evaluate(now time.Time) {
+	d.m.Lock()
+	defer d.m.Unlock()
+
+	for _, c := range d.pool {
+		s := d.statsOf(c)
+		switch {
+		case c.Ejected() && !now.Before(s.ejectedUntil):
+			c.SetEjected(false)
+			log.Println("endpoint ", c.Address, " is back from the outlier ejection")
+		case !c.Ejected() && s.ejections > 0:
+			s.ejections--
+		}
+	}
+
+	d.ejectBySuccessRate(now)
+
+	for _, c := range d.pool {
+		s := d.statsOf(c)
+		s.total, s.success = 0, 0
+	}
+}
+
+// ejectBySuccessRate ejects the connections whose success rate is below the mean minus
+// the standard deviation multiplied by the factor, only the connections with enough
+// requests are analyzed and only when there are enough of them
+func (d *Detector) ejectBySuccessRate(now time.Time) {
+	type rate struct {
+		c    *conn.Connection
+		rate float64
+	}
+
+	var rates []rate
+	var sum float64
+	for _, c := range d.pool {
+		s := d.statsOf(c)
+		if c.Ejected() || s.total < d.cfg.SuccessRateRequestVolume {
+			continue
+		}
+
+		r := float64(s.success) * 100 / float64(s.total)
+		rates = append(rates, rate{c: c, rate: r})
+		sum += r
+	}
+
+	if len(rates) == 0 || len(rates) < d.cfg.SuccessRateMinHosts {
+		return
+	}
+
+	mean := sum / float64(len(rates))
+	var variance float64
+	for _, r := range rates {
+		variance += (r.rate - mean) * (r.rate - mean)
+	}
+	threshold := mean - d.cfg.SuccessRateStdevFactor*math.Sqrt(variance/float64(len(rates)))
+
+	for _, r := range rates {
+		if r.rate < threshold {
+			d.eject(r.c, d.statsOf(r.c), now)
+		}
+	}
+}
+
+// eject ejects the connection unless the maximum percentage of ejected connections would be
+// exceeded, one connection can always be ejected as in Envoy so the small pools eject too
+func (d *Detector) eject(c *conn.Connection, s *stats, now time.Time) {
+	if c.Ejected() {
+		return
+	}
+
+	var ejected int
+	for _, pc := range d.pool {
+		if pc.Ejected() {
+			ejected++
+		}
+	}
+
+	if ejected > 0 && float64(ejected+1)*100 > d.cfg.MaxEjectionPercent*float64(len(d.pool)) {
+		return
+	}
+
+	ejection := time.Duration(d.cfg.BaseEjectionTime) * time.Second
+	max := time.Duration(d.cfg.MaxEjectionTime) * time.Second
+	for i := 0; i < s.ejections && ejection < max; i++ {
+		ejection *= 2
+	}
+
+	if ejection > max {
+		ejection = max
+	}
+
+	s.ejections++
+	s.ejectedUntil = now.Add(ejection)
+	c.SetEjected(true)
+	log.Println("endpoint ", c.Address, " ejected by the outlier detection for ", ejection)
+}
+
+func (d *Detector) threshold(r conn.Result) int {
+	switch r {
+	case conn.ServerError:
+		return d.cfg.Consecutive5xx
+	case conn.GRPCError:
+		return d.cfg.ConsecutiveGRPCErrors
+	default:
+		return d.cfg.ConsecutiveConnectFailures
+	}
+}
+
+// statsOf returns the stats of the connection, d.m must be held
+func (d *Detector) statsOf(c *conn.Connection) *stats {
+	s, ok := d.stats[c]
+	if !ok {
+		s = &stats{consecutive: make(map[conn.Result]int)}
+		d.stats[c] = s
+	}
+
+	return s
+}
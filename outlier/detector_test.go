@@ -0,0 +1,152 @@
+package outlier
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/cperez08/h2-proxy/config"
+	"github.com/cperez08/h2-proxy/conn"
+)
+
+func TestConsecutiveFailures(t *testing.T) {
+	cfg := newConfig(&config.OutlierDetectionConfig{MaxEjectionPercent: 50})
+	d := NewDetector(cfg)
+	pool := newPool(4)
+	d.Rebuild(pool)
+
+	for i := 0; i < 4; i++ {
+		d.ObserveResult(pool[0], conn.ServerError)
+	}
+	// a success resets the consecutive failures
+	d.ObserveResult(pool[0], conn.Success)
+	d.ObserveResult(pool[0], conn.ServerError)
+	assert.False(t, pool[0].Ejected())
+
+	// failures of different kinds are counted separately
+	for i := 0; i < 4; i++ {
+		d.ObserveResult(pool[0], conn.GRPCError)
+		d.ObserveResult(pool[0], conn.ConnectFailure)
+	}
+	assert.False(t, pool[0].Ejected())
+
+	d.ObserveResult(pool[0], conn.GRPCError)
+	assert.True(t, pool[0].Ejected())
+	assert.False(t, pool[0].IsAvailable())
+
+	for i := 0; i < 5; i++ {
+		d.ObserveResult(pool[1], conn.ConnectFailure)
+	}
+	assert.True(t, pool[1].Ejected())
+
+	// 50% of the pool is already ejected
+	for i := 0; i < 5; i++ {
+		d.ObserveResult(pool[2], conn.ServerError)
+	}
+	assert.False(t, pool[2].Ejected())
+}
+
+func TestDefaultMaxEjectionPercent(t *testing.T) {
+	d := NewDetector(newConfig(&config.OutlierDetectionConfig{}))
+	pool := newPool(4)
+	d.Rebuild(pool)
+
+	// one connection is ejected even if it is more than 10% of the pool
+	for i := 0; i < 5; i++ {
+		d.ObserveResult(pool[0], conn.ServerError)
+		d.ObserveResult(pool[1], conn.ServerError)
+	}
+	assert.True(t, pool[0].Ejected())
+	assert.False(t, pool[1].Ejected())
+}
+
+func TestEjectionTime(t *testing.T) {
+	cfg := newConfig(&config.OutlierDetectionConfig{MaxEjectionPercent: 100, BaseEjectionTime: 30, MaxEjectionTime: 100})
+	d := NewDetector(cfg)
+	pool := newPool(1)
+	d.Rebuild(pool)
+
+	var now time.Time
+	eject := func() {
+		for i := 0; i < 5; i++ {
+			d.ObserveResult(pool[0], conn.ServerError)
+		}
+	}
+
+	// the ejection time is doubled every time and limited by the max ejection time
+	for _, ejection := range []time.Duration{30 * time.Second, 60 * time.Second, 100 * time.Second} {
+		eject()
+		assert.True(t, pool[0].Ejected())
+		now = d.stats[pool[0]].ejectedUntil
+
+		d.Evaluate(now.Add(-time.Second))
+		assert.True(t, pool[0].Ejected(), ejection)
+
+		d.Evaluate(now)
+		assert.False(t, pool[0].Ejected(), ejection)
+	}
+
+	// the ejection time goes back to the base one after some intervals without ejections
+	for i := 0; i < 3; i++ {
+		d.Evaluate(now)
+	}
+	eject()
+	assert.WithinDuration(t, time.Now().Add(30*time.Second), d.stats[pool[0]].ejectedUntil, time.Second)
+}
+
+func TestSuccessRate(t *testing.T) {
+	cfg := newConfig(&config.OutlierDetectionConfig{MaxEjectionPercent: 50})
+	d := NewDetector(cfg)
+	pool := newPool(6)
+	d.Rebuild(pool)
+
+	observe := func(c *conn.Connection, total, failures int) {
+		for i := 0; i < total; i++ {
+			r := conn.Success
+			if i%(total/failures) == 0 {
+				r = conn.ServerError
+			}
+			d.ObserveResult(c, r)
+		}
+	}
+
+	for _, c := range pool[:5] {
+		observe(c, 100, 1)
+	}
+	observe(pool[5], 100, 50)
+	d.Evaluate(time.Now())
+	assert.True(t, pool[5].Ejected())
+	for _, c := range pool[:5] {
+		assert.False(t, c.Ejected())
+	}
+
+	// not enough connections with enough requests
+	d = NewDetector(cfg)
+	pool = newPool(6)
+	d.Rebuild(pool)
+	for _, c := range pool[:3] {
+		observe(c, 100, 1)
+	}
+	observe(pool[3], 99, 33)
+	observe(pool[4], 99, 33)
+	observe(pool[5], 100, 50)
+	d.Evaluate(time.Now())
+	assert.False(t, pool[5].Ejected())
+}
+
+func newConfig(cfg *config.OutlierDetectionConfig) *config.OutlierDetectionConfig {
+	cl := &config.ClusterConfig{OutlierDetection: cfg}
+	cl.SetDefaults()
+	return cfg
+}
+
+func newPool(n int) []*conn.Connection {
+	pool := make([]*conn.Connection, n)
+	for i := range pool {
+		pool[i] = &conn.Connection{Address: fmt.Sprintf("10.0.0.%d:8080", i+1), IsActive: true, IsConnected: true}
+	}
+
+	return pool
+}
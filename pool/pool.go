@@ -7,16 +7,38 @@ import (
 	"net"
 	"net/http"
 	"sync"
+	"time"
 
+	"github.com/cperez08/h2-proxy/breaker"
 	"github.com/cperez08/h2-proxy/config"
 	"github.com/cperez08/h2-proxy/conn"
+	"github.com/cperez08/h2-proxy/health"
 	"github.com/cperez08/h2-proxy/lb"
+	"github.com/cperez08/h2-proxy/outlier"
 	"github.com/cperez08/h2-proxy/resolver"
 	"golang.org/x/net/http2"
 )
 
+// ErrNoConnections is returned when there is no connection available in the pool
+var ErrNoConnections = errors.New("no active connections found")
+
+const (
+	minReconnectDelay = 100 * time.Millisecond
+	maxReconnectDelay = 30 * time.Second
+	reconnectTimeout  = 5 * time.Second // dial and TLS handshake of the reconnections
+	tripsLogInterval  = time.Minute
+)
+
+// ConnectionPool is a http2.ClientConnPool with the circuit breaker of the cluster
+type ConnectionPool interface {
+	http2.ClientConnPool
+	// Breaker returns the circuit breaker, nil when it is not enabled
+	Breaker() *breaker.Breaker
+}
+
 // connectionPool is the implementation for http2.ConnPool interface
 type connectionPool struct {
+	name          string
 	ctx           context.Context
 	t             *http2.Transport
 	m             sync.Mutex
@@ -25,12 +47,52 @@ type connectionPool struct {
 	r             *resolver.Resolver
 	basePort      string
 	isDomainBased bool // indicates if the pool was built based on a domain with multiple A / AAA records or 1 or N IPs
+	isSRV         bool // the domain is resolved with its SRV records
+	isStatic      bool // the pool was built from the static endpoints, they are never resolved again
+	zones         *zones
+	health        *health.Checker
+	outlier       *outlier.Detector
+	breaker       *breaker.Breaker
 }
 
 // NewConnectionPool returns a new instance of the connectionPool object
-// also initializes the set of connections based on the Address
-func NewConnectionPool(ctx context.Context, cfg *config.ProxyConfig, t *http2.Transport) (http2.ClientConnPool, error) {
-	c := &connectionPool{t: t, basePort: cfg.TargetPort, ctx: ctx}
+// also initializes the set of connections based on the Address,
+// the pool is set as the transport ConnPool
+func NewConnectionPool(ctx context.Context, cfg *config.ClusterConfig, t *http2.Transport) (ConnectionPool, error) {
+	c := &connectionPool{name: cfg.Name, t: t, basePort: cfg.TargetPort, ctx: ctx, breaker: breaker.New(cfg.CircuitBreakers)}
+	// set before creating any connection since the transport reads it when the connections fail
+	t.ConnPool = c
+	if cfg.DNSConfig.ZoneAware != nil {
+		c.zones = newZones(cfg.DNSConfig.ZoneAware, cfg.Endpoints)
+		c.zones.load()
+	}
+
+	if cfg.HealthCheck != nil {
+		c.health = health.NewChecker(cfg.HealthCheck, t, net.JoinHostPort(cfg.TargetHost, cfg.TargetPort))
+	}
+
+	if cfg.OutlierDetection != nil {
+		c.outlier = outlier.NewDetector(cfg.OutlierDetection)
+	}
+
+	if len(cfg.Endpoints) > 0 {
+		c.isStatic = true
+		// the endpoints metadata is only known for the static endpoints
+		c.balancer = lb.NewSubset(func() lb.LoadBalancer { return lb.NewBalancer(cfg.DNSConfig) })
+		for _, e := range cfg.Endpoints {
+			conn.AddConnection(&c.connections, &conn.Connection{Address: e.Address, Weight: e.Weight, Zone: e.Zone, Metadata: e.Metadata, IsConnected: false, IsActive: true})
+		}
+
+		// the cluster starts with the endpoints not reachable, they are connected later
+		if err := c.initPool(); err != nil {
+			log.Println("error connecting endpoints of cluster ", cfg.Name, " ", err)
+			c.reconnectAll()
+		}
+
+		c.startChecks()
+		return c, nil
+	}
+
 	if ip := net.ParseIP(cfg.TargetHost); ip != nil {
 		c.balancer = lb.GetBalancer(lb.None)
 		c.connections = append(c.connections, &conn.Connection{Address: cfg.TargetHost + ":" + cfg.TargetPort, IsConnected: false, IsActive: true})
@@ -38,22 +100,31 @@ func NewConnectionPool(ctx context.Context, cfg *config.ProxyConfig, t *http2.Tr
 			return nil, err
 		}
 
+		c.startChecks()
 		return c, nil
 	}
 
-	c.balancer = lb.GetBalancer(lb.Balancer(cfg.DNSConfig.BalancerAlg))
+	c.balancer = lb.NewBalancer(cfg.DNSConfig)
 	c.r = resolver.NewResolver(cfg.DNSConfig.RefreshRate, cfg.DNSConfig.NeedRefresh)
 	c.isDomainBased = true
 
-	ips := c.r.Resolve(cfg.TargetHost, cfg.TargetPort)
-	for _, i := range ips {
-		conn.AddConnection(&c.connections, &conn.Connection{Address: i, IsConnected: false, IsActive: true})
+	if cfg.DNSConfig.SRV {
+		c.isSRV = true
+		for _, e := range c.r.ResolveSRV(cfg.TargetHost) {
+			conn.AddConnection(&c.connections, &conn.Connection{Address: e.Address, Weight: e.Weight, IsConnected: false, IsActive: true})
+		}
+	} else {
+		ips := c.r.Resolve(cfg.TargetHost, cfg.TargetPort)
+		for _, i := range ips {
+			conn.AddConnection(&c.connections, &conn.Connection{Address: i, IsConnected: false, IsActive: true})
+		}
 	}
 
 	if err := c.initPool(); err != nil {
 		return nil, err
 	}
 
+	c.startChecks()
 	go c.watchForChanges()
 	return c, nil
 }
@@ -68,38 +139,229 @@ func (p *connectionPool) GetClientConn(req *http.Request, addr string) (*http2.C
 	p.m.Lock()
 	defer p.m.Unlock()
 	if len(p.connections) == 0 {
-		return nil, errors.New("no active connections found")
+		return nil, ErrNoConnections
 	}
 
-	c := p.balancer.PickConnection(p.connections)
+	c := lb.Pick(p.balancer, p.connections, req)
 	if c == nil {
-		return nil, errors.New("no active connections found")
+		return nil, ErrNoConnections
+	}
+
+	s := conn.StreamFromContext(req.Context())
+	// the retries are sent to a different connection when the balancer picks another one,
+	// the one tried is used when there is no other (e.g. hash based balancers)
+	for i := 0; s != nil && s.Tried(c) && i < len(p.connections); i++ {
+		if other := lb.Pick(p.balancer, p.connections, req); other != nil && !s.Tried(other) {
+			c = other
+			break
+		}
+	}
+
+	if s != nil && !p.dispatch(s, c) {
+		return nil, breaker.ErrOpen
+	}
+
+	// the connection counts the request as active until the stream is done
+	if s != nil {
+		s.Attach(c)
+		if p.outlier != nil {
+			s.SetObserver(p.outlier)
+		}
 	}
 
 	return c.Conn, nil
 }
 
-// MarkDead mark a connection as dead removing it from the pool
+// dispatch holds a circuit breaker pending request while the connection has no free stream, the
+// transport asks again for a connection meanwhile. False is returned when the pending requests
+// are reached, the requests without stream (e.g. sent by the proxy itself) are not limited
+func (p *connectionPool) dispatch(s *conn.Stream, c *conn.Connection) bool {
+	if c.Conn == nil || c.Conn.CanTakeNewRequest() {
+		s.Dispatch()
+		return true
+	}
+
+	if s.Waiting() {
+		return true
+	}
+
+	if !p.breaker.AcquirePending() {
+		return false
+	}
+
+	s.Wait(p.breaker.ReleasePending)
+	return true
+}
+
+// Breaker returns the circuit breaker of the cluster
+func (p *connectionPool) Breaker() *breaker.Breaker {
+	return p.breaker
+}
+
+// MarkDead marks a connection as dead, when the health checking is enabled it is kept disconnected
+// until a probe succeeds. Otherwise it is removed from the pool, the static endpoints are kept with
+// their weight and connected again in the background since they are never resolved again
 func (p *connectionPool) MarkDead(cc *http2.ClientConn) {
 	p.m.Lock()
 	defer p.m.Unlock()
+	var owned bool
 	for i, c := range p.connections {
-		if c.Conn == cc {
+		if c.Conn != nil && c.Conn == cc {
+			owned = true
+			if p.health != nil || p.isStatic {
+				c.IsConnected = false
+				c.Conn = nil
+				if p.health == nil {
+					go p.reconnect(c)
+				}
+				break
+			}
+
 			p.connections[i] = p.connections[len(p.connections)-1]
 			p.connections = p.connections[:len(p.connections)-1]
 			break
 		}
 	}
 
+	// e.g. the connections closed on shutdown or discarded by the reconnections
+	if !owned {
+		return
+	}
+
 	if err := cc.Close(); err != nil {
 		log.Println("error closing dead connection ")
 	}
 
-	p.balancer.RebuildBalancer(p.connections)
+	p.rebuildBalancer()
 }
 
 func (p *connectionPool) initPool() error {
-	return conn.ConnectPool(p.t, p.connections)
+	p.m.Lock()
+	defer p.m.Unlock()
+	err := p.connectPool()
+	p.rebuildBalancer()
+	return err
+}
+
+// reconnectAll reconnects in the background the active connections not connected,
+// the health checks reconnect them when they are enabled
+func (p *connectionPool) reconnectAll() {
+	if p.health != nil {
+		return
+	}
+
+	p.m.Lock()
+	defer p.m.Unlock()
+	for _, c := range p.connections {
+		if c.IsActive && !c.IsConnected {
+			go p.reconnect(c)
+		}
+	}
+}
+
+// reconnect connects the connection again with a growing delay between the attempts,
+// it stops once connected or when the connection is removed from the pool
+func (p *connectionPool) reconnect(c *conn.Connection) {
+	delay := minReconnectDelay
+	for {
+		select {
+		case <-p.ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+
+		if delay *= 2; delay > maxReconnectDelay {
+			delay = maxReconnectDelay
+		}
+
+		p.m.Lock()
+		pending := p.contains(c) && !c.IsConnected
+		p.m.Unlock()
+		if !pending || p.redial(c) {
+			return
+		}
+	}
+}
+
+// redial connects the connection marked as dead, the lock is not held while connecting. False is
+// returned when it is not connected, e.g. the connection failed, it was removed or connected
+// meanwhile or the circuit breaker max connections was reached
+func (p *connectionPool) redial(c *conn.Connection) bool {
+	cc, err := conn.ConnectTimeout(p.t, c.Address, reconnectTimeout)
+	if err != nil {
+		log.Println("error reconnecting endpoint ", c.Address, " ", err)
+		return false
+	}
+
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	if !p.contains(c) || c.IsConnected || p.breaker.AllowConnections(p.connected(), 1) == 0 {
+		cc.Close()
+		return false
+	}
+
+	c.Conn, c.IsConnected = cc, true
+	p.rebuildBalancer()
+	return true
+}
+
+// contains indicates if the connection is in the pool, p.m must be held
+func (p *connectionPool) contains(c *conn.Connection) bool {
+	for _, pc := range p.connections {
+		if pc == c {
+			return true
+		}
+	}
+
+	return false
+}
+
+// connected returns the number of connections connected, p.m must be held
+func (p *connectionPool) connected() int {
+	var n int
+	for _, c := range p.connections {
+		if c.IsConnected {
+			n++
+		}
+	}
+
+	return n
+}
+
+// connectPool connects the active connections, p.m must be held
+func (p *connectionPool) connectPool() error {
+	var toConnect []*conn.Connection
+	for _, c := range p.connections {
+		if c.IsActive && !c.IsConnected {
+			toConnect = append(toConnect, c)
+		}
+	}
+
+	return p.connect(toConnect)
+}
+
+// connect connects the connections without exceeding the circuit breaker max connections, p.m must be held
+func (p *connectionPool) connect(toConnect []*conn.Connection) error {
+	if allowed := p.breaker.AllowConnections(p.connected(), len(toConnect)); allowed < len(toConnect) {
+		log.Println("circuit breaker max connections reached, ", len(toConnect)-allowed, " targets not connected")
+		toConnect = toConnect[:allowed]
+	}
+
+	return conn.ConnectPool(p.t, toConnect)
+}
+
+// rebuildBalancer notifies the balancer about the changes in the pool, p.m must be held
+func (p *connectionPool) rebuildBalancer() {
+	if p.zones != nil {
+		p.zones.assign(p.connections)
+	}
+
+	if p.outlier != nil {
+		p.outlier.Rebuild(p.connections)
+	}
+
+	p.balancer.RebuildBalancer(p.connections)
 }
 
 // TODO add upper context to handle cancelation
@@ -107,27 +369,186 @@ func (p *connectionPool) watchForChanges() {
 	for {
 		select {
 		case <-p.ctx.Done():
-			conn.CloseAllConnections(&p.connections)
+			// closing the connections makes the transport call MarkDead
+			// so they are removed from the pool before closing them
+			p.m.Lock()
+			connections := p.connections
+			p.connections = nil
+			p.m.Unlock()
+			conn.CloseAllConnections(&connections)
 			p.r.CloseResolver()
 			return
 		case <-p.r.C:
+			if p.isSRV {
+				p.refreshEndpoints(p.r.GetCurrentEndpoints())
+				continue
+			}
 			p.refreshConnections(p.r.GetCurrentIPs())
 		}
 	}
 }
 
 func (p *connectionPool) refreshConnections(refreshedIPs []string) {
+	p.zones.load()
 	p.m.Lock()
 	defer p.m.Unlock()
 
 	conn.RefreshConnections(&p.connections, refreshedIPs)
 
 	// let's create the connections for the new ips
-	if err := conn.ConnectPool(p.t, p.connections); err != nil {
+	if err := p.connectPool(); err != nil {
 		log.Println("error refreshing connection ", err)
 	}
 
-	p.balancer.RebuildBalancer(p.connections)
+	p.rebuildBalancer()
+}
+
+func (p *connectionPool) refreshEndpoints(endpoints []conn.Endpoint) {
+	p.zones.load()
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	conn.RefreshEndpoints(&p.connections, endpoints)
+	if err := p.connectPool(); err != nil {
+		log.Println("error refreshing connection ", err)
+	}
+
+	p.rebuildBalancer()
+}
+
+// startChecks starts the health checking, the outlier detection and the circuit breaker trips log when they are enabled
+func (p *connectionPool) startChecks() {
+	if p.health != nil {
+		go p.watchHealth()
+	}
+
+	if p.outlier != nil {
+		go p.watchOutliers()
+	}
+
+	if p.breaker != nil {
+		go p.watchTrips()
+	}
+}
+
+// watchTrips logs the circuit breaker trips every interval when they changed, whatever print_logs is
+func (p *connectionPool) watchTrips() {
+	ticker := time.NewTicker(tripsLogInterval)
+	defer ticker.Stop()
+
+	var last breaker.Trips
+	for {
+		select {
+		case <-p.ctx.Done():
+			return
+		case <-ticker.C:
+			if trips := p.breaker.Trips(); trips != last {
+				log.Printf("circuit breaker trips of cluster %s: %d requests, %d pending requests, %d retries and %d connections rejected",
+					p.name, trips.Requests, trips.PendingRequests, trips.Retries, trips.Connections)
+				last = trips
+			}
+		}
+	}
+}
+
+// watchOutliers runs the outlier detection analysis every interval until the context is done
+func (p *connectionPool) watchOutliers() {
+	ticker := time.NewTicker(p.outlier.Interval())
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.ctx.Done():
+			return
+		case now := <-ticker.C:
+			p.outlier.Evaluate(now)
+		}
+	}
+}
+
+// watchHealth probes the connections every interval until the context is done
+func (p *connectionPool) watchHealth() {
+	ticker := time.NewTicker(p.health.Interval())
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.ctx.Done():
+			return
+		case <-ticker.C:
+			p.checkHealth()
+		}
+	}
+}
+
+// checkHealth probes all the connections concurrently and deactivates the unhealthy
+// ones so the balancers skip them, the lock is not held while probing nor reconnecting
+func (p *connectionPool) checkHealth() {
+	p.m.Lock()
+	addrs := make([]string, 0, len(p.connections))
+	for _, c := range p.connections {
+		addrs = append(addrs, c.Address)
+	}
+	p.m.Unlock()
+
+	errs := make(map[string]error, len(addrs))
+	var wg sync.WaitGroup
+	var em sync.Mutex
+	for _, a := range addrs {
+		wg.Add(1)
+		go func(addr string) {
+			defer wg.Done()
+			err := p.health.Probe(addr)
+			em.Lock()
+			errs[addr] = err
+			em.Unlock()
+		}(a)
+	}
+	wg.Wait()
+
+	p.m.Lock()
+	p.health.Forget(addrs)
+	var changed bool
+	var reconnect []*conn.Connection
+	for _, c := range p.connections {
+		err, ok := errs[c.Address]
+		if !ok {
+			// added by a refresh while probing
+			continue
+		}
+
+		healthy := p.health.Observe(c.Address, err, c.IsActive)
+		if healthy != c.IsActive {
+			changed = true
+			c.IsActive = healthy
+			if healthy {
+				// the recovered endpoints ramp up like the new ones when slow start is enabled
+				c.AddedAt = time.Now()
+				log.Println("endpoint ", c.Address, " marked healthy")
+			} else {
+				log.Println("endpoint ", c.Address, " marked unhealthy ", err)
+			}
+		}
+
+		if c.IsActive && !c.IsConnected && err == nil {
+			reconnect = append(reconnect, c)
+		}
+	}
+
+	if changed {
+		p.rebuildBalancer()
+	}
+	p.m.Unlock()
+
+	// reconnects the healthy endpoints whose connection was marked as dead
+	for _, c := range reconnect {
+		wg.Add(1)
+		go func(c *conn.Connection) {
+			defer wg.Done()
+			p.redial(c)
+		}(c)
+	}
+	wg.Wait()
 }
 
 // func traceGetConn(req *http.Request, hostPort string) {
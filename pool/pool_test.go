@@ -9,6 +9,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/cperez08/h2-proxy/breaker"
 	"github.com/cperez08/h2-proxy/config"
 	"github.com/cperez08/h2-proxy/conn"
 	"github.com/cperez08/h2-proxy/lb"
@@ -19,7 +20,7 @@ const defaultAddr = "127.0.0.1:8080"
 
 func TestNewConnectionPoolByIP(t *testing.T) {
 	ctx := context.Background()
-	cfg := getProxyConfig()
+	cfg := getClusterConfig()
 	tr := getTransport()
 	l := fakeListener("8080")
 	defer l.Close()
@@ -32,14 +33,34 @@ func TestNewConnectionPoolByIP(t *testing.T) {
 		t.Fail()
 	}
 
-	conn, err := cp.GetClientConn(&http.Request{}, defaultAddr)
-	if conn == nil || err != nil {
+	cc, err := cp.GetClientConn(&http.Request{}, defaultAddr)
+	if cc == nil || err != nil {
+		t.Log("error grabbing the connection")
+		t.Fail()
+	}
+
+	// the connection picked is attached to the request stream
+	s := &conn.Stream{}
+	req, _ := http.NewRequestWithContext(conn.WithStream(ctx, s), http.MethodGet, "http://"+defaultAddr, nil)
+	if _, err := cp.GetClientConn(req, defaultAddr); err != nil {
 		t.Log("error grabbing the connection")
 		t.Fail()
 	}
 
+	c := s.Connection()
+	if c == nil || c.ActiveRequests() != 1 {
+		t.Log("expecting one active request")
+		t.Fail()
+	}
+
+	s.Done()
+	if c.ActiveRequests() != 0 {
+		t.Log("expecting no active requests")
+		t.Fail()
+	}
+
 	cfg.TargetPort = "8090"
-	cp, err = NewConnectionPool(ctx, cfg, tr)
+	cp, err = NewConnectionPool(ctx, cfg, getTransport())
 	if cp != nil || err == nil {
 		t.Log("should return error initializing the pool")
 		t.Fail()
@@ -48,7 +69,7 @@ func TestNewConnectionPoolByIP(t *testing.T) {
 
 func TestNewConnectionPoolByHost(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
-	cfg := getProxyConfig()
+	cfg := getClusterConfig()
 	tr := getTransport()
 	l := fakeListener("8080")
 
@@ -68,7 +89,7 @@ func TestNewConnectionPoolByHost(t *testing.T) {
 	}
 
 	cfg.TargetPort = "8090"
-	cp, err = NewConnectionPool(ctx, cfg, tr)
+	cp, err = NewConnectionPool(ctx, cfg, getTransport())
 	if cp != nil || err == nil {
 		t.Log("should return error initializing the pool")
 		t.Fail()
@@ -77,7 +98,7 @@ func TestNewConnectionPoolByHost(t *testing.T) {
 
 func TestNewConnectionPoolByHost2(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
-	cfg := getProxyConfig()
+	cfg := getClusterConfig()
 	tr := getTransport()
 	l := fakeListener("8080")
 
@@ -115,7 +136,7 @@ func TestNewConnectionPoolByHost2(t *testing.T) {
 
 func TestGetNoConnection(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
-	cfg := getProxyConfig()
+	cfg := getClusterConfig()
 	tr := getTransport()
 	l := fakeListener("8080")
 
@@ -146,9 +167,318 @@ func TestForceRefreshError(t *testing.T) {
 	cp.refreshConnections([]string{"127.0.0.1:8080"})
 }
 
+func TestNewConnectionPoolByEndpoints(t *testing.T) {
+	ctx := context.Background()
+	cfg := &config.ClusterConfig{Name: "test", Endpoints: []*config.EndpointConfig{{Address: defaultAddr, Weight: 3}}}
+	cfg.SetDefaults()
+	cfg.DNSConfig.BalancerAlg = string(lb.WeightedRoundRobin)
+	l := fakeListener("8080")
+	defer l.Close()
+
+	cp, err := NewConnectionPool(ctx, cfg, getTransport())
+	if cp == nil || err != nil {
+		t.Log("error creating the connection", err)
+		t.FailNow()
+	}
+
+	s := &conn.Stream{}
+	req, _ := http.NewRequestWithContext(conn.WithStream(ctx, s), http.MethodGet, "http://"+defaultAddr, nil)
+	if _, err := cp.GetClientConn(req, defaultAddr); err != nil {
+		t.Log("error grabbing the connection", err)
+		t.FailNow()
+	}
+
+	if c := s.Connection(); c.Address != defaultAddr || c.Weight != 3 {
+		t.Log("unexpected connection", c.Address, c.Weight)
+		t.Fail()
+	}
+	s.Done()
+
+	// the marked as dead connections are kept and connected again
+	casted := cp.(*connectionPool)
+	cp.MarkDead(casted.connections[0].Conn)
+	waitConnected(t, casted, defaultAddr)
+}
+
+func TestReconnectEndpoints(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// the endpoints not reachable do not fail the cluster
+	cfg := &config.ClusterConfig{Name: "test", Endpoints: []*config.EndpointConfig{{Address: "127.0.0.1:8090"}}}
+	cfg.SetDefaults()
+	cp, err := NewConnectionPool(ctx, cfg, getTransport())
+	if cp == nil || err != nil {
+		t.Log("error creating the connection", err)
+		t.FailNow()
+	}
+
+	if _, err := cp.GetClientConn(&http.Request{}, defaultAddr); err == nil {
+		t.Log("expecting error due to no connected endpoint")
+		t.Fail()
+	}
+
+	l := fakeListener("8090")
+	defer l.Close()
+	waitConnected(t, cp.(*connectionPool), "127.0.0.1:8090")
+}
+
+// waitConnected waits until the connection to addr is in the pool and connected
+func waitConnected(t *testing.T, p *connectionPool, addr string) {
+	for i := 0; i < 100; i++ {
+		p.m.Lock()
+		for _, c := range p.connections {
+			if c.Address == addr && c.IsConnected {
+				p.m.Unlock()
+				return
+			}
+		}
+		p.m.Unlock()
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	t.Log("connection not reconnected", addr)
+	t.Fail()
+}
+
+func TestGetClientConnForRequest(t *testing.T) {
+	ctx := context.Background()
+	cfg := &config.ClusterConfig{Name: "test", Endpoints: []*config.EndpointConfig{{Address: defaultAddr}}}
+	cfg.SetDefaults()
+	cfg.DNSConfig.BalancerAlg = string(lb.RingHash)
+	cfg.DNSConfig.HashPolicy = &config.HashPolicy{Header: "x-user-id"}
+	l := fakeListener("8080")
+	defer l.Close()
+
+	cp, err := NewConnectionPool(ctx, cfg, getTransport())
+	if cp == nil || err != nil {
+		t.Log("error creating the connection", err)
+		t.FailNow()
+	}
+
+	if _, ok := cp.(*connectionPool).balancer.(lb.RequestBalancer); !ok {
+		t.Log("expecting request balancer")
+		t.FailNow()
+	}
+
+	// the ring is built when the pool is created
+	req, _ := http.NewRequest(http.MethodGet, "http://"+defaultAddr, nil)
+	req.Header.Set("x-user-id", "123")
+	if cc, err := cp.GetClientConn(req, defaultAddr); cc == nil || err != nil {
+		t.Log("error grabbing the connection", err)
+		t.Fail()
+	}
+}
+
+// TestForceRefreshEndpointsError test made specially for increasing code coverage
+func TestForceRefreshEndpointsError(t *testing.T) {
+	cp := &connectionPool{connections: []*conn.Connection{{Address: "127.0.0.1:8080", IsActive: true}}, balancer: &lb.WeightedRoundRobinLB{}}
+	cp.refreshEndpoints([]conn.Endpoint{{Address: "127.0.0.1:8080", Weight: 2}})
+	if cp.connections[0].Weight != 2 {
+		t.Log("expecting weight updated")
+		t.Fail()
+	}
+}
+
+func TestCheckHealth(t *testing.T) {
+	ctx := context.Background()
+	cfg := &config.ClusterConfig{Name: "test", Endpoints: []*config.EndpointConfig{{Address: defaultAddr}}, HealthCheck: &config.HealthCheckConfig{Type: "tcp", UnhealthyThreshold: 1, HealthyThreshold: 1}}
+	cfg.SetDefaults()
+	l := fakeListener("8080")
+
+	cp, err := NewConnectionPool(ctx, cfg, getTransport())
+	if cp == nil || err != nil {
+		l.Close()
+		t.Log("error creating the connection", err)
+		t.FailNow()
+	}
+
+	casted := cp.(*connectionPool)
+	casted.checkHealth()
+	if !casted.connections[0].IsActive {
+		t.Log("expecting healthy connection")
+		t.Fail()
+	}
+
+	l.Close()
+	casted.checkHealth()
+	if casted.connections[0].IsActive {
+		t.Log("expecting unhealthy connection")
+		t.Fail()
+	}
+
+	if _, err := cp.GetClientConn(&http.Request{}, defaultAddr); err == nil {
+		t.Log("expecting error due to no healthy connection")
+		t.Fail()
+	}
+
+	l = fakeListener("8080")
+	defer l.Close()
+	casted.checkHealth()
+	if _, err := cp.GetClientConn(&http.Request{}, defaultAddr); err != nil {
+		t.Log("expecting recovered connection", err)
+		t.Fail()
+	}
+}
+
+func TestMarkDeadNotOwned(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cfg := &config.ClusterConfig{Name: "test", Endpoints: []*config.EndpointConfig{{Address: defaultAddr}}, HealthCheck: &config.HealthCheckConfig{Type: "http", Timeout: 100}}
+	cfg.SetDefaults()
+	l := fakeListener("8080")
+	defer l.Close()
+
+	tr := getTransport()
+	cp, err := NewConnectionPool(ctx, cfg, tr)
+	if cp == nil || err != nil {
+		t.Log("error creating the connection", err)
+		t.FailNow()
+	}
+
+	casted := cp.(*connectionPool)
+	rb := &rebuildCounter{}
+	casted.balancer = rb
+
+	// the probe connections are not notified to the pool when they are closed
+	casted.health.Probe(defaultAddr)
+
+	// nor the connections of the transport not in the pool
+	cc, err := conn.Connect(tr, defaultAddr)
+	if err != nil {
+		t.Log("error connecting", err)
+		t.FailNow()
+	}
+	cc.Close()
+	cp.MarkDead(cc)
+	time.Sleep(50 * time.Millisecond)
+
+	casted.m.Lock()
+	defer casted.m.Unlock()
+	if rb.rebuilds != 0 || !casted.connections[0].IsConnected {
+		t.Log("unexpected pool changes", rb.rebuilds)
+		t.Fail()
+	}
+}
+
+// rebuildCounter counts the balancer rebuilds
+type rebuildCounter struct {
+	lb.NoBalancer
+	rebuilds int
+}
+
+func (r *rebuildCounter) RebuildBalancer(pool []*conn.Connection) {
+	r.rebuilds++
+}
+
+func TestOutlierDetection(t *testing.T) {
+	ctx := context.Background()
+	cfg := &config.ClusterConfig{Name: "test", Endpoints: []*config.EndpointConfig{{Address: defaultAddr}}, OutlierDetection: &config.OutlierDetectionConfig{}}
+	cfg.SetDefaults()
+	l := fakeListener("8080")
+	defer l.Close()
+
+	cp, err := NewConnectionPool(ctx, cfg, getTransport())
+	if cp == nil || err != nil {
+		t.Log("error creating the connection", err)
+		t.FailNow()
+	}
+
+	for i := 0; i < cfg.OutlierDetection.Consecutive5xx; i++ {
+		s := &conn.Stream{}
+		req, _ := http.NewRequestWithContext(conn.WithStream(ctx, s), http.MethodGet, "http://"+defaultAddr, nil)
+		if _, err := cp.GetClientConn(req, defaultAddr); err != nil {
+			t.Log("error grabbing the connection", err)
+			t.FailNow()
+		}
+		s.ObserveResult(conn.ServerError)
+		s.Done()
+	}
+
+	if _, err := cp.GetClientConn(&http.Request{}, defaultAddr); err == nil {
+		t.Log("expecting error due to ejected connection")
+		t.Fail()
+	}
+}
+
+func TestMaxConnections(t *testing.T) {
+	ctx := context.Background()
+	cfg := &config.ClusterConfig{
+		Name:            "test",
+		Endpoints:       []*config.EndpointConfig{{Address: defaultAddr}, {Address: "localhost:8080"}},
+		CircuitBreakers: &config.CircuitBreakersConfig{MaxConnections: 1},
+	}
+	cfg.SetDefaults()
+	l := fakeListener("8080")
+	defer l.Close()
+
+	cp, err := NewConnectionPool(ctx, cfg, getTransport())
+	if cp == nil || err != nil {
+		t.Log("error creating the connection", err)
+		t.FailNow()
+	}
+
+	casted := cp.(*connectionPool)
+	casted.m.Lock()
+	if !casted.connections[0].IsConnected || casted.connections[1].IsConnected {
+		t.Log("expecting only one connection")
+		t.Fail()
+	}
+	casted.m.Unlock()
+
+	if trips := cp.Breaker().Trips(); trips.Connections != 1 {
+		t.Log("expecting one connection trip", trips)
+		t.Fail()
+	}
+}
+
+func TestPendingRequests(t *testing.T) {
+	l := fakeListener("8080")
+	defer l.Close()
+
+	// a closed connection can not take new requests, the transport asks again for a connection
+	full, err := conn.Connect(getTransport(), defaultAddr)
+	if err != nil {
+		t.Log("error creating the connection", err)
+		t.FailNow()
+	}
+	full.Close()
+
+	maxPending := 1
+	p := &connectionPool{breaker: breaker.New(&config.CircuitBreakersConfig{MaxPendingRequests: &maxPending})}
+	c := &conn.Connection{Conn: full}
+	s1, s2 := &conn.Stream{}, &conn.Stream{}
+	if !p.dispatch(s1, c) || !p.dispatch(s1, c) {
+		t.Log("expecting the first request pending")
+		t.Fail()
+	}
+
+	if p.dispatch(s2, c) {
+		t.Log("expecting the second request rejected")
+		t.Fail()
+	}
+
+	// the first request gets a free stream releasing its pending request
+	if !p.dispatch(s1, &conn.Connection{}) || !p.dispatch(s2, c) {
+		t.Log("expecting the second request pending")
+		t.Fail()
+	}
+
+	s2.Done()
+	if !p.breaker.AcquirePending() {
+		t.Log("expecting the pending request released once the stream is done")
+		t.Fail()
+	}
+
+	if trips := p.breaker.Trips(); trips.PendingRequests != 1 {
+		t.Log("expecting one pending request trip", trips)
+		t.Fail()
+	}
+}
+
 func TestKillConnectionError(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
-	cfg := getProxyConfig()
+	cfg := getClusterConfig()
 	tr := getTransport()
 	l := fakeListener("8080")
 
@@ -180,8 +510,8 @@ func getTransport() *http2.Transport {
 	}
 }
 
-func getProxyConfig() *config.ProxyConfig {
-	cfg := &config.ProxyConfig{TargetHost: "localhost", TargetPort: "8080"}
+func getClusterConfig() *config.ClusterConfig {
+	cfg := &config.ClusterConfig{Name: "test", TargetHost: "localhost", TargetPort: "8080"}
 	cfg.SetDefaults()
 	return cfg
 }
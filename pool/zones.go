@@ -0,0 +1,93 @@
+package pool
+
+import (
+	"io/ioutil"
+	"log"
+	"net"
+	"regexp"
+	"sync"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/cperez08/h2-proxy/config"
+	"github.com/cperez08/h2-proxy/conn"
+)
+
+// zones finds the zone of the targets, first in the zones file by address
+// or host and then extracting it from the host with the zone pattern
+type zones struct {
+	file     string
+	pattern  *regexp.Regexp
+	explicit map[string]string // zones set in the cluster endpoints, they are never replaced
+
+	m         sync.Mutex
+	byAddress map[string]string // last zones file read
+}
+
+func newZones(cfg *config.ZoneAwareConfig, endpoints []*config.EndpointConfig) *zones {
+	z := &zones{file: cfg.ZonesFile, explicit: make(map[string]string)}
+	if cfg.ZonePattern != "" {
+		z.pattern = regexp.MustCompile(cfg.ZonePattern)
+	}
+
+	for _, e := range endpoints {
+		if e.Zone != "" {
+			z.explicit[e.Address] = e.Zone
+		}
+	}
+
+	return z
+}
+
+// load reads the zones file, the previous zones are kept when it cannot be read. It is
+// called when the targets are refreshed, not while holding the pool lock
+func (z *zones) load() {
+	if z == nil || z.file == "" {
+		return
+	}
+
+	var byAddress map[string]string
+	b, err := ioutil.ReadFile(z.file)
+	if err == nil {
+		err = yaml.Unmarshal(b, &byAddress)
+	}
+
+	if err != nil {
+		log.Println("error reading zones file ", err)
+		return
+	}
+
+	z.m.Lock()
+	z.byAddress = byAddress
+	z.m.Unlock()
+}
+
+// assign sets the zone of the connections from the last zones file read or the pattern,
+// the zones set in the endpoints are kept
+func (z *zones) assign(pool []*conn.Connection) {
+	z.m.Lock()
+	defer z.m.Unlock()
+
+	for _, c := range pool {
+		if zone, ok := z.explicit[c.Address]; ok {
+			c.Zone = zone
+			continue
+		}
+
+		host, _, err := net.SplitHostPort(c.Address)
+		if err != nil {
+			host = c.Address
+		}
+
+		c.Zone = ""
+		if zone, ok := z.byAddress[c.Address]; ok {
+			c.Zone = zone
+		} else if zone, ok := z.byAddress[host]; ok {
+			c.Zone = zone
+		} else if z.pattern != nil {
+			if m := z.pattern.FindStringSubmatch(host); m != nil {
+				c.Zone = m[1]
+			}
+		}
+	}
+}
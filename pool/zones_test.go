@@ -0,0 +1,59 @@
+package pool
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/cperez08/h2-proxy/config"
+	"github.com/cperez08/h2-proxy/conn"
+)
+
+func TestAssignZones(t *testing.T) {
+	f, err := ioutil.TempFile("", "zones*.yaml")
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	defer os.Remove(f.Name())
+
+	f.WriteString("10.0.0.1: zone-a\n'10.0.0.2:8080': zone-b\n")
+	f.Close()
+
+	z := newZones(&config.ZoneAwareConfig{ZonesFile: f.Name(), ZonePattern: `^[^.]+\.([^.]+)\.users\.svc`}, []*config.EndpointConfig{{Address: "10.0.0.4:8080", Zone: "zone-d"}})
+	z.load()
+	pool := []*conn.Connection{
+		{Address: "10.0.0.1:8080"},
+		{Address: "10.0.0.2:8080"},
+		{Address: "10.0.0.3:8080"},
+		{Address: "users-0.zone-c.users.svc.:50051"},
+		{Address: "10.0.0.4:8080"},
+	}
+	z.assign(pool)
+
+	assert.Equal(t, "zone-a", pool[0].Zone)
+	assert.Equal(t, "zone-b", pool[1].Zone)
+	assert.Equal(t, "", pool[2].Zone)
+	assert.Equal(t, "zone-c", pool[3].Zone)
+	assert.Equal(t, "zone-d", pool[4].Zone)
+
+	// the changes in the file replace the zones assigned before once it is read again
+	ioutil.WriteFile(f.Name(), []byte("10.0.0.1: zone-b\n10.0.0.4: zone-a\n"), 0644)
+	z.assign(pool)
+	assert.Equal(t, "zone-a", pool[0].Zone)
+
+	z.load()
+	z.assign(pool)
+	assert.Equal(t, "zone-b", pool[0].Zone)
+	assert.Equal(t, "", pool[1].Zone)
+	assert.Equal(t, "zone-d", pool[4].Zone)
+
+	// an invalid file keeps the zones from the pattern
+	z = newZones(&config.ZoneAwareConfig{ZonesFile: "noexists.yaml", ZonePattern: `^[^.]+\.([^.]+)\.users\.svc`}, nil)
+	z.load()
+	pool = []*conn.Connection{{Address: "users-0.zone-c.users.svc.:50051"}}
+	z.assign(pool)
+	assert.Equal(t, "zone-c", pool[0].Zone)
+}
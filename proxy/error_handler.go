@@ -3,52 +3,107 @@ package proxy
 import (
 	"fmt"
 	"log"
+	"math"
 	"net/http"
+	"strconv"
 	"strings"
-
-	"golang.org/x/net/http2"
+	"time"
 )
 
 const (
 	contentType = "Content-Type"
 	grpcMessage = "grpc-message"
 	grpcStatus  = "grpc-status"
+
+	retryAfterHeader = "Retry-After"
+)
+
+// gRPC status codes returned by the proxy
+// https://github.com/grpc/grpc/blob/master/doc/statuscodes.md
+const (
+	codeUnknown           = 2
+	codeDeadlineExceeded  = 4
+	codeResourceExhausted = 8
+	codeUnimplemented     = 12
+	codeInternal          = 13
+	codeUnavailable       = 14
 )
 
+// httpStatuses maps the gRPC codes to the http status returned to non gRPC clients
+var httpStatuses = map[int]int{
+	codeUnknown:           http.StatusInternalServerError,
+	codeDeadlineExceeded:  http.StatusGatewayTimeout,
+	codeResourceExhausted: http.StatusTooManyRequests,
+	codeUnimplemented:     http.StatusNotFound,
+	codeUnavailable:       http.StatusServiceUnavailable,
+}
+
 // HandleError ...
 func HandleError(w http.ResponseWriter, r *http.Request, errMsg string, printLogs bool) {
-	if printLogs {
-		log.Println(fmt.Sprintf(`{"rq_id": "%s", "rq_path": "%s", "rq_proto": "%s", "message": %s}`,
-			r.Header.Get("X-Request-Id"),
-			r.URL.Path,
-			r.Proto,
-			errMsg,
-		))
-	}
+	HandleErrorCode(w, r, errMsg, codeUnknown, printLogs)
+}
+
+// HandleErrorCode replies with the gRPC code for gRPC requests
+// or the equivalent http status for the rest
+func HandleErrorCode(w http.ResponseWriter, r *http.Request, errMsg string, code int, printLogs bool) {
+	LogError(r, errMsg, printLogs)
 
 	ct := r.Header.Get(contentType)
 	if strings.Contains(ct, "grpc") {
-		HandleGRPCError(w, ct, errMsg)
+		handleGRPCError(w, ct, errMsg, code)
 		return
 	}
 
-	HandleHTTPError(w, errMsg)
+	handleHTTPError(w, errMsg, httpStatuses[code])
+}
+
+// handleRateLimited replies RESOURCE_EXHAUSTED telling the client when to retry
+func handleRateLimited(w http.ResponseWriter, r *http.Request, errMsg string, wait time.Duration, printLogs bool) {
+	retryAfter := int(math.Ceil(wait.Seconds()))
+	if retryAfter < 1 {
+		retryAfter = 1
+	}
+
+	w.Header().Set(retryAfterHeader, strconv.Itoa(retryAfter))
+	HandleErrorCode(w, r, errMsg, codeResourceExhausted, printLogs)
+}
+
+// LogError prints the error related to the request
+func LogError(r *http.Request, errMsg string, printLogs bool) {
+	if !printLogs {
+		return
+	}
+
+	log.Println(fmt.Sprintf(`{"rq_id": "%s", "rq_path": "%s", "rq_proto": "%s", "message": %s}`,
+		r.Header.Get("X-Request-Id"),
+		r.URL.Path,
+		r.Proto,
+		errMsg,
+	))
 }
 
 // HandleGRPCError ...
 func HandleGRPCError(w http.ResponseWriter, ct, errMsg string) {
+	handleGRPCError(w, ct, errMsg, codeUnknown)
+}
+
+func handleGRPCError(w http.ResponseWriter, ct, errMsg string, code int) {
 	// Add headers empty body and trailers
 	w.Header().Set(contentType, ct)
 	w.Header().Set(grpcMessage, errMsg)
-	w.Header().Set(grpcStatus, fmt.Sprintf("%d", http2.ErrCodeInternal))
+	w.Header().Set(grpcStatus, fmt.Sprintf("%d", code))
 	w.Write([]byte(``))
-	w.Header().Add(http.TrailerPrefix+grpcStatus, fmt.Sprintf("%d", http2.ErrCodeInternal))
+	w.Header().Add(http.TrailerPrefix+grpcStatus, fmt.Sprintf("%d", code))
 	w.Header().Add(http.TrailerPrefix+grpcMessage, errMsg)
 }
 
 // HandleHTTPError ...
 func HandleHTTPError(w http.ResponseWriter, errMsg string) {
-	w.WriteHeader(http.StatusInternalServerError)
+	handleHTTPError(w, errMsg, http.StatusInternalServerError)
+}
+
+func handleHTTPError(w http.ResponseWriter, errMsg string, status int) {
 	w.Header().Add(contentType, "application/json")
+	w.WriteHeader(status)
 	w.Write([]byte(fmt.Sprintf(`{"message": "%s"}`, errMsg)))
 }
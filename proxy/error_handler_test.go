@@ -27,3 +27,18 @@ func TestHandleErrorHttp(t *testing.T) {
 
 	assert.Equal(t, writer.Header().Get(contentType), "application/json")
 }
+
+func TestHandleErrorCode(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/", ioutil.NopCloser(bytes.NewReader([]byte(``))))
+	req.Header.Set(contentType, "application/grpc")
+	var writer = NewCustomeRsWriter()
+	HandleErrorCode(writer, req, "no route", codeUnimplemented, false)
+
+	assert.Equal(t, writer.Header().Get(grpcStatus), "12")
+
+	req.Header.Set(contentType, "application/json")
+	writer = NewCustomeRsWriter()
+	HandleErrorCode(writer, req, "no route", codeUnimplemented, false)
+
+	assert.Equal(t, http.StatusNotFound, writer.(*CustomResponseWriter).Status)
+}
@@ -1,78 +1,225 @@
 package proxy
 
 import (
-	"bytes"
+	"context"
+	"errors"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"log"
 	"net/http"
+	"strconv"
+	"sync/atomic"
 	"time"
 
+	"github.com/cperez08/h2-proxy/breaker"
+	"github.com/cperez08/h2-proxy/certs"
+	"github.com/cperez08/h2-proxy/cluster"
 	"github.com/cperez08/h2-proxy/config"
+	"github.com/cperez08/h2-proxy/conn"
+	"github.com/cperez08/h2-proxy/lb"
+	"github.com/cperez08/h2-proxy/ratelimit"
+	"github.com/cperez08/h2-proxy/router"
 )
 
 const (
-	// version 1.0 just support http, future versions will include https as well
-	defaultScheme       = "http"
 	forwardedForHeder   = "X-Forwarded-For"
 	proxiedByForHeder   = "X-Proxied-By"
 	forwardedHostHeader = "X-Forwarded-Host"
+	copyBufferSize      = 32 * 1024
 )
 
-// Handler handles the proxy requests
-func Handler(config *config.ProxyConfig, cli *http.Client) http.HandlerFunc {
+// Handler handles the proxy requests sending them to the cluster of the matching route
+func Handler(config *config.ProxyConfig, rt *router.Router) http.HandlerFunc {
+	mirrors := newMirror(config)
+	hedges := newHedging()
+	limiter := ratelimit.New(config.RateLimit)
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		start := time.Now()
-		proxyReq, reqSize, err := createRequest(r, config)
+		// the listener limit applies to all the requests, the route one only to the requests of the route
+		if wait, ok := limiter.Allow(r); !ok {
+			handleRateLimited(w, r, fmt.Sprintf("[%s] rate limit exceeded", config.ProxyName), wait, config.PrintLogs)
+			return
+		}
+
+		route := rt.Route(r)
+		if route == nil {
+			HandleErrorCode(w, r, fmt.Sprintf("[%s] no route found for %s%s", config.ProxyName, r.Host, r.URL.Path), codeUnimplemented, config.PrintLogs)
+			return
+		}
+
+		wait, ok, err := route.AllowRequest(r)
+		if err != nil {
+			LogError(r, fmt.Sprintf("[%s] error calling the rate limit service: %s", config.ProxyName, err), config.PrintLogs)
+		}
+
+		if !ok {
+			handleRateLimited(w, r, fmt.Sprintf("[%s] route rate limit exceeded for %s%s", config.ProxyName, r.Host, r.URL.Path), wait, config.PrintLogs)
+			return
+		}
+
+		// the deadline covers the whole request, the target stream is canceled when it expires
+		timeout, hasTimeout := requestTimeout(r, route.Config)
+		if hasTimeout {
+			ctx, cancel := context.WithTimeout(r.Context(), timeout)
+			defer cancel()
+			r = r.WithContext(ctx)
+		}
+
+		c := route.PickCluster(r)
+		// the requests over the cluster thresholds fail fast instead of queuing in the connections
+		if !c.Breaker.AcquireRequest() {
+			HandleErrorCode(w, r, fmt.Sprintf("[%s] circuit breaker max requests reached for cluster %s, %d requests rejected", config.ProxyName, c.Name, c.Breaker.Trips().Requests), codeUnavailable, config.PrintLogs)
+			return
+		}
+		defer c.Breaker.ReleaseRequest()
+
+		proxyReq, reqBody, err := createRequest(r, c, config)
 		if err != nil {
 			HandleError(w, r, err.Error(), config.PrintLogs)
 			return
 		}
 
-		rs, err := cli.Do(proxyReq)
+		if route.VirtualHost.PreserveHost {
+			proxyReq.Host = r.Host
+		}
+
+		// the target receives the time remaining
+		if hasTimeout && isGRPC(r) {
+			if deadline, ok := r.Context().Deadline(); ok {
+				proxyReq.Header.Set(grpcTimeout, encodeGRPCTimeout(time.Until(deadline)))
+			}
+		}
+
+		if s := route.Subset(r); s != nil {
+			proxyReq = proxyReq.WithContext(lb.WithSubset(proxyReq.Context(), s))
+		}
+
+		if mc := route.MirrorCluster(); mc != nil {
+			var body *mirrorBody
+			if proxyReq.Body != http.NoBody {
+				body = &mirrorBody{ReadCloser: proxyReq.Body}
+				proxyReq.Body = body
+			}
+			// the shadow request is sent once the client request is completed,
+			// it never delays nor changes the client response
+			defer mirrors.send(r, mc, body, route.VirtualHost.PreserveHost)
+		}
+
+		// the stream keeps the request active in the target connection until the response is completed
+		var rs *http.Response
+		var stream *conn.Stream
+		if route.Config.Hedge != nil {
+			rs, stream, err = hedges.do(c, route.Config, proxyReq)
+		} else {
+			var body *replayBody
+			if route.Config.Retry != nil && proxyReq.Body != http.NoBody {
+				body = &replayBody{src: proxyReq.Body}
+			}
+			rs, stream, err = do(c, route.Config.Retry, proxyReq, body, &conn.Stream{})
+		}
+		defer stream.Done()
 		if err != nil {
+			if errors.Is(err, breaker.ErrOpen) {
+				HandleErrorCode(w, r, fmt.Sprintf("[%s] circuit breaker max pending requests reached for cluster %s, %d requests rejected", config.ProxyName, c.Name, c.Breaker.Trips().PendingRequests), codeUnavailable, config.PrintLogs)
+				return
+			}
+			if deadlineExceeded(r) {
+				HandleErrorCode(w, r, fmt.Sprintf("[%s] deadline exceeded waiting for target", config.ProxyName), codeDeadlineExceeded, config.PrintLogs)
+				return
+			}
 			HandleError(w, r, fmt.Sprintf("[%s] error performing request to target: "+err.Error(), config.ProxyName), config.PrintLogs)
 			return
 		}
 
 		rsSize, err := writeResponse(w, rs, config)
 		if err != nil {
-			HandleError(w, r, err.Error(), config.PrintLogs)
-			return
+			// the headers were already sent, the gRPC clients receive the status in the trailers
+			if deadlineExceeded(r) && isGRPC(r) {
+				msg := fmt.Sprintf("[%s] deadline exceeded streaming the response", config.ProxyName)
+				LogError(r, msg, config.PrintLogs)
+				handleGRPCError(w, r.Header.Get(contentType), msg, codeDeadlineExceeded)
+				return
+			}
+
+			LogError(r, err.Error(), config.PrintLogs)
+			// reset the stream so the client does not take a truncated response as a complete one
+			panic(http.ErrAbortHandler)
 		}
+		stream.ObserveResult(resultOf(rs))
 
 		if config.PrintLogs {
-			PrintLog(start, reqSize, rsSize, r, config.CompactLogs)
+			PrintLog(start, reqBody.Count(), rsSize, r, config.CompactLogs)
 		}
 	})
 }
 
-func createRequest(r *http.Request, config *config.ProxyConfig) (_ *http.Request, requestSize int, _ error) {
-	url := r.URL
-	url.Host = config.TargetHost + ":" + config.TargetPort
-	url.Scheme = defaultScheme
+// createRequest creates the request to the cluster target, the body is not buffered
+// but piped to the target while it is read from the client
+func createRequest(r *http.Request, c *cluster.Cluster, config *config.ProxyConfig) (_ *http.Request, _ *countingReader, _ error) {
+	url := *r.URL
+	url.Host = c.Authority
+	url.Scheme = c.Scheme
 
-	reqBody, err := ioutil.ReadAll(r.Body)
-	if err != nil {
-		return nil, 0, fmt.Errorf("[%s] error reading request", config.ProxyName)
+	reqBody := &countingReader{ReadCloser: r.Body}
+	var body io.Reader = reqBody
+	if r.Body == nil || r.Body == http.NoBody {
+		body = http.NoBody
 	}
 
-	proxyReq, err := http.NewRequest(r.Method, url.String(), ioutil.NopCloser(bytes.NewReader(reqBody)))
+	proxyReq, err := http.NewRequestWithContext(r.Context(), r.Method, url.String(), body)
 	if err != nil {
-		return nil, 0, fmt.Errorf("[%s] error parsing request", config.ProxyName)
+		return nil, nil, fmt.Errorf("[%s] error parsing request", config.ProxyName)
 	}
 
+	proxyReq.ContentLength = r.ContentLength
+	// not sent to the target, it is used by the balancers hashing the client IP
+	proxyReq.RemoteAddr = r.RemoteAddr
 	proxyReq.Header = r.Header.Clone()
 	proxyReq.Header.Set(forwardedHostHeader, r.Host)
 	proxyReq.Header.Set(forwardedForHeder, r.RemoteAddr)
 	proxyReq.Header.Set(proxiedByForHeder, config.ProxyName)
 
-	proxyReq.Trailer = r.Trailer.Clone()
+	if config.TLS != nil {
+		// the identity is only forwarded when the client certificate was verified,
+		// any value sent by the client is discarded
+		proxyReq.Header.Del(config.TLS.IdentityHeader)
+		if id := certs.PeerIdentity(r.TLS); id != nil {
+			proxyReq.Header.Set(config.TLS.IdentityHeader, id.String())
+		}
+	}
+
+	// the trailers are filled once the client body is fully read, the same map
+	// is shared so the transport sends them after the body
+	proxyReq.Trailer = r.Trailer
 
-	return proxyReq, len(reqBody), nil
+	return proxyReq, reqBody, nil
 }
 
+// resultOf classifies the target response for the outlier detection, the gRPC status
+// is in the trailers or in the headers of the trailers only responses
+func resultOf(rs *http.Response) conn.Result {
+	if rs.StatusCode >= http.StatusInternalServerError {
+		return conn.ServerError
+	}
+
+	code := rs.Trailer.Get(grpcStatus)
+	if code == "" {
+		code = rs.Header.Get(grpcStatus)
+	}
+
+	switch code {
+	case strconv.Itoa(codeInternal), strconv.Itoa(codeUnavailable):
+		return conn.GRPCError
+	default:
+		return conn.Success
+	}
+}
+
+// writeResponse streams the target response to the client flushing every chunk
+// read, the trailers are sent once the body is completed
 func writeResponse(w http.ResponseWriter, rs *http.Response, config *config.ProxyConfig) (responseSize int, _ error) {
+	defer rs.Body.Close()
+
 	for k, vals := range rs.Header {
 		for _, val := range vals {
 			w.Header().Add(k, val)
@@ -80,14 +227,30 @@ func writeResponse(w http.ResponseWriter, rs *http.Response, config *config.Prox
 	}
 
 	w.Header().Add(proxiedByForHeder, config.ProxyName)
-	rsBody, err := ioutil.ReadAll(rs.Body)
-	if err != nil {
-		return 0, fmt.Errorf("[%s] error reading target response", config.ProxyName)
-	}
-
 	w.WriteHeader(rs.StatusCode)
-	defer rs.Body.Close()
-	w.Write(rsBody)
+
+	flusher, _ := w.(http.Flusher)
+	flush(flusher)
+
+	buf := make([]byte, copyBufferSize)
+	for {
+		n, err := rs.Body.Read(buf)
+		if n > 0 {
+			if _, werr := w.Write(buf[:n]); werr != nil {
+				return responseSize, fmt.Errorf("[%s] error writing response", config.ProxyName)
+			}
+			responseSize += n
+			flush(flusher)
+		}
+
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return responseSize, fmt.Errorf("[%s] error reading target response", config.ProxyName)
+		}
+	}
 
 	for t, vals := range rs.Trailer {
 		for _, val := range vals {
@@ -95,7 +258,31 @@ func writeResponse(w http.ResponseWriter, rs *http.Response, config *config.Prox
 		}
 	}
 
-	return len(rsBody), nil
+	return responseSize, nil
+}
+
+func flush(f http.Flusher) {
+	if f != nil {
+		f.Flush()
+	}
+}
+
+// countingReader counts the bytes read from the request body,
+// the body is read by the transport in its own goroutine
+type countingReader struct {
+	io.ReadCloser
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	atomic.AddInt64(&c.n, int64(n))
+	return n, err
+}
+
+// Count returns the number of bytes read so far
+func (c *countingReader) Count() int {
+	return int(atomic.LoadInt64(&c.n))
 }
 
 // PrintLog prints in stout basic information about the request and response
@@ -103,9 +290,14 @@ func PrintLog(t time.Time, reqSize int, resSize int, r *http.Request, compact bo
 	logStr := ""
 
 	if compact {
-		logStr = `id: %s | p: %s | pr: %s | ms: %d | rq_ln: %d | rs_ln: %d`
+		logStr = `id: %s | p: %s | pr: %s | ms: %d | rq_ln: %d | rs_ln: %d | cl: %s`
 	} else {
-		logStr = `{"rq_id": "%s", "rq_path": "%s", "rq_proto": "%s", "elapsed_time_ms": %d, "rq_length": %d, "rs_length": %d}`
+		logStr = `{"rq_id": "%s", "rq_path": "%s", "rq_proto": "%s", "elapsed_time_ms": %d, "rq_length": %d, "rs_length": %d, "rq_client": "%s"}`
+	}
+
+	var client string
+	if id := certs.PeerIdentity(r.TLS); id != nil {
+		client = id.ID()
 	}
 
 	logStr = fmt.Sprintf(logStr,
@@ -115,6 +307,7 @@ func PrintLog(t time.Time, reqSize int, resSize int, r *http.Request, compact bo
 		time.Since(t).Milliseconds(),
 		reqSize,
 		resSize,
+		client,
 	)
 
 	log.Println(logStr)
@@ -3,6 +3,7 @@ package proxy
 import (
 	"bytes"
 	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -14,11 +15,19 @@ import (
 	"testing"
 	"time"
 
+	"github.com/stretchr/testify/assert"
 	"golang.org/x/net/http2"
+
+	"github.com/cperez08/h2-proxy/breaker"
+	"github.com/cperez08/h2-proxy/cluster"
+	"github.com/cperez08/h2-proxy/config"
+	"github.com/cperez08/h2-proxy/conn"
+	"github.com/cperez08/h2-proxy/router"
 )
 
 var (
-	cfg, _ = NewProxyFromFile("../config/config.yaml")
+	cfg, _      = NewProxyFromFile("../config/config.yaml")
+	testCluster = &cluster.Cluster{Name: config.DefaultCluster, Authority: "127.0.0.1:7090", Scheme: "http"}
 )
 
 func TestProxyHandler(t *testing.T) {
@@ -194,18 +203,122 @@ func TestCreateRequest(t *testing.T) {
 		t.FailNow()
 	}
 
-	if _, _, err := createRequest(req, cfg); err == nil {
-		t.Log("expected error creating request")
+	// the body is not read when the request is created but piped to the target
+	proxyReq, body, err := createRequest(req, testCluster, cfg)
+	if err != nil {
+		t.Log("unexpected error creating request", err)
+		t.FailNow()
+	}
+
+	if _, err := ioutil.ReadAll(proxyReq.Body); err == nil {
+		t.Log("expected error reading request")
+		t.Fail()
+	}
+
+	if body.Count() != 0 {
+		t.Log("unexpected request size")
 		t.Fail()
 	}
 
+	assert.Equal(t, "http", proxyReq.URL.Scheme)
+
+	req, _ = http.NewRequest("GET", "http://localhost:9090/user.UserService/CreateUser", nil)
+	proxyReq, _, _ = createRequest(req, &cluster.Cluster{Authority: "users:50051", Scheme: "https"}, cfg)
+	assert.Equal(t, "https", proxyReq.URL.Scheme)
+	assert.Equal(t, "users:50051", proxyReq.URL.Host)
+
+	// the identity sent by the client is never forwarded
+	cfg.TLS = &config.TLSConfig{IdentityHeader: "X-Client-Identity"}
+	req, _ = http.NewRequest("GET", "localhost:9090", nil)
+	req.Header.Set("X-Client-Identity", "fake")
+	proxyReq, _, _ = createRequest(req, testCluster, cfg)
+	assert.Equal(t, "", proxyReq.Header.Get("X-Client-Identity"))
+
+	pair, _ := tls.LoadX509KeyPair("../certs/testdata/client.pem", "../certs/testdata/client-key.pem")
+	cert, _ := x509.ParseCertificate(pair.Certificate[0])
+	req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}, VerifiedChains: [][]*x509.Certificate{{cert}}}
+	proxyReq, _, _ = createRequest(req, testCluster, cfg)
+	assert.Contains(t, proxyReq.Header.Get("X-Client-Identity"), "URI=spiffe://cluster.local/ns/default/sa/users")
+	cfg.TLS = nil
+
 	req = &http.Request{Method: "¡™¢", Body: ioutil.NopCloser(bytes.NewBuffer([]byte(``))), Header: make(http.Header), URL: &url.URL{Host: "localhost"}}
-	if _, _, err := createRequest(req, cfg); err == nil {
+	if _, _, err := createRequest(req, testCluster, cfg); err == nil {
 		t.Log("expected error creating new proxy request")
 		t.Fail()
 	}
 }
 
+func TestProxyHandlerStreaming(t *testing.T) {
+	FakeProxyListerner, err := net.Listen("tcp", "0.0.0.0:7070")
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+
+	FakeServerListerner, err := net.Listen("tcp", "0.0.0.0:7090")
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+
+	defer FakeProxyListerner.Close()
+	defer FakeServerListerner.Close()
+
+	tr := &http2.Transport{
+		DisableCompression: true,
+		AllowHTTP:          true,
+		DialTLS: func(netw, addr string, cfg *tls.Config) (net.Conn, error) {
+			return net.Dial(netw, addr)
+		},
+	}
+	defer tr.CloseIdleConnections()
+
+	go ServeListener(FakeProxyListerner, Handler(cfg, newTestRouter(&http.Client{Transport: tr})))
+	go ServeListener(FakeServerListerner, EchoHandler())
+
+	cliTr := &http2.Transport{
+		DisableCompression: true,
+		AllowHTTP:          true,
+		DialTLS: func(netw, addr string, cfg *tls.Config) (net.Conn, error) {
+			return net.Dial(netw, addr)
+		},
+	}
+	defer cliTr.CloseIdleConnections()
+
+	pr, pw := io.Pipe()
+	req, _ := http.NewRequest(http.MethodPost, "http://localhost:7070/echo", pr)
+
+	response, err := (&http.Client{Transport: cliTr}).Do(req)
+	if err != nil {
+		t.Log("error performing requests", err)
+		t.FailNow()
+	}
+	defer response.Body.Close()
+
+	// every message must be received before the request body is completed
+	buf := make([]byte, 5)
+	for _, msg := range []string{"ping1", "ping2", "ping3"} {
+		pw.Write([]byte(msg))
+
+		if _, err := io.ReadFull(response.Body, buf); err != nil || string(buf) != msg {
+			t.Log("unexpected streamed message", string(buf), err)
+			t.FailNow()
+		}
+	}
+
+	pw.Close()
+	rest, err := ioutil.ReadAll(response.Body)
+	if err != nil || len(rest) != 0 {
+		t.Log("unexpected end of stream", err)
+		t.Fail()
+	}
+
+	if response.Trailer.Get("grpc-status") != "0" {
+		t.Log("expected trailer not received")
+		t.Fail()
+	}
+}
+
 func TestWriteResponse(t *testing.T) {
 	wr := NewCustomeRsWriter()
 	var fr io.ReadCloser = &FakeReader{}
@@ -217,6 +330,43 @@ func TestWriteResponse(t *testing.T) {
 	}
 }
 
+func TestResultOf(t *testing.T) {
+	rs := &http.Response{StatusCode: http.StatusBadGateway, Header: make(http.Header)}
+	assert.Equal(t, conn.ServerError, resultOf(rs))
+
+	rs = &http.Response{StatusCode: http.StatusOK, Header: http.Header{"Grpc-Status": {"14"}}}
+	assert.Equal(t, conn.GRPCError, resultOf(rs))
+
+	rs = &http.Response{StatusCode: http.StatusOK, Header: make(http.Header), Trailer: http.Header{"Grpc-Status": {"13"}}}
+	assert.Equal(t, conn.GRPCError, resultOf(rs))
+
+	rs = &http.Response{StatusCode: http.StatusOK, Header: make(http.Header), Trailer: http.Header{"Grpc-Status": {"5"}}}
+	assert.Equal(t, conn.Success, resultOf(rs))
+}
+
+func TestCircuitBreakerOpen(t *testing.T) {
+	c := *testCluster
+	c.Breaker = breaker.New(&config.CircuitBreakersConfig{MaxRequests: 0})
+	rt, err := router.NewRouter(cfg, map[string]*cluster.Cluster{c.Name: &c})
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+
+	req, _ := http.NewRequest(http.MethodPost, "http://localhost:7070/ok", nil)
+	req.Header.Set("Content-Type", "application/grpc")
+	w := NewCustomeRsWriter()
+	Handler(cfg, rt).ServeHTTP(w, req)
+
+	assert.Equal(t, "14", w.Header().Get(grpcStatus))
+	assert.Equal(t, uint64(1), c.Breaker.Trips().Requests)
+
+	req.Header.Del("Content-Type")
+	w = NewCustomeRsWriter()
+	Handler(cfg, rt).ServeHTTP(w, req)
+	assert.Equal(t, http.StatusServiceUnavailable, w.(*CustomResponseWriter).Status)
+}
+
 func SetUpFakeServerProxy(lis net.Listener) {
 	t := &http2.Transport{
 		DisableCompression: true,
@@ -238,7 +388,7 @@ func SetUpFakeServerProxy(lis net.Listener) {
 
 		log.Println("accepted new connection from", conn.RemoteAddr().String())
 		server.ServeConn(conn, &http2.ServeConnOpts{
-			Handler:    Handler(cfg, cli),
+			Handler:    Handler(cfg, newTestRouter(cli)),
 			BaseConfig: &http.Server{},
 		})
 	}
@@ -287,6 +437,58 @@ func SetUpTimeoutServer(lis net.Listener) {
 	}
 }
 
+// newTestRouter returns a router sending everything to the test cluster using cli
+func newTestRouter(cli *http.Client) *router.Router {
+	c := *testCluster
+	c.Client = cli
+	rt, err := router.NewRouter(cfg, map[string]*cluster.Cluster{c.Name: &c})
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	return rt
+}
+
+// ServeListener serves every accepted connection in its own goroutine
+// until the listener is closed
+func ServeListener(lis net.Listener, h http.Handler) {
+	server := http2.Server{}
+	for {
+		conn, err := lis.Accept()
+		if err != nil {
+			return
+		}
+
+		go server.ServeConn(conn, &http2.ServeConnOpts{
+			Handler:    h,
+			BaseConfig: &http.Server{},
+		})
+	}
+}
+
+// EchoHandler writes back every chunk received as soon as it is read
+func EchoHandler() http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+
+		buf := make([]byte, 1024)
+		for {
+			n, err := r.Body.Read(buf)
+			if n > 0 {
+				w.Write(buf[:n])
+				w.(http.Flusher).Flush()
+			}
+
+			if err != nil {
+				break
+			}
+		}
+
+		w.Header().Set(http.TrailerPrefix+"grpc-status", "0")
+	})
+}
+
 func FakeHandler() http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		headers := map[string]string{"server": "fake-server", "version": "v1"}
@@ -310,3 +512,55 @@ func FakeHandler() http.HandlerFunc {
 		}
 	})
 }
+
+func TestRateLimit(t *testing.T) {
+	target := listenLocal(t)
+	defer target.Close()
+	go ServeListener(target, FakeHandler())
+
+	tr := newTestTransport()
+	defer tr.CloseIdleConnections()
+	clusters := map[string]*cluster.Cluster{
+		"users": {Name: "users", Authority: target.Addr().String(), Scheme: "http", Client: &http.Client{Transport: tr}},
+	}
+
+	rcfg := *cfg
+	rcfg.RateLimit = &config.RateLimitConfig{RequestsPerSecond: 100, Burst: 100}
+	rcfg.Routes = []*config.RouteConfig{{
+		Match:     &config.RouteMatch{Prefix: "/"},
+		Cluster:   "users",
+		RateLimit: &config.RateLimitConfig{RequestsPerSecond: 0.1, Burst: 2, ClientKey: &config.ClientKey{Header: "x-caller"}},
+	}}
+	rt, err := router.NewRouter(&rcfg, clusters)
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+
+	h := Handler(&rcfg, rt)
+	send := func(caller string, grpc bool) *CustomResponseWriter {
+		req, _ := http.NewRequest(http.MethodPost, "http://localhost:7070/ok", nil)
+		req.Header.Set("x-caller", caller)
+		if grpc {
+			req.Header.Set(contentType, "application/grpc")
+		}
+
+		w := NewCustomeRsWriter().(*CustomResponseWriter)
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	assert.Equal(t, http.StatusOK, send("orders", false).Status)
+	assert.Equal(t, http.StatusOK, send("orders", false).Status)
+
+	w := send("orders", false)
+	assert.Equal(t, http.StatusTooManyRequests, w.Status)
+	assert.Equal(t, "10", w.Header().Get(retryAfterHeader))
+
+	w = send("orders", true)
+	assert.Equal(t, "8", w.Header().Get(grpcStatus))
+	assert.NotEmpty(t, w.Header().Get(retryAfterHeader))
+
+	// other callers have their own bucket
+	assert.Equal(t, http.StatusOK, send("payments", false).Status)
+}
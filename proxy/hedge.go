@@ -0,0 +1,207 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/cperez08/h2-proxy/cluster"
+	"github.com/cperez08/h2-proxy/config"
+	"github.com/cperez08/h2-proxy/conn"
+)
+
+const (
+	hedgeWindowSize    = 1000 // latencies kept per route
+	minHedgeSamples    = 20   // latencies needed to hedge with the percentile delay
+	percentileInterval = 100  // latencies added before computing the percentile again
+)
+
+// hedging sends the hedged requests of the routes and keeps their recent latencies
+type hedging struct {
+	m         sync.Mutex
+	latencies map[*config.RouteConfig]*latencyWindow
+}
+
+// latencyWindow is a ring buffer with the latest latencies of a route
+type latencyWindow struct {
+	samples    []time.Duration
+	next       int
+	added      int // latencies added since the percentile was computed
+	percentile time.Duration
+}
+
+// hedgeLeg is the result of one of the requests sent
+type hedgeLeg struct {
+	rs     *http.Response
+	stream *conn.Stream
+	err    error
+	i      int // index of the request in the cancel functions
+}
+
+func newHedging() *hedging {
+	return &hedging{latencies: make(map[*config.RouteConfig]*latencyWindow)}
+}
+
+// do sends the request and, when there is no response after the delay, a copy to other target,
+// the first response received is returned and the other request is canceled. The body is read
+// before sending the request, when it is too large to be sent twice the request is not hedged
+func (h *hedging) do(c *cluster.Cluster, rc *config.RouteConfig, req *http.Request) (*http.Response, *conn.Stream, error) {
+	var payload []byte
+	hasBody := req.Body != nil && req.Body != http.NoBody
+	if hasBody {
+		var err error
+		if payload, err = ioutil.ReadAll(io.LimitReader(req.Body, maxReplayBodySize+1)); err != nil {
+			return nil, &conn.Stream{}, fmt.Errorf("[h2-proxy]: error reading request body %w", err)
+		}
+
+		if len(payload) > maxReplayBodySize {
+			body := &replayBody{src: ioutil.NopCloser(io.MultiReader(bytes.NewReader(payload), req.Body))}
+			return do(c, rc.Retry, req, body, &conn.Stream{})
+		}
+	}
+
+	start := time.Now()
+	results := make(chan hedgeLeg, 2)
+	// the requests are canceled as soon as other one wins, before they return
+	var cancels []context.CancelFunc
+	send := func(stream *conn.Stream) {
+		var body *replayBody
+		if hasBody {
+			body = &replayBody{src: ioutil.NopCloser(bytes.NewReader(payload))}
+		}
+
+		ctx, cancel := context.WithCancel(req.Context())
+		i := len(cancels)
+		cancels = append(cancels, cancel)
+		go func() {
+			rs, s, err := do(c, rc.Retry, req.WithContext(ctx), body, stream)
+			results <- hedgeLeg{rs: rs, stream: s, err: err, i: i}
+		}()
+	}
+
+	primary := &conn.Stream{}
+	send(primary)
+
+	delay, ok := h.delay(rc)
+	if !ok {
+		return h.first(rc, start, results, cancels)
+	}
+
+	t := time.NewTimer(delay)
+	defer t.Stop()
+
+	select {
+	case l := <-results:
+		return h.result(rc, start, l)
+	case <-t.C:
+	}
+
+	// the hedged requests count as retries in the circuit breakers until their stream is done
+	if !c.Breaker.AcquireRetry() {
+		return h.first(rc, start, results, cancels)
+	}
+
+	hedge := primary.Hedge()
+	hedge.OnDone(c.Breaker.ReleaseRetry)
+	send(hedge)
+	return h.first(rc, start, results, cancels)
+}
+
+// first returns the first response of the requests sent, the errors are only returned when all
+// of them failed. The other requests are canceled right away and discarded once they return
+func (h *hedging) first(rc *config.RouteConfig, start time.Time, results chan hedgeLeg, cancels []context.CancelFunc) (*http.Response, *conn.Stream, error) {
+	for pending := len(cancels); pending > 1; pending-- {
+		l := <-results
+		if l.err != nil {
+			l.stream.Done()
+			cancels[l.i]()
+			continue
+		}
+
+		for i, cancel := range cancels {
+			if i != l.i {
+				cancel()
+			}
+		}
+
+		go func(pending int) {
+			for ; pending > 0; pending-- {
+				l := <-results
+				if l.rs != nil {
+					l.rs.Body.Close()
+				}
+				l.stream.Done()
+			}
+		}(pending - 1)
+
+		return h.result(rc, start, l)
+	}
+
+	return h.result(rc, start, <-results)
+}
+
+// result records the latency of the response, the context of the request is canceled
+// by the server once the handler returns
+func (h *hedging) result(rc *config.RouteConfig, start time.Time, l hedgeLeg) (*http.Response, *conn.Stream, error) {
+	if l.err == nil {
+		h.observe(rc, time.Since(start))
+	}
+
+	return l.rs, l.stream, l.err
+}
+
+// observe records the latency until the response headers
+func (h *hedging) observe(rc *config.RouteConfig, d time.Duration) {
+	h.m.Lock()
+	defer h.m.Unlock()
+
+	w, ok := h.latencies[rc]
+	if !ok {
+		w = &latencyWindow{}
+		h.latencies[rc] = w
+	}
+
+	if len(w.samples) < hedgeWindowSize {
+		w.samples = append(w.samples, d)
+	} else {
+		w.samples[w.next] = d
+		w.next = (w.next + 1) % hedgeWindowSize
+	}
+	w.added++
+}
+
+// delay returns the time to wait before sending the hedged request, the configured one or the
+// percentile of the route latency, false when there are not enough latencies to compute it
+func (h *hedging) delay(rc *config.RouteConfig) (time.Duration, bool) {
+	if rc.Hedge.Delay > 0 {
+		return time.Duration(rc.Hedge.Delay) * time.Millisecond, true
+	}
+
+	h.m.Lock()
+	defer h.m.Unlock()
+
+	w, ok := h.latencies[rc]
+	if !ok || len(w.samples) < minHedgeSamples {
+		return 0, false
+	}
+
+	if w.percentile == 0 || w.added >= percentileInterval {
+		sorted := append([]time.Duration(nil), w.samples...)
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+		i := int(math.Ceil(rc.Hedge.Percentile/100*float64(len(sorted)))) - 1
+		if i < 0 {
+			i = 0
+		}
+		w.percentile, w.added = sorted[i], 0
+	}
+
+	return w.percentile, true
+}
@@ -0,0 +1,148 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/cperez08/h2-proxy/cluster"
+	"github.com/cperez08/h2-proxy/config"
+	"github.com/cperez08/h2-proxy/conn"
+	"github.com/cperez08/h2-proxy/router"
+)
+
+func TestHedge(t *testing.T) {
+	echo := func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		w.Write(b)
+	}
+
+	fast := listenLocal(t)
+	defer fast.Close()
+	go ServeListener(fast, http.HandlerFunc(echo))
+
+	canceled := make(chan struct{}, 4)
+	slow := listenLocal(t)
+	defer slow.Close()
+	go ServeListener(slow, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+			canceled <- struct{}{}
+		case <-time.After(2 * time.Second):
+			echo(w, r)
+		}
+	}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ccfg := &config.ClusterConfig{Name: "users", Endpoints: []*config.EndpointConfig{{Address: fast.Addr().String()}, {Address: slow.Addr().String()}}}
+	ccfg.DNSConfig = &config.DNSConfig{BalancerAlg: "round_robin"}
+	ccfg.SetDefaults()
+	c, err := cluster.NewCluster(ctx, ccfg)
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+
+	hcfg := *cfg
+	hcfg.Routes = []*config.RouteConfig{{
+		Match:      &config.RouteMatch{Prefix: "/"},
+		Cluster:    "users",
+		Idempotent: true,
+		Hedge:      &config.HedgePolicy{Delay: 20},
+	}}
+
+	rt, err := router.NewRouter(&hcfg, map[string]*cluster.Cluster{c.Name: c})
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+
+	proxyLis := listenLocal(t)
+	defer proxyLis.Close()
+	go ServeListener(proxyLis, Handler(&hcfg, rt))
+
+	cliTr := newTestTransport()
+	defer cliTr.CloseIdleConnections()
+	cli := &http.Client{Transport: cliTr, Timeout: time.Second}
+
+	// the slow requests are hedged to the fast endpoint and canceled
+	for i := 0; i < 4; i++ {
+		body := fmt.Sprintf(`{"req": "%d"}`, i)
+		req, _ := http.NewRequest(http.MethodPost, "http://"+proxyLis.Addr().String()+"/lookup", strings.NewReader(body))
+		rs, err := cli.Do(req)
+		if err != nil {
+			t.Log("error performing request", err)
+			t.FailNow()
+		}
+
+		b, _ := ioutil.ReadAll(rs.Body)
+		rs.Body.Close()
+		assert.Equal(t, http.StatusOK, rs.StatusCode)
+		assert.Equal(t, body, string(b))
+	}
+
+	select {
+	case <-canceled:
+	case <-time.After(time.Second):
+		t.Log("slow request not canceled")
+		t.Fail()
+	}
+}
+
+func TestHedgeCancelsLoser(t *testing.T) {
+	h := newHedging()
+	rc := &config.RouteConfig{Hedge: &config.HedgePolicy{Delay: 10}}
+	loserCtx, loserCancel := context.WithCancel(context.Background())
+	_, winnerCancel := context.WithCancel(context.Background())
+	defer winnerCancel()
+
+	results := make(chan hedgeLeg, 2)
+	results <- hedgeLeg{rs: &http.Response{StatusCode: http.StatusOK, Body: http.NoBody}, stream: &conn.Stream{}, i: 1}
+	rs, stream, err := h.first(rc, time.Now(), results, []context.CancelFunc{loserCancel, winnerCancel})
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, rs.StatusCode)
+	stream.Done()
+
+	// the slow request is canceled while it is still in flight
+	assert.Equal(t, context.Canceled, loserCtx.Err())
+	results <- hedgeLeg{err: loserCtx.Err(), stream: &conn.Stream{}, i: 0}
+}
+
+func TestHedgeDelay(t *testing.T) {
+	h := newHedging()
+	rc := &config.RouteConfig{Hedge: &config.HedgePolicy{Percentile: 95}}
+
+	for i := 1; i < minHedgeSamples; i++ {
+		h.observe(rc, time.Duration(i)*time.Millisecond)
+	}
+	_, ok := h.delay(rc)
+	assert.False(t, ok)
+
+	for i := minHedgeSamples; i <= 100; i++ {
+		h.observe(rc, time.Duration(i)*time.Millisecond)
+	}
+	d, ok := h.delay(rc)
+	assert.True(t, ok)
+	assert.Equal(t, 95*time.Millisecond, d)
+
+	// the percentile is computed again after some latencies
+	for i := 0; i < hedgeWindowSize; i++ {
+		h.observe(rc, time.Millisecond)
+	}
+	d, _ = h.delay(rc)
+	assert.Equal(t, time.Millisecond, d)
+	assert.Len(t, h.latencies[rc].samples, hedgeWindowSize)
+
+	rc.Hedge.Delay = 10
+	d, ok = h.delay(rc)
+	assert.True(t, ok)
+	assert.Equal(t, 10*time.Millisecond, d)
+}
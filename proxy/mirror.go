@@ -0,0 +1,148 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/cperez08/h2-proxy/cluster"
+	"github.com/cperez08/h2-proxy/config"
+	"github.com/cperez08/h2-proxy/conn"
+)
+
+const (
+	shadowHeader      = "X-Shadow-Request"
+	maxMirrorBodySize = 4 * 1024 * 1024
+	maxMirrorRequests = 100
+	mirrorTimeout     = 10 * time.Second
+)
+
+// mirror sends the shadow requests in background, the number of shadow requests
+// in flight is limited and new ones are dropped when the limit is reached
+type mirror struct {
+	config *config.ProxyConfig
+	slots  chan struct{}
+}
+
+func newMirror(config *config.ProxyConfig) *mirror {
+	return &mirror{config: config, slots: make(chan struct{}, maxMirrorRequests)}
+}
+
+// send sends a copy of the client request to the shadow cluster once the primary request
+// is completed, body is nil when the request has no body. The response is discarded
+func (m *mirror) send(r *http.Request, c *cluster.Cluster, body *mirrorBody, preserveHost bool) {
+	var payload []byte
+	// the body is only complete when the primary request read all of it, e.g. it is not when
+	// the primary request failed before sending the whole body so the request is not mirrored
+	if body != nil {
+		var ok bool
+		if payload, ok = body.Bytes(); !ok {
+			LogError(r, fmt.Sprintf("[%s] request body not mirrored to %s, incomplete or too large", m.config.ProxyName, c.Name), m.config.PrintLogs)
+			return
+		}
+	}
+
+	select {
+	case m.slots <- struct{}{}:
+	default:
+		LogError(r, fmt.Sprintf("[%s] too many mirrored requests in flight, dropping request to %s", m.config.ProxyName, c.Name), m.config.PrintLogs)
+		return
+	}
+
+	// the shadow requests count in the circuit breakers of the shadow cluster
+	if !c.Breaker.AcquireRequest() {
+		<-m.slots
+		LogError(r, fmt.Sprintf("[%s] circuit breaker max requests reached for cluster %s, dropping mirrored request", m.config.ProxyName, c.Name), m.config.PrintLogs)
+		return
+	}
+
+	// the client request is already completed so the shadow request has its own context
+	ctx, cancel := context.WithTimeout(context.Background(), mirrorTimeout)
+	shadow := r.Clone(ctx)
+	shadow.Body = http.NoBody
+	shadow.ContentLength = 0
+	if body != nil {
+		shadow.Body = ioutil.NopCloser(bytes.NewReader(payload))
+		shadow.ContentLength = int64(len(payload))
+	}
+	shadow.Trailer = r.Trailer.Clone()
+
+	go func() {
+		defer func() { <-m.slots }()
+		defer c.Breaker.ReleaseRequest()
+		defer cancel()
+
+		proxyReq, _, err := createRequest(shadow, c, m.config)
+		if err != nil {
+			LogError(shadow, err.Error(), m.config.PrintLogs)
+			return
+		}
+
+		if preserveHost {
+			proxyReq.Host = r.Host
+		}
+		proxyReq.Header.Set(shadowHeader, "true")
+
+		stream := &conn.Stream{}
+		proxyReq = proxyReq.WithContext(conn.WithStream(proxyReq.Context(), stream))
+		defer stream.Done()
+
+		rs, err := c.Client.Do(proxyReq)
+		if err != nil {
+			LogError(shadow, fmt.Sprintf("[%s] error performing mirrored request to %s: "+err.Error(), m.config.ProxyName, c.Name), m.config.PrintLogs)
+			return
+		}
+
+		io.Copy(ioutil.Discard, rs.Body)
+		rs.Body.Close()
+	}()
+}
+
+// mirrorBody copies the request body while it is read by the transport, the copy
+// can only be mirrored when the body was completely read and it is not too large
+type mirrorBody struct {
+	io.ReadCloser
+	m        sync.Mutex
+	buf      bytes.Buffer
+	complete bool
+	overflow bool
+}
+
+func (b *mirrorBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	if n > 0 && !b.overflow {
+		if b.buf.Len()+n > maxMirrorBodySize {
+			b.overflow = true
+			b.buf = bytes.Buffer{}
+		} else {
+			b.buf.Write(p[:n])
+		}
+	}
+
+	if err == io.EOF {
+		b.complete = true
+	}
+
+	return n, err
+}
+
+// Bytes returns the copy of the body, false when it can not be mirrored
+func (b *mirrorBody) Bytes() ([]byte, bool) {
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	if !b.complete || b.overflow {
+		return nil, false
+	}
+
+	return b.buf.Bytes(), true
+}
@@ -0,0 +1,142 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/http2"
+
+	"github.com/cperez08/h2-proxy/breaker"
+	"github.com/cperez08/h2-proxy/cluster"
+	"github.com/cperez08/h2-proxy/config"
+	"github.com/cperez08/h2-proxy/router"
+)
+
+func TestMirrorRequest(t *testing.T) {
+	target := listenLocal(t)
+	defer target.Close()
+	go ServeListener(target, FakeHandler())
+
+	type shadowRequest struct {
+		body   string
+		shadow string
+	}
+	received := make(chan shadowRequest, 1)
+	release := make(chan struct{})
+	shadowTarget := listenLocal(t)
+	defer shadowTarget.Close()
+	go ServeListener(shadowTarget, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		received <- shadowRequest{body: string(b), shadow: r.Header.Get(shadowHeader)}
+		// a slow shadow cluster does not delay the client
+		<-release
+	}))
+	defer close(release)
+
+	tr := newTestTransport()
+	defer tr.CloseIdleConnections()
+
+	clusters := map[string]*cluster.Cluster{
+		"primary": {Name: "primary", Authority: target.Addr().String(), Scheme: "http", Client: &http.Client{Transport: tr}},
+		"shadow":  {Name: "shadow", Authority: shadowTarget.Addr().String(), Scheme: "http", Client: &http.Client{Transport: tr}},
+	}
+
+	mcfg := *cfg
+	mcfg.Routes = []*config.RouteConfig{{
+		Match:   &config.RouteMatch{Prefix: "/"},
+		Cluster: "primary",
+		Mirror:  &config.MirrorPolicy{Cluster: "shadow", Percentage: 100},
+	}}
+
+	rt, err := router.NewRouter(&mcfg, clusters)
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+
+	proxyLis := listenLocal(t)
+	defer proxyLis.Close()
+	go ServeListener(proxyLis, Handler(&mcfg, rt))
+
+	cliTr := newTestTransport()
+	defer cliTr.CloseIdleConnections()
+
+	req, _ := http.NewRequest(http.MethodPost, "http://"+proxyLis.Addr().String()+"/ok", strings.NewReader(`{"req": "1"}`))
+	rs, err := (&http.Client{Transport: cliTr, Timeout: time.Second}).Do(req)
+	if err != nil {
+		t.Log("error performing request", err)
+		t.FailNow()
+	}
+	defer rs.Body.Close()
+
+	b, _ := ioutil.ReadAll(rs.Body)
+	assert.Equal(t, http.StatusOK, rs.StatusCode)
+	assert.Equal(t, `{"status":"ok"}`, string(b))
+
+	select {
+	case s := <-received:
+		assert.Equal(t, `{"req": "1"}`, s.body)
+		assert.Equal(t, "true", s.shadow)
+	case <-time.After(time.Second):
+		t.Log("mirrored request not received")
+		t.Fail()
+	}
+}
+
+func TestMirrorBreaker(t *testing.T) {
+	m := newMirror(cfg)
+	c := &cluster.Cluster{Name: "shadow", Breaker: breaker.New(&config.CircuitBreakersConfig{MaxRequests: 0})}
+	r, _ := http.NewRequest(http.MethodGet, "http://localhost/ok", nil)
+
+	// the shadow cluster is over its max requests, the shadow request is dropped
+	m.send(r, c, nil, false)
+	assert.Equal(t, uint64(1), c.Breaker.Trips().Requests)
+	assert.Equal(t, 0, len(m.slots))
+}
+
+func TestMirrorBody(t *testing.T) {
+	b := &mirrorBody{ReadCloser: ioutil.NopCloser(strings.NewReader("hello"))}
+	buf := make([]byte, 2)
+	b.Read(buf)
+
+	// the body is not completely read yet
+	_, ok := b.Bytes()
+	assert.False(t, ok)
+
+	ioutil.ReadAll(b)
+	payload, ok := b.Bytes()
+	assert.True(t, ok)
+	assert.Equal(t, "hello", string(payload))
+
+	b = &mirrorBody{ReadCloser: ioutil.NopCloser(bytes.NewReader(make([]byte, maxMirrorBodySize+1)))}
+	ioutil.ReadAll(b)
+	_, ok = b.Bytes()
+	assert.False(t, ok)
+}
+
+func listenLocal(t *testing.T) net.Listener {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+
+	return lis
+}
+
+func newTestTransport() *http2.Transport {
+	return &http2.Transport{
+		DisableCompression: true,
+		AllowHTTP:          true,
+		DialTLS: func(netw, addr string, cfg *tls.Config) (net.Conn, error) {
+			return net.Dial(netw, addr)
+		},
+	}
+}
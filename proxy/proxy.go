@@ -28,6 +28,11 @@ func NewProxyFromFile(file string) (*config.ProxyConfig, error) {
 				return nil, err
 			}
 
+			// the configuration from the environment is validated as the file one
+			if err := rs.Validate(); err != nil {
+				return nil, err
+			}
+
 			return rs, nil
 		}
 
@@ -39,11 +44,16 @@ func NewProxyFromFile(file string) (*config.ProxyConfig, error) {
 		return nil, err
 	}
 
-	if rs.TargetHost == "" || rs.TargetPort == "" {
-		return nil, errors.New("target host and target port are mandatory")
+	if rs.Zone == "" {
+		// the zone usually depends on the node where the proxy runs
+		rs.Zone = os.Getenv("H2_PROXY_ZONE")
 	}
 
 	rs.SetDefaults()
+	if err := rs.Validate(); err != nil {
+		return nil, err
+	}
+
 	return rs, nil
 }
 
@@ -59,6 +69,7 @@ func loadConfigWithDefaults(c *config.ProxyConfig) error {
 
 	c.TargetHost = host
 	c.TargetPort = port
+	c.Zone = os.Getenv("H2_PROXY_ZONE")
 	logs = strings.ToLower(logs)
 
 	if logs == "true" || logs == "false" {
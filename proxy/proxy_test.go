@@ -30,7 +30,8 @@ func TestNewProxyFromFile(t *testing.T) {
 
 	os.Setenv("H2_PROXY_TARGET_HOST", "127.0.0.1")
 	os.Setenv("H2_PROXY_TARGET_PORT", "8080")
-	Defaultcfg, _ := NewProxyFromFile("../config/noexists.yaml")
+	Defaultcfg, err := NewProxyFromFile("../config/noexists.yaml")
+	assert.NoError(t, err, "the configuration from the environment is validated")
 	assert.Equal(t, Defaultcfg.TargetHost, "127.0.0.1")
 
 	// force malformed yaml
@@ -61,6 +62,165 @@ func TestNewProxyFromFile(t *testing.T) {
 	RemoveTmpFile(fileName)
 }
 
+func TestNewProxyFromFileWithRoutes(t *testing.T) {
+	fileName := "config3.yaml"
+	CreateTmpFile(fileName, []byte(`
+clusters:
+  - name: users
+    target_host: users-service
+    target_port: '50051'
+    circuit_breakers:
+      max_requests: 10
+  - name: orders
+    target_host: orders-service
+    target_port: '50051'
+    dns_config:
+      balancer_alg: round_robin
+    circuit_breakers:
+      max_pending_requests: 0
+routes:
+  - match:
+      service: user.UserService
+    cluster: users
+  - match:
+      prefix: /
+    cluster: orders
+`))
+	defer RemoveTmpFile(fileName)
+
+	cfg, err := NewProxyFromFile("../config/" + fileName)
+	if err != nil {
+		t.Log("unexpected error reading yaml file ", err)
+		t.FailNow()
+	}
+
+	assert.Equal(t, 2, len(cfg.Clusters))
+	assert.Equal(t, 2, len(cfg.Routes))
+	assert.Equal(t, "none", cfg.Clusters[0].DNSConfig.BalancerAlg)
+	assert.Equal(t, "round_robin", cfg.Clusters[1].DNSConfig.BalancerAlg)
+	// an explicit 0 is kept to fail the requests instead of waiting for a stream
+	assert.Equal(t, 1024, *cfg.Clusters[0].CircuitBreakers.MaxPendingRequests)
+	assert.Equal(t, 0, *cfg.Clusters[1].CircuitBreakers.MaxPendingRequests)
+
+	// the target values build the default cluster and route
+	cfg, _ = NewProxyFromFile("../config/config.yaml")
+	assert.Equal(t, 1, len(cfg.Clusters))
+	assert.Equal(t, "default", cfg.Clusters[0].Name)
+	assert.Equal(t, "7090", cfg.Clusters[0].TargetPort)
+	assert.Equal(t, "/", cfg.Routes[0].Match.Prefix)
+	assert.Equal(t, "default", cfg.Routes[0].Cluster)
+
+	invalid := []string{
+		// unknown cluster
+		"clusters: [{name: users, target_host: users, target_port: '80'}]\nroutes: [{match: {prefix: /}, cluster: orders}]",
+		// duplicated cluster
+		"clusters: [{name: users, target_host: users, target_port: '80'}, {name: users, target_host: users, target_port: '80'}]",
+		// no target
+		"clusters: [{name: users, target_host: users}]",
+		// no name
+		"clusters: [{target_host: users, target_port: '80'}]",
+		// more than one matcher
+		"clusters: [{name: users, target_host: users, target_port: '80'}]\nroutes: [{match: {prefix: /, regex: .*}, cluster: users}]",
+		// no matcher
+		"clusters: [{name: users, target_host: users, target_port: '80'}]\nroutes: [{cluster: users}]",
+		// method without service
+		"clusters: [{name: users, target_host: users, target_port: '80'}]\nroutes: [{match: {prefix: /, method: Get}, cluster: users}]",
+		// virtual host without name
+		"clusters: [{name: users, target_host: users, target_port: '80'}]\nvirtual_hosts: [{domains: [a.com]}]",
+		// virtual host without domains
+		"clusters: [{name: users, target_host: users, target_port: '80'}]\nvirtual_hosts: [{name: a}]",
+		// duplicated domain
+		"clusters: [{name: users, target_host: users, target_port: '80'}]\nvirtual_hosts: [{name: a, domains: [a.com]}, {name: b, domains: [A.com]}]",
+		// invalid wildcard
+		"clusters: [{name: users, target_host: users, target_port: '80'}]\nvirtual_hosts: [{name: a, domains: [a.*.com]}]",
+		// virtual host route to unknown cluster
+		"clusters: [{name: users, target_host: users, target_port: '80'}]\nvirtual_hosts: [{name: a, domains: [a.com], routes: [{match: {prefix: /}, cluster: orders}]}]",
+		// cluster and weighted clusters
+		"clusters: [{name: users, target_host: users, target_port: '80'}]\nroutes: [{match: {prefix: /}, cluster: users, weighted_clusters: [{name: users, weight: 1}]}]",
+		// weighted cluster without weight
+		"clusters: [{name: users, target_host: users, target_port: '80'}]\nroutes: [{match: {prefix: /}, weighted_clusters: [{name: users}]}]",
+		// weighted cluster unknown
+		"clusters: [{name: users, target_host: users, target_port: '80'}]\nroutes: [{match: {prefix: /}, weighted_clusters: [{name: orders, weight: 1}]}]",
+		// hash policy with several attributes
+		"clusters: [{name: users, target_host: users, target_port: '80'}]\nroutes: [{match: {prefix: /}, cluster: users, hash_policy: {path: true, client_ip: true}}]",
+		// endpoint without port
+		"clusters: [{name: users, endpoints: [{address: users}]}]",
+		// negative endpoint weight
+		"clusters: [{name: users, endpoints: [{address: 'users:80', weight: -1}]}]",
+		// cluster hash policy with several attributes
+		"clusters: [{name: users, target_host: users, target_port: '80', dns_config: {balancer_alg: ring_hash, hash_policy: {header: a, path: true}}}]",
+		// slow start without window
+		"clusters: [{name: users, target_host: users, target_port: '80', dns_config: {balancer_alg: least_request, slow_start: {aggression: 2}}}]",
+		// zone aware without proxy zone
+		"clusters: [{name: users, target_host: users, target_port: '80', dns_config: {zone_aware: {}}}]",
+		// zone pattern without group
+		"zone: a\nclusters: [{name: users, target_host: users, target_port: '80', dns_config: {zone_aware: {zone_pattern: '^[a-z]+'}}}]",
+		// unknown health check type
+		"clusters: [{name: users, target_host: users, target_port: '80', health_check: {type: udp}}]",
+		// health check path without slash
+		"clusters: [{name: users, target_host: users, target_port: '80', health_check: {type: http, path: health}}]",
+		// outlier max ejection time lower than the base one
+		"clusters: [{name: users, target_host: users, target_port: '80', outlier_detection: {base_ejection_time: 60, max_ejection_time: 30}}]",
+		// outlier max ejection percent out of range
+		"clusters: [{name: users, target_host: users, target_port: '80', outlier_detection: {max_ejection_percent: 150}}]",
+		// negative circuit breakers threshold
+		"clusters: [{name: users, target_host: users, target_port: '80', circuit_breakers: {max_requests: -1}}]",
+		// retry budget out of range
+		"clusters: [{name: users, target_host: users, target_port: '80', circuit_breakers: {retry_budget: 150}}]",
+		// unknown retry condition
+		"clusters: [{name: users, target_host: users, target_port: '80'}]\nroutes: [{match: {prefix: /}, cluster: users, retry: {retry_on: [5xx]}}]",
+		// retry max interval lower than the base one
+		"clusters: [{name: users, target_host: users, target_port: '80'}]\nroutes: [{match: {prefix: /}, cluster: users, retry: {base_interval: 100, max_interval: 50}}]",
+		// negative route timeout
+		"clusters: [{name: users, target_host: users, target_port: '80'}]\nroutes: [{match: {prefix: /}, cluster: users, timeout: -1}]",
+		// hedge in a route not idempotent
+		"clusters: [{name: users, target_host: users, target_port: '80'}]\nroutes: [{match: {prefix: /}, cluster: users, hedge: {delay: 10}}]",
+		// hedge percentile out of range
+		"clusters: [{name: users, target_host: users, target_port: '80'}]\nroutes: [{match: {prefix: /}, cluster: users, idempotent: true, hedge: {percentile: 150}}]",
+		// rate limit without requests per second
+		"target_host: users\ntarget_port: '80'\nrate_limit: {burst: 10}",
+		// rate limit client key with several attributes
+		"clusters: [{name: users, target_host: users, target_port: '80'}]\nroutes: [{match: {prefix: /}, cluster: users, rate_limit: {requests_per_second: 10, client_key: {header: a, client_ip: true}}}]",
+		// global rate limit with unknown cluster
+		"clusters: [{name: users, target_host: users, target_port: '80'}]\nglobal_rate_limit: {cluster: ratelimit, domain: users}",
+		// global rate limit without domain
+		"clusters: [{name: users, target_host: users, target_port: '80'}]\nglobal_rate_limit: {cluster: users}",
+		// unknown global rate limit failure mode
+		"clusters: [{name: users, target_host: users, target_port: '80'}]\nglobal_rate_limit: {cluster: users, domain: users, failure_mode: ignore}",
+		// rate limit descriptor entry with several values
+		"clusters: [{name: users, target_host: users, target_port: '80'}]\nroutes: [{match: {prefix: /}, cluster: users, rate_limit_descriptors: [{entries: [{key: a, value: b, path: true}]}]}]",
+		// subset without headers
+		"clusters: [{name: users, target_host: users, target_port: '80'}]\nroutes: [{match: {prefix: /}, cluster: users, subset: {fallback: no_fallback}}]",
+		// default subset fallback without default subset
+		"clusters: [{name: users, target_host: users, target_port: '80'}]\nroutes: [{match: {prefix: /}, cluster: users, subset: {headers: {x-version: version}, fallback: default_subset}}]",
+		// subset in a cluster without endpoints
+		"clusters: [{name: users, target_host: users, target_port: '80'}]\nroutes: [{match: {prefix: /}, cluster: users, subset: {headers: {x-version: version}}}]",
+		// subset in a weighted cluster without endpoints
+		"clusters: [{name: users, endpoints: [{address: '10.0.0.1:80'}]}, {name: users-v2, target_host: users, target_port: '80'}]\nroutes: [{match: {prefix: /}, weighted_clusters: [{name: users, weight: 1}, {name: users-v2, weight: 1}], subset: {headers: {x-version: version}}}]",
+		// unknown subset fallback
+		"clusters: [{name: users, target_host: users, target_port: '80'}]\nroutes: [{match: {prefix: /}, cluster: users, subset: {headers: {x-version: version}, fallback: other}}]",
+		// mirror to unknown cluster
+		"clusters: [{name: users, target_host: users, target_port: '80'}]\nroutes: [{match: {prefix: /}, cluster: users, mirror: {cluster: orders}}]",
+		// mirror percentage out of range
+		"clusters: [{name: users, target_host: users, target_port: '80'}]\nroutes: [{match: {prefix: /}, cluster: users, mirror: {cluster: users, percentage: 150}}]",
+	}
+
+	for _, content := range invalid {
+		CreateTmpFile(fileName, []byte(content))
+		if _, err := NewProxyFromFile("../config/" + fileName); err == nil {
+			t.Log("expecting validation error for", content)
+			t.Fail()
+		}
+	}
+
+	// the subsets are supported in the clusters with endpoints
+	CreateTmpFile(fileName, []byte("clusters: [{name: users, endpoints: [{address: '10.0.0.1:80', metadata: {version: v2}}]}]\nroutes: [{match: {prefix: /}, cluster: users, subset: {headers: {x-version: version}}}]"))
+	if _, err := NewProxyFromFile("../config/" + fileName); err != nil {
+		t.Log("unexpected validation error ", err)
+		t.Fail()
+	}
+}
+
 func TestLogOptions(t *testing.T) {
 	os.Setenv("H2_PROXY_TARGET_HOST", "127.0.0.1")
 	os.Setenv("H2_PROXY_TARGET_PORT", "8080")
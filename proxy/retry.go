@@ -0,0 +1,279 @@
+package proxy
+
+import (
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cperez08/h2-proxy/breaker"
+	"github.com/cperez08/h2-proxy/cluster"
+	"github.com/cperez08/h2-proxy/config"
+	"github.com/cperez08/h2-proxy/conn"
+	"github.com/cperez08/h2-proxy/pool"
+	"golang.org/x/net/http2"
+)
+
+// maxReplayBodySize is the largest request body buffered to be replayed by the retries
+const maxReplayBodySize = 1024 * 1024
+
+// retry_on conditions, the gRPC codes are only retried in the trailers only
+// responses since the rest of the responses are already streamed to the client
+const (
+	retryConnectFailure = "connect_failure"
+	retryRefusedStream  = "refused_stream"
+	retryGoAway         = "goaway"
+	retry503            = "503"
+)
+
+// grpcRetryCodes maps the gRPC codes to their retry_on condition
+var grpcRetryCodes = map[string]string{
+	"1":  "cancelled",
+	"4":  "deadline_exceeded",
+	"8":  "resource_exhausted",
+	"13": "internal",
+	"14": "unavailable",
+}
+
+var errReplayAborted = errors.New("[h2-proxy]: request body replayed by a retry")
+
+// do sends the request to the cluster retrying the failures allowed by the retry policy, every
+// attempt has its own stream, starting with stream, and the retries avoid the connections of the
+// previous attempts. The stream returned must be done once the response is completed, it
+// releases the circuit breaker retry of the last attempt
+func do(c *cluster.Cluster, p *config.RetryPolicy, req *http.Request, body *replayBody, stream *conn.Stream) (*http.Response, *conn.Stream, error) {
+	for attempt := 1; ; attempt++ {
+		areq := req.WithContext(conn.WithStream(req.Context(), stream))
+		if body != nil {
+			areq.Body = body.attempt()
+		}
+
+		sent := time.Now()
+		rs, err := c.Client.Do(areq)
+		var cond string
+		if err != nil {
+			// the requests canceled by the client or rejected by the circuit breaker are not failures of the target
+			if req.Context().Err() != nil || errors.Is(err, breaker.ErrOpen) {
+				return nil, stream, err
+			}
+			stream.ObserveResult(conn.ConnectFailure)
+			cond = errorCondition(err)
+		} else {
+			// the latency until the response headers, the body can be a long stream
+			stream.ObserveLatency(time.Since(sent))
+			cond = responseCondition(rs)
+		}
+
+		if p == nil || attempt >= p.MaxAttempts || !retryOn(p, cond) || !body.replayable() || !c.Breaker.AcquireRetry() {
+			return rs, stream, err
+		}
+
+		if rs != nil {
+			stream.ObserveResult(resultOf(rs))
+			rs.Body.Close()
+		}
+
+		// the retry counts as active until the response of the attempt is completed
+		stream = stream.Retry()
+		stream.OnDone(c.Breaker.ReleaseRetry)
+
+		if err = backoff(req, p, attempt); err != nil {
+			return nil, stream, err
+		}
+	}
+}
+
+// backoff waits a random time up to the base interval doubled on every retry
+// and limited by the max interval, the error is returned when the request is canceled
+func backoff(req *http.Request, p *config.RetryPolicy, attempt int) error {
+	d := time.Duration(p.BaseInterval) * time.Millisecond
+	max := time.Duration(p.MaxInterval) * time.Millisecond
+	for i := 1; i < attempt && d < max; i++ {
+		d *= 2
+	}
+
+	if d > max {
+		d = max
+	}
+
+	if d <= 0 {
+		return nil
+	}
+
+	t := time.NewTimer(time.Duration(rand.Int63n(int64(d))) + 1)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		return nil
+	case <-req.Context().Done():
+		return req.Context().Err()
+	}
+}
+
+func retryOn(p *config.RetryPolicy, cond string) bool {
+	if cond == "" {
+		return false
+	}
+
+	for _, on := range p.RetryOn {
+		if on == cond {
+			return true
+		}
+	}
+
+	return false
+}
+
+// errorCondition returns the retry_on condition of the error, empty when it can not be retried
+func errorCondition(err error) string {
+	var se http2.StreamError
+	var ge http2.GoAwayError
+	var oe *net.OpError
+
+	switch {
+	case errors.As(err, &se):
+		if se.Code == http2.ErrCodeRefusedStream {
+			return retryRefusedStream
+		}
+		return ""
+	// the streams not processed by the target after a graceful GOAWAY fail with an unexported error
+	case errors.As(err, &ge), strings.Contains(err.Error(), "graceful shutdown GOAWAY"):
+		return retryGoAway
+	case errors.Is(err, pool.ErrNoConnections), errors.As(err, &oe) && oe.Op == "dial",
+		strings.Contains(err.Error(), "client conn not usable"), strings.Contains(err.Error(), "client conn is closed"):
+		return retryConnectFailure
+	default:
+		return ""
+	}
+}
+
+// responseCondition returns the retry_on condition of the response, empty when it is not a failure
+func responseCondition(rs *http.Response) string {
+	if rs.StatusCode == http.StatusServiceUnavailable {
+		return retry503
+	}
+
+	return grpcRetryCodes[rs.Header.Get(grpcStatus)]
+}
+
+// replayBody buffers the request body while it is read so the retries can send it again,
+// the body is read from the client only once and every attempt reads it from the beginning
+type replayBody struct {
+	src      io.ReadCloser
+	rm       sync.Mutex // serializes the reads of the client body
+	m        sync.Mutex
+	buf      []byte
+	read     int   // bytes read from the client
+	err      error // error returned by the client body, io.EOF when it is completed
+	overflow bool  // the body is larger than maxReplayBodySize, it can not be replayed
+	current  *replayReader
+}
+
+// replayReader is the body of one attempt, it is aborted when the next attempt starts
+type replayReader struct {
+	b       *replayBody
+	off     int
+	aborted int32
+}
+
+// attempt returns the body of a new attempt aborting the previous one
+func (b *replayBody) attempt() io.ReadCloser {
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	if b.current != nil {
+		atomic.StoreInt32(&b.current.aborted, 1)
+	}
+
+	b.current = &replayReader{b: b}
+	return b.current
+}
+
+// replayable returns false when the body was not completely buffered, a nil body is always replayable
+func (b *replayBody) replayable() bool {
+	if b == nil {
+		return true
+	}
+
+	b.m.Lock()
+	defer b.m.Unlock()
+	return !b.overflow
+}
+
+func (r *replayReader) Read(p []byte) (int, error) {
+	if atomic.LoadInt32(&r.aborted) == 1 {
+		return 0, errReplayAborted
+	}
+
+	if n, ok := r.readBuffered(p); ok {
+		return n, nil
+	}
+
+	b := r.b
+	b.rm.Lock()
+	defer b.rm.Unlock()
+
+	// other attempt could read the body while waiting
+	if n, ok := r.readBuffered(p); ok {
+		return n, nil
+	}
+
+	b.m.Lock()
+	off, read, rerr := r.off, b.read, b.err
+	b.m.Unlock()
+
+	if off != read {
+		// the part of the body not buffered was read by other attempt
+		return 0, errReplayAborted
+	}
+
+	if rerr != nil {
+		return 0, rerr
+	}
+
+	// the lock is not held while reading so the next attempt can start meanwhile
+	n, err := b.src.Read(p)
+
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	if !b.overflow {
+		if len(b.buf)+n > maxReplayBodySize {
+			b.overflow = true
+			b.buf = nil
+		} else {
+			b.buf = append(b.buf, p[:n]...)
+		}
+	}
+
+	r.off += n
+	b.read += n
+	b.err = err
+	return n, err
+}
+
+// readBuffered copies the buffered body not read yet by the attempt
+func (r *replayReader) readBuffered(p []byte) (int, bool) {
+	b := r.b
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	if r.off >= len(b.buf) {
+		return 0, false
+	}
+
+	n := copy(p, b.buf[r.off:])
+	r.off += n
+	return n, true
+}
+
+// Close does not close the client body since other attempt can read it
+func (r *replayReader) Close() error {
+	return nil
+}
@@ -0,0 +1,207 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/http2"
+
+	"github.com/cperez08/h2-proxy/cluster"
+	"github.com/cperez08/h2-proxy/config"
+	"github.com/cperez08/h2-proxy/conn"
+	"github.com/cperez08/h2-proxy/pool"
+	"github.com/cperez08/h2-proxy/router"
+)
+
+func TestRetry(t *testing.T) {
+	good := listenLocal(t)
+	defer good.Close()
+	go ServeListener(good, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		w.Write(b)
+	}))
+
+	var failures int64
+	bad := listenLocal(t)
+	defer bad.Close()
+	go ServeListener(bad, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&failures, 1)
+		ioutil.ReadAll(r.Body)
+		// trailers only response
+		w.Header().Set(grpcStatus, "14")
+	}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ccfg := &config.ClusterConfig{Name: "users", Endpoints: []*config.EndpointConfig{{Address: good.Addr().String()}, {Address: bad.Addr().String()}}}
+	ccfg.DNSConfig = &config.DNSConfig{BalancerAlg: "round_robin"}
+	ccfg.SetDefaults()
+	c, err := cluster.NewCluster(ctx, ccfg)
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+
+	rcfg := *cfg
+	rcfg.Routes = []*config.RouteConfig{{
+		Match:   &config.RouteMatch{Prefix: "/"},
+		Cluster: "users",
+		Retry:   &config.RetryPolicy{RetryOn: []string{"unavailable"}, MaxAttempts: 2},
+	}}
+	rcfg.Routes[0].SetDefaults()
+
+	rt, err := router.NewRouter(&rcfg, map[string]*cluster.Cluster{c.Name: c})
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+
+	proxyLis := listenLocal(t)
+	defer proxyLis.Close()
+	go ServeListener(proxyLis, Handler(&rcfg, rt))
+
+	cliTr := newTestTransport()
+	defer cliTr.CloseIdleConnections()
+	cli := &http.Client{Transport: cliTr, Timeout: time.Second}
+
+	// the retries land on the endpoint not tried and replay the body
+	for i := 0; i < 4; i++ {
+		body := fmt.Sprintf(`{"req": "%d"}`, i)
+		req, _ := http.NewRequest(http.MethodPost, "http://"+proxyLis.Addr().String()+"/echo", strings.NewReader(body))
+		rs, err := cli.Do(req)
+		if err != nil {
+			t.Log("error performing request", err)
+			t.FailNow()
+		}
+
+		b, _ := ioutil.ReadAll(rs.Body)
+		rs.Body.Close()
+		assert.Equal(t, http.StatusOK, rs.StatusCode)
+		assert.Equal(t, "", rs.Header.Get(grpcStatus))
+		assert.Equal(t, body, string(b))
+	}
+	assert.NotZero(t, atomic.LoadInt64(&failures))
+
+	// the failure is returned when the attempts are exhausted
+	rcfg.Routes[0].Retry.MaxAttempts = 1
+	failed := 0
+	for i := 0; i < 2; i++ {
+		req, _ := http.NewRequest(http.MethodPost, "http://"+proxyLis.Addr().String()+"/echo", strings.NewReader("{}"))
+		rs, err := cli.Do(req)
+		if err != nil {
+			t.Log("error performing request", err)
+			t.FailNow()
+		}
+		rs.Body.Close()
+
+		if rs.Header.Get(grpcStatus) == "14" {
+			failed++
+		}
+	}
+	assert.Equal(t, 1, failed)
+}
+
+func TestRetryHoldsBreaker(t *testing.T) {
+	var requests int64
+	target := listenLocal(t)
+	defer target.Close()
+	go ServeListener(target, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt64(&requests, 1) == 1 {
+			w.Header().Set(grpcStatus, "14")
+		}
+	}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ccfg := &config.ClusterConfig{Name: "users", Endpoints: []*config.EndpointConfig{{Address: target.Addr().String()}}}
+	ccfg.CircuitBreakers = &config.CircuitBreakersConfig{MaxRetries: 1}
+	ccfg.SetDefaults()
+	c, err := cluster.NewCluster(ctx, ccfg)
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+
+	p := &config.RetryPolicy{RetryOn: []string{"unavailable"}, MaxAttempts: 2, BaseInterval: 1, MaxInterval: 10}
+	req, _ := http.NewRequest(http.MethodGet, "http://"+target.Addr().String()+"/", nil)
+	rs, stream, err := do(c, p, req, nil, &conn.Stream{})
+	if err != nil {
+		t.Log("error performing request", err)
+		t.FailNow()
+	}
+	rs.Body.Close()
+	assert.Equal(t, int64(2), atomic.LoadInt64(&requests))
+
+	// the retry is active until the stream of the retried attempt is done
+	assert.False(t, c.Breaker.AcquireRetry())
+	stream.Done()
+	assert.True(t, c.Breaker.AcquireRetry())
+	c.Breaker.ReleaseRetry()
+}
+
+func TestReplayBody(t *testing.T) {
+	b := &replayBody{src: ioutil.NopCloser(strings.NewReader("hello"))}
+	first := b.attempt()
+	buf := make([]byte, 2)
+	n, err := first.Read(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "he", string(buf[:n]))
+
+	// the next attempt reads the body from the beginning and the previous one is aborted
+	second := b.attempt()
+	_, err = first.Read(buf)
+	assert.Equal(t, errReplayAborted, err)
+
+	all, err := ioutil.ReadAll(second)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(all))
+	assert.True(t, b.replayable())
+
+	all, _ = ioutil.ReadAll(b.attempt())
+	assert.Equal(t, "hello", string(all))
+
+	b = &replayBody{src: ioutil.NopCloser(bytes.NewReader(make([]byte, maxReplayBodySize+1)))}
+	all, err = ioutil.ReadAll(b.attempt())
+	assert.NoError(t, err)
+	assert.Len(t, all, maxReplayBodySize+1)
+	assert.False(t, b.replayable())
+
+	var nb *replayBody
+	assert.True(t, nb.replayable())
+}
+
+func TestRetryConditions(t *testing.T) {
+	assert.Equal(t, retryRefusedStream, errorCondition(http2.StreamError{Code: http2.ErrCodeRefusedStream}))
+	assert.Equal(t, "", errorCondition(http2.StreamError{Code: http2.ErrCodeCancel}))
+	assert.Equal(t, retryGoAway, errorCondition(fmt.Errorf("post: %w", http2.GoAwayError{})))
+	assert.Equal(t, retryGoAway, errorCondition(errors.New("http2: Transport received Server's graceful shutdown GOAWAY")))
+	assert.Equal(t, retryConnectFailure, errorCondition(fmt.Errorf("post: %w", pool.ErrNoConnections)))
+	assert.Equal(t, retryConnectFailure, errorCondition(&net.OpError{Op: "dial", Err: errors.New("refused")}))
+	assert.Equal(t, "", errorCondition(errors.New("http2: client connection lost")))
+
+	rs := &http.Response{StatusCode: http.StatusServiceUnavailable, Header: make(http.Header)}
+	assert.Equal(t, retry503, responseCondition(rs))
+
+	rs = &http.Response{StatusCode: http.StatusOK, Header: http.Header{"Grpc-Status": {"8"}}}
+	assert.Equal(t, "resource_exhausted", responseCondition(rs))
+
+	rs = &http.Response{StatusCode: http.StatusOK, Header: http.Header{"Grpc-Status": {"5"}}}
+	assert.Equal(t, "", responseCondition(rs))
+
+	p := &config.RetryPolicy{RetryOn: []string{retry503}}
+	assert.True(t, retryOn(p, retry503))
+	assert.False(t, retryOn(p, ""))
+	assert.False(t, retryOn(p, retryGoAway))
+}
@@ -0,0 +1,98 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cperez08/h2-proxy/config"
+)
+
+const grpcTimeout = "grpc-timeout"
+
+// grpcTimeoutUnits are the units of the grpc-timeout header, from the smallest to the largest
+// https://github.com/grpc/grpc/blob/master/doc/PROTOCOL-HTTP2.md
+var grpcTimeoutUnits = []struct {
+	unit byte
+	d    time.Duration
+}{
+	{'n', time.Nanosecond},
+	{'u', time.Microsecond},
+	{'m', time.Millisecond},
+	{'S', time.Second},
+	{'M', time.Minute},
+	{'H', time.Hour},
+}
+
+// requestTimeout returns the deadline of the request, the grpc-timeout header capped by the
+// route max_grpc_timeout or the route timeout when the header is not present, false when there is none
+func requestTimeout(r *http.Request, rc *config.RouteConfig) (time.Duration, bool) {
+	if d, ok := parseGRPCTimeout(r.Header.Get(grpcTimeout)); ok {
+		if max := time.Duration(rc.MaxGRPCTimeout) * time.Millisecond; max > 0 && d > max {
+			d = max
+		}
+		return d, true
+	}
+
+	if rc.Timeout > 0 {
+		return time.Duration(rc.Timeout) * time.Millisecond, true
+	}
+
+	return 0, false
+}
+
+// deadlineExceeded returns true when the request deadline expired
+func deadlineExceeded(r *http.Request) bool {
+	return errors.Is(r.Context().Err(), context.DeadlineExceeded)
+}
+
+func isGRPC(r *http.Request) bool {
+	return strings.Contains(r.Header.Get(contentType), "grpc")
+}
+
+// parseGRPCTimeout parses the header value, 1 to 8 ASCII digits followed by the unit,
+// the timeouts too large for a time.Duration are capped
+func parseGRPCTimeout(v string) (time.Duration, bool) {
+	if len(v) < 2 || len(v) > 9 {
+		return 0, false
+	}
+
+	var n int64
+	for _, c := range []byte(v[:len(v)-1]) {
+		if c < '0' || c > '9' {
+			return 0, false
+		}
+		n = n*10 + int64(c-'0')
+	}
+
+	for _, u := range grpcTimeoutUnits {
+		if u.unit == v[len(v)-1] {
+			if n > math.MaxInt64/int64(u.d) {
+				return math.MaxInt64, true
+			}
+			return time.Duration(n) * u.d, true
+		}
+	}
+
+	return 0, false
+}
+
+// encodeGRPCTimeout encodes the timeout with the smallest unit fitting in 8 digits,
+// it is rounded up so a remaining timeout is never sent as 0
+func encodeGRPCTimeout(d time.Duration) string {
+	if d <= 0 {
+		return "0n"
+	}
+
+	for _, u := range grpcTimeoutUnits {
+		if n := (d + u.d - 1) / u.d; n < 1e8 {
+			return strconv.FormatInt(int64(n), 10) + string(u.unit)
+		}
+	}
+
+	return "99999999H"
+}
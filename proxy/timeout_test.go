@@ -0,0 +1,157 @@
+package proxy
+
+import (
+	"io/ioutil"
+	"math"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/cperez08/h2-proxy/cluster"
+	"github.com/cperez08/h2-proxy/config"
+	"github.com/cperez08/h2-proxy/router"
+)
+
+func TestDeadlineExceeded(t *testing.T) {
+	canceled := make(chan string, 3)
+	target := listenLocal(t)
+	defer target.Close()
+	go ServeListener(target, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/stream" {
+			w.Header().Set(contentType, "application/grpc")
+			w.WriteHeader(http.StatusOK)
+			w.(http.Flusher).Flush()
+		}
+
+		select {
+		case <-r.Context().Done():
+			canceled <- r.Header.Get(grpcTimeout)
+		case <-time.After(5 * time.Second):
+		}
+	}))
+
+	tr := newTestTransport()
+	defer tr.CloseIdleConnections()
+	clusters := map[string]*cluster.Cluster{
+		"users": {Name: "users", Authority: target.Addr().String(), Scheme: "http", Client: &http.Client{Transport: tr}},
+	}
+
+	tcfg := *cfg
+	tcfg.Routes = []*config.RouteConfig{{Match: &config.RouteMatch{Prefix: "/"}, Cluster: "users", Timeout: 50, MaxGRPCTimeout: 100}}
+	rt, err := router.NewRouter(&tcfg, clusters)
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+
+	proxyLis := listenLocal(t)
+	defer proxyLis.Close()
+	go ServeListener(proxyLis, Handler(&tcfg, rt))
+
+	cliTr := newTestTransport()
+	defer cliTr.CloseIdleConnections()
+	cli := &http.Client{Transport: cliTr, Timeout: 2 * time.Second}
+
+	send := func(path string, grpc bool) *http.Response {
+		req, _ := http.NewRequest(http.MethodPost, "http://"+proxyLis.Addr().String()+path, nil)
+		if grpc {
+			req.Header.Set(contentType, "application/grpc")
+			// capped by the route max grpc timeout
+			req.Header.Set(grpcTimeout, "10S")
+		}
+
+		start := time.Now()
+		rs, err := cli.Do(req)
+		if err != nil {
+			t.Log("error performing request", err)
+			t.FailNow()
+		}
+		ioutil.ReadAll(rs.Body)
+		rs.Body.Close()
+		assert.Less(t, int64(time.Since(start)), int64(time.Second))
+
+		select {
+		case v := <-canceled:
+			if grpc {
+				d, ok := parseGRPCTimeout(v)
+				assert.True(t, ok)
+				assert.True(t, d > 0 && d <= 100*time.Millisecond, v)
+			}
+		case <-time.After(time.Second):
+			t.Log("target stream not canceled")
+			t.Fail()
+		}
+
+		return rs
+	}
+
+	rs := send("/wait", false)
+	assert.Equal(t, http.StatusGatewayTimeout, rs.StatusCode)
+
+	rs = send("/wait", true)
+	assert.Equal(t, "4", rs.Header.Get(grpcStatus))
+
+	// the headers were already sent, the status is in the trailers
+	rs = send("/stream", true)
+	assert.Equal(t, http.StatusOK, rs.StatusCode)
+	assert.Equal(t, "4", rs.Trailer.Get(grpcStatus))
+}
+
+func TestRequestTimeout(t *testing.T) {
+	r, _ := http.NewRequest(http.MethodPost, "http://localhost/", nil)
+	rc := &config.RouteConfig{}
+	_, ok := requestTimeout(r, rc)
+	assert.False(t, ok)
+
+	rc.Timeout = 200
+	d, ok := requestTimeout(r, rc)
+	assert.True(t, ok)
+	assert.Equal(t, 200*time.Millisecond, d)
+
+	// the header replaces the route timeout
+	r.Header.Set(grpcTimeout, "2S")
+	d, _ = requestTimeout(r, rc)
+	assert.Equal(t, 2*time.Second, d)
+
+	rc.MaxGRPCTimeout = 500
+	d, _ = requestTimeout(r, rc)
+	assert.Equal(t, 500*time.Millisecond, d)
+
+	r.Header.Set(grpcTimeout, "invalid")
+	d, _ = requestTimeout(r, rc)
+	assert.Equal(t, 200*time.Millisecond, d)
+}
+
+func TestGRPCTimeout(t *testing.T) {
+	valid := map[string]time.Duration{
+		"1H":        time.Hour,
+		"5M":        5 * time.Minute,
+		"30S":       30 * time.Second,
+		"250m":      250 * time.Millisecond,
+		"10u":       10 * time.Microsecond,
+		"99999999n": 99999999 * time.Nanosecond,
+	}
+	for v, expected := range valid {
+		d, ok := parseGRPCTimeout(v)
+		assert.True(t, ok, v)
+		assert.Equal(t, expected, d, v)
+	}
+
+	// too large for a time.Duration
+	d, ok := parseGRPCTimeout("99999999H")
+	assert.True(t, ok)
+	assert.Equal(t, time.Duration(math.MaxInt64), d)
+
+	for _, v := range []string{"", "S", "10", "10s", "-1S", "+1S", " 1S", "1_0S", "123456789S"} {
+		_, ok := parseGRPCTimeout(v)
+		assert.False(t, ok, v)
+	}
+
+	assert.Equal(t, "99999999n", encodeGRPCTimeout(99999999*time.Nanosecond))
+	assert.Equal(t, "250000u", encodeGRPCTimeout(250*time.Millisecond))
+	assert.Equal(t, "1500001u", encodeGRPCTimeout(1500*time.Millisecond+time.Nanosecond))
+	assert.Equal(t, "0n", encodeGRPCTimeout(-time.Second))
+	assert.Equal(t, "7200000m", encodeGRPCTimeout(2*time.Hour))
+}
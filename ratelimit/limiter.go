@@ -0,0 +1,138 @@
+package ratelimit
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/cperez08/h2-proxy/certs"
+	"github.com/cperez08/h2-proxy/config"
+)
+
+const (
+	// sweepInterval is the time between the removals of the buckets not used
+	sweepInterval = time.Minute
+	// maxBuckets bounds the buckets between sweeps, the keys come from the requests
+	// (e.g. a client rotating header values) and the ones beyond it share overflowKey
+	maxBuckets  = 10000
+	overflowKey = "\x01"
+)
+
+// Limiter limits the requests per second with token buckets, the requests take a token of the
+// bucket of their client and gRPC method when the limit is per client or per method.
+// A nil limiter has no limits
+type Limiter struct {
+	cfg *config.RateLimitConfig
+
+	m         sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+// bucket is refilled at the requests per second rate up to the burst
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// New returns a new rate limiter, nil when cfg is nil
+func New(cfg *config.RateLimitConfig) *Limiter {
+	if cfg == nil {
+		return nil
+	}
+
+	return &Limiter{cfg: cfg, buckets: make(map[string]*bucket), lastSweep: time.Now()}
+}
+
+// Allow takes a token for the request, when there is none false is returned
+// with the time until the next token
+func (l *Limiter) Allow(r *http.Request) (time.Duration, bool) {
+	if l == nil {
+		return 0, true
+	}
+
+	return l.take(l.key(r), time.Now())
+}
+
+func (l *Limiter) take(key string, now time.Time) (time.Duration, bool) {
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	if now.Sub(l.lastSweep) >= sweepInterval {
+		l.sweep(now)
+	}
+
+	burst := float64(l.cfg.Burst)
+	b, ok := l.buckets[key]
+	if !ok && len(l.buckets) >= maxBuckets {
+		b, ok = l.buckets[overflowKey]
+		key = overflowKey
+	}
+
+	if !ok {
+		b = &bucket{tokens: burst, last: now}
+		l.buckets[key] = b
+	} else if now.After(b.last) {
+		b.tokens += now.Sub(b.last).Seconds() * l.cfg.RequestsPerSecond
+		if b.tokens > burst {
+			b.tokens = burst
+		}
+		b.last = now
+	}
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0, true
+	}
+
+	return time.Duration((1 - b.tokens) / l.cfg.RequestsPerSecond * float64(time.Second)), false
+}
+
+// sweep removes the buckets full again since they are the same as new ones, l.m must be held
+func (l *Limiter) sweep(now time.Time) {
+	refill := time.Duration(float64(l.cfg.Burst) / l.cfg.RequestsPerSecond * float64(time.Second))
+	for k, b := range l.buckets {
+		if now.Sub(b.last) >= refill {
+			delete(l.buckets, k)
+		}
+	}
+
+	l.lastSweep = now
+}
+
+// key returns the bucket of the request, the requests without the client key share the same bucket
+func (l *Limiter) key(r *http.Request) string {
+	var key string
+	if ck := l.cfg.ClientKey; ck != nil {
+		key = requestValue(r, ck.Header, false, ck.ClientIP, ck.Identity)
+	}
+
+	if l.cfg.PerMethod {
+		key += "\x00" + r.URL.Path
+	}
+
+	return key
+}
+
+// requestValue returns the header, path, client IP or verified identity of the request,
+// empty when the request does not have it
+func requestValue(r *http.Request, header string, path, clientIP, identity bool) string {
+	switch {
+	case header != "":
+		return r.Header.Get(header)
+	case path:
+		return r.URL.Path
+	case clientIP:
+		if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+			return host
+		}
+		return r.RemoteAddr
+	case identity:
+		if id := certs.PeerIdentity(r.TLS); id != nil {
+			return id.ID()
+		}
+	}
+
+	return ""
+}
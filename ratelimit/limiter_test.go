@@ -0,0 +1,80 @@
+package ratelimit
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/cperez08/h2-proxy/config"
+)
+
+func TestTake(t *testing.T) {
+	l := New(&config.RateLimitConfig{RequestsPerSecond: 2, Burst: 2})
+	now := time.Now()
+
+	for i := 0; i < 2; i++ {
+		_, ok := l.take("a", now)
+		assert.True(t, ok)
+	}
+
+	wait, ok := l.take("a", now)
+	assert.False(t, ok)
+	assert.Equal(t, 500*time.Millisecond, wait)
+
+	// every client key has its own bucket
+	_, ok = l.take("b", now)
+	assert.True(t, ok)
+
+	// the bucket is refilled at the requests per second rate
+	_, ok = l.take("a", now.Add(250*time.Millisecond))
+	assert.False(t, ok)
+	_, ok = l.take("a", now.Add(500*time.Millisecond))
+	assert.True(t, ok)
+
+	// the buckets not used are removed
+	_, ok = l.take("b", now.Add(sweepInterval+time.Second))
+	assert.True(t, ok)
+	assert.Len(t, l.buckets, 1)
+
+	// the keys beyond the max buckets share the same bucket
+	for i := len(l.buckets); i < maxBuckets; i++ {
+		l.take(strconv.Itoa(i), now)
+	}
+	for i := 0; i < 2; i++ {
+		_, ok = l.take("c"+strconv.Itoa(i), now)
+		assert.True(t, ok)
+	}
+	_, ok = l.take("d", now)
+	assert.False(t, ok)
+	assert.Len(t, l.buckets, maxBuckets+1)
+
+	var nl *Limiter
+	_, ok = nl.Allow(&http.Request{})
+	assert.True(t, ok)
+}
+
+func TestKey(t *testing.T) {
+	r, _ := http.NewRequest(http.MethodPost, "http://localhost/user.UserService/GetUser", nil)
+	r.RemoteAddr = "10.0.0.1:5000"
+	r.Header.Set("x-caller", "orders")
+
+	cfg := &config.RateLimitConfig{RequestsPerSecond: 1, Burst: 1}
+	assert.Equal(t, "", New(cfg).key(r))
+
+	cfg.PerMethod = true
+	assert.Equal(t, "\x00/user.UserService/GetUser", New(cfg).key(r))
+
+	cfg.PerMethod = false
+	cfg.ClientKey = &config.ClientKey{Header: "x-caller"}
+	assert.Equal(t, "orders", New(cfg).key(r))
+
+	cfg.ClientKey = &config.ClientKey{ClientIP: true}
+	assert.Equal(t, "10.0.0.1", New(cfg).key(r))
+
+	// requests without a verified client certificate share the bucket
+	cfg.ClientKey = &config.ClientKey{Identity: true}
+	assert.Equal(t, "", New(cfg).key(r))
+}
@@ -0,0 +1,243 @@
+package ratelimit
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cperez08/h2-proxy/cluster"
+	"github.com/cperez08/h2-proxy/config"
+	"github.com/cperez08/h2-proxy/grpcwire"
+)
+
+const (
+	shouldRateLimitPath = "/envoy.service.ratelimit.v3.RateLimitService/ShouldRateLimit"
+	// overLimitCode is RateLimitResponse.Code OVER_LIMIT
+	overLimitCode = 2
+)
+
+// Service asks a rate limit service speaking the Envoy ratelimit gRPC protocol whether the
+// requests are over the limit, the limits are shared by all the proxy replicas. The over
+// limit answers are cached until the limit is reset. A nil service has no limits
+type Service struct {
+	cfg *config.GlobalRateLimitConfig
+	c   *cluster.Cluster
+
+	m         sync.Mutex
+	cache     map[string]time.Time // over limit descriptors and when they are allowed again
+	lastSweep time.Time
+}
+
+// Entry is a key and value of a descriptor
+type Entry struct {
+	Key   string
+	Value string
+}
+
+// Descriptor is the list of entries the rate limit service matches against its limits
+type Descriptor []Entry
+
+// NewService returns a new rate limit service client, nil when cfg is nil
+func NewService(cfg *config.GlobalRateLimitConfig, c *cluster.Cluster) *Service {
+	if cfg == nil {
+		return nil
+	}
+
+	return &Service{cfg: cfg, c: c, cache: make(map[string]time.Time), lastSweep: time.Now()}
+}
+
+// Descriptors returns the descriptors of the request, the descriptors with an entry
+// without value in the request are skipped
+func Descriptors(r *http.Request, cfgs []*config.RateLimitDescriptor) []Descriptor {
+	var ds []Descriptor
+next:
+	for _, dc := range cfgs {
+		d := make(Descriptor, 0, len(dc.Entries))
+		for _, e := range dc.Entries {
+			v := e.Value
+			if v == "" {
+				v = requestValue(r, e.Header, e.Path, e.ClientIP, e.Identity)
+			}
+
+			if v == "" {
+				continue next
+			}
+			d = append(d, Entry{Key: e.Key, Value: v})
+		}
+		ds = append(ds, d)
+	}
+
+	return ds
+}
+
+// Allow asks the rate limit service for the descriptors, when they are over the limit false is
+// returned with the time until the limit is reset. When the service fails the request is
+// allowed unless the failure mode is deny, the error is returned to be logged
+func (s *Service) Allow(ctx context.Context, ds []Descriptor) (time.Duration, bool, error) {
+	if s == nil || len(ds) == 0 {
+		return 0, true, nil
+	}
+
+	key := cacheKey(ds)
+	now := time.Now()
+	if wait, ok := s.cached(key, now); ok {
+		return wait, false, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(s.cfg.Timeout)*time.Millisecond)
+	defer cancel()
+
+	overLimit, reset, err := s.shouldRateLimit(ctx, ds)
+	if err != nil {
+		if s.cfg.FailureMode == "deny" {
+			return time.Second, false, err
+		}
+		return 0, true, err
+	}
+
+	if !overLimit {
+		return 0, true, nil
+	}
+
+	ttl := reset
+	if ttl <= 0 {
+		ttl = time.Duration(s.cfg.CacheTTL) * time.Millisecond
+	}
+
+	if s.cfg.CacheTTL >= 0 && ttl > 0 {
+		s.m.Lock()
+		s.cache[key] = now.Add(ttl)
+		s.m.Unlock()
+	}
+
+	return reset, false, nil
+}
+
+// cached returns the time until the descriptors are allowed again when they are cached as over limit
+func (s *Service) cached(key string, now time.Time) (time.Duration, bool) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if now.Sub(s.lastSweep) >= sweepInterval {
+		for k, until := range s.cache {
+			if !now.Before(until) {
+				delete(s.cache, k)
+			}
+		}
+		s.lastSweep = now
+	}
+
+	until, ok := s.cache[key]
+	if !ok || !now.Before(until) {
+		return 0, false
+	}
+
+	return until.Sub(now), true
+}
+
+// shouldRateLimit calls RateLimitService/ShouldRateLimit returning if the descriptors are over the limit
+func (s *Service) shouldRateLimit(ctx context.Context, ds []Descriptor) (bool, time.Duration, error) {
+	msg, err := grpcwire.Invoke(ctx, s.c.Client.Transport, s.c.Scheme+"://"+s.c.Authority+shouldRateLimitPath, rateLimitRequest(s.cfg.Domain, ds))
+	if err != nil {
+		return false, 0, err
+	}
+
+	return rateLimitResponse(msg)
+}
+
+// cacheKey joins the descriptors, the separators cannot be part of the header values
+func cacheKey(ds []Descriptor) string {
+	var b strings.Builder
+	for _, d := range ds {
+		for _, e := range d {
+			b.WriteString(e.Key)
+			b.WriteByte(0)
+			b.WriteString(e.Value)
+			b.WriteByte(1)
+		}
+		b.WriteByte(2)
+	}
+
+	return b.String()
+}
+
+// rateLimitRequest encodes RateLimitRequest, domain is the field 1 and the descriptors the
+// field 2, every entry (field 1 of the descriptor) has the key as field 1 and the value as field 2
+func rateLimitRequest(domain string, ds []Descriptor) []byte {
+	b := grpcwire.AppendBytes(nil, 1, []byte(domain))
+	for _, d := range ds {
+		var db []byte
+		for _, e := range d {
+			eb := grpcwire.AppendBytes(nil, 1, []byte(e.Key))
+			eb = grpcwire.AppendBytes(eb, 2, []byte(e.Value))
+			db = grpcwire.AppendBytes(db, 1, eb)
+		}
+		b = grpcwire.AppendBytes(b, 2, db)
+	}
+
+	return b
+}
+
+// rateLimitResponse decodes the overall code (field 1) of RateLimitResponse, when it is OVER_LIMIT
+// the longest duration until reset (field 4) of the over limit statuses (field 2) is returned
+func rateLimitResponse(msg []byte) (bool, time.Duration, error) {
+	fields, err := grpcwire.Fields(msg)
+	if err != nil {
+		return false, 0, err
+	}
+
+	var overLimit bool
+	var reset time.Duration
+	for _, f := range fields {
+		switch {
+		case f.Num == 1 && f.Type == grpcwire.VarintType:
+			overLimit = f.Varint == overLimitCode
+		case f.Num == 2 && f.Type == grpcwire.BytesType:
+			status, err := grpcwire.Fields(f.Bytes)
+			if err != nil {
+				return false, 0, err
+			}
+
+			var code uint64
+			var d time.Duration
+			for _, sf := range status {
+				switch {
+				case sf.Num == 1 && sf.Type == grpcwire.VarintType:
+					code = sf.Varint
+				case sf.Num == 4 && sf.Type == grpcwire.BytesType:
+					if d, err = decodeDuration(sf.Bytes); err != nil {
+						return false, 0, err
+					}
+				}
+			}
+
+			if code == overLimitCode && d > reset {
+				reset = d
+			}
+		}
+	}
+
+	return overLimit, reset, nil
+}
+
+// decodeDuration decodes google.protobuf.Duration, seconds is the field 1 and nanos the field 2
+func decodeDuration(msg []byte) (time.Duration, error) {
+	fields, err := grpcwire.Fields(msg)
+	if err != nil {
+		return 0, err
+	}
+
+	var d time.Duration
+	for _, f := range fields {
+		switch {
+		case f.Num == 1 && f.Type == grpcwire.VarintType:
+			d += time.Duration(int64(f.Varint)) * time.Second
+		case f.Num == 2 && f.Type == grpcwire.VarintType:
+			d += time.Duration(int32(f.Varint))
+		}
+	}
+
+	return d, nil
+}
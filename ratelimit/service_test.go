@@ -0,0 +1,161 @@
+package ratelimit
+
+import (
+	"context"
+	"crypto/tls"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/http2"
+
+	"github.com/cperez08/h2-proxy/cluster"
+	"github.com/cperez08/h2-proxy/config"
+	"github.com/cperez08/h2-proxy/grpcwire"
+)
+
+func TestServiceAllow(t *testing.T) {
+	var calls int32
+	lis := fakeServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		b, _ := ioutil.ReadAll(r.Body)
+		msg, _ := grpcwire.ReadFrame(b)
+
+		if r.URL.Path != shouldRateLimitPath {
+			w.Header().Set("grpc-status", "12")
+			return
+		}
+
+		// the orders client is over the limit for 3 seconds
+		var rs []byte
+		if string(msg) == string(rateLimitRequest("users", []Descriptor{{{Key: "client", Value: "orders"}}})) {
+			duration := grpcwire.AppendVarint([]byte{1 << 3}, 3)
+			status := grpcwire.AppendBytes(grpcwire.AppendVarint([]byte{1 << 3}, overLimitCode), 4, duration)
+			rs = grpcwire.AppendBytes(grpcwire.AppendVarint([]byte{1 << 3}, overLimitCode), 2, status)
+		} else {
+			rs = grpcwire.AppendVarint([]byte{1 << 3}, 1)
+		}
+
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Trailer", "grpc-status")
+		w.Write(grpcwire.Frame(rs))
+		w.Header().Set("grpc-status", "0")
+	}))
+	defer lis.Close()
+
+	tr := getTransport()
+	defer tr.CloseIdleConnections()
+	c := &cluster.Cluster{Name: "ratelimit", Authority: lis.Addr().String(), Scheme: "http", Client: &http.Client{Transport: tr}}
+	cfg := &config.GlobalRateLimitConfig{Cluster: "ratelimit", Domain: "users", Timeout: 1000, FailureMode: "allow", CacheTTL: 1000}
+	s := NewService(cfg, c)
+
+	_, ok, _ := s.Allow(context.Background(), []Descriptor{{{Key: "client", Value: "billing"}}})
+	assert.True(t, ok)
+
+	wait, ok, _ := s.Allow(context.Background(), []Descriptor{{{Key: "client", Value: "orders"}}})
+	assert.False(t, ok)
+	assert.Equal(t, 3*time.Second, wait)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&calls))
+
+	// the over limit answer is cached until the reset
+	wait, ok, _ = s.Allow(context.Background(), []Descriptor{{{Key: "client", Value: "orders"}}})
+	assert.False(t, ok)
+	assert.True(t, wait > 0 && wait <= 3*time.Second)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&calls))
+
+	// requests without descriptors are not sent
+	_, ok, _ = s.Allow(context.Background(), nil)
+	assert.True(t, ok)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&calls))
+
+	// the failures allow the requests unless the failure mode is deny
+	lis.Close()
+	tr.CloseIdleConnections()
+	_, ok, err := s.Allow(context.Background(), []Descriptor{{{Key: "client", Value: "billing"}}})
+	assert.True(t, ok)
+	assert.Error(t, err)
+
+	cfg.FailureMode = "deny"
+	_, ok, err = s.Allow(context.Background(), []Descriptor{{{Key: "client", Value: "billing"}}})
+	assert.False(t, ok)
+	assert.Error(t, err)
+
+	var ns *Service
+	_, ok, _ = ns.Allow(context.Background(), []Descriptor{{{Key: "client", Value: "billing"}}})
+	assert.True(t, ok)
+}
+
+func TestDescriptors(t *testing.T) {
+	r, _ := http.NewRequest(http.MethodPost, "http://localhost/user.UserService/GetUser", nil)
+	r.RemoteAddr = "10.0.0.1:5000"
+	r.Header.Set("x-caller", "orders")
+
+	cfgs := []*config.RateLimitDescriptor{
+		{Entries: []*config.DescriptorEntry{{Key: "service", Value: "users"}, {Key: "method", Path: true}}},
+		{Entries: []*config.DescriptorEntry{{Key: "client", Header: "x-caller"}, {Key: "ip", ClientIP: true}}},
+		// skipped, the request has no verified identity
+		{Entries: []*config.DescriptorEntry{{Key: "identity", Identity: true}}},
+	}
+
+	assert.Equal(t, []Descriptor{
+		{{Key: "service", Value: "users"}, {Key: "method", Value: "/user.UserService/GetUser"}},
+		{{Key: "client", Value: "orders"}, {Key: "ip", Value: "10.0.0.1"}},
+	}, Descriptors(r, cfgs))
+}
+
+func TestRateLimitMessages(t *testing.T) {
+	assert.Equal(t, []byte{1<<3 | 2, 1, 'd', 2<<3 | 2, 8, 1<<3 | 2, 6, 1<<3 | 2, 1, 'k', 2<<3 | 2, 1, 'v'},
+		rateLimitRequest("d", []Descriptor{{{Key: "k", Value: "v"}}}))
+
+	overLimit, _, err := rateLimitResponse([]byte{1 << 3, 1})
+	assert.NoError(t, err)
+	assert.False(t, overLimit)
+
+	// the longest reset of the over limit statuses, the fixed size fields are skipped
+	ok := grpcwire.AppendBytes(grpcwire.AppendVarint([]byte{1 << 3}, 1), 4, []byte{1 << 3, 9})
+	over := grpcwire.AppendBytes(grpcwire.AppendVarint([]byte{1 << 3}, overLimitCode), 4, grpcwire.AppendVarint([]byte{1 << 3, 1, 2 << 3}, uint64(500*time.Millisecond)))
+	msg := grpcwire.AppendBytes(grpcwire.AppendBytes([]byte{1 << 3, overLimitCode}, 2, ok), 2, over)
+	msg = append(msg, 5<<3|5, 0, 0, 0, 0)
+	overLimit, reset, err := rateLimitResponse(msg)
+	assert.NoError(t, err)
+	assert.True(t, overLimit)
+	assert.Equal(t, 1500*time.Millisecond, reset)
+}
+
+func fakeServer(t *testing.T, h http.Handler) net.Listener {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+
+	go func() {
+		server := http2.Server{}
+		for {
+			c, err := lis.Accept()
+			if err != nil {
+				log.Println("error accepting new connection ", err)
+				return
+			}
+
+			go server.ServeConn(c, &http2.ServeConnOpts{Handler: h, BaseConfig: &http.Server{}})
+		}
+	}()
+
+	return lis
+}
+
+func getTransport() *http2.Transport {
+	return &http2.Transport{
+		DisableCompression: true,
+		AllowHTTP:          true,
+		DialTLS: func(netw, addr string, cfg *tls.Config) (net.Conn, error) {
+			return net.Dial(netw, addr)
+		},
+	}
+}
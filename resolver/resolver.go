@@ -1,17 +1,33 @@
 package resolver
 
 import (
+	"fmt"
+	"log"
+	"net"
+	"reflect"
+	"sort"
+	"sync"
 	"time"
 
 	rsv "github.com/cperez08/dm-resolver/pkg/resolver"
+
+	"github.com/cperez08/h2-proxy/conn"
 )
 
+// lookupSRV is replaced in the tests
+var lookupSRV = net.LookupSRV
+
 // Resolver ...
 type Resolver struct {
 	r           *rsv.DomainResolver
 	C           chan bool
 	refreshRate time.Duration
 	needRefresh bool
+
+	// SRV resolution, the weight of the records is kept
+	m         sync.Mutex
+	endpoints []conn.Endpoint
+	done      chan struct{}
 }
 
 // NewResolver creates a new resolver instance
@@ -36,7 +52,98 @@ func (r *Resolver) GetCurrentIPs() []string {
 	return r.r.Addresses
 }
 
-// CloseResolver closes the resolver
+// ResolveSRV resolves the SRV records of name returning the targets of the lowest
+// priority with their weights, the records are watched when the refresh is needed
+func (r *Resolver) ResolveSRV(name string) []conn.Endpoint {
+	endpoints, err := resolveSRV(name)
+	if err != nil {
+		log.Println("error resolving SRV records ", err)
+	}
+
+	r.m.Lock()
+	r.endpoints = endpoints
+	r.m.Unlock()
+
+	if r.needRefresh {
+		r.done = make(chan struct{})
+		go r.watchSRV(name)
+	}
+
+	return endpoints
+}
+
+// GetCurrentEndpoints return the current endpoints resolved from the SRV records
+func (r *Resolver) GetCurrentEndpoints() []conn.Endpoint {
+	r.m.Lock()
+	defer r.m.Unlock()
+	return r.endpoints
+}
+
+// CloseResolver closes the resolver, the SRV records are only watched when the refresh is needed
 func (r *Resolver) CloseResolver() {
-	r.r.Close()
+	if r.done != nil {
+		close(r.done)
+		return
+	}
+
+	if r.r != nil {
+		r.r.Close()
+	}
+}
+
+// watchSRV notifies in C the changes in the SRV records, errors and
+// empty answers are ignored to keep the previous endpoints
+func (r *Resolver) watchSRV(name string) {
+	t := time.NewTicker(time.Second * r.refreshRate)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-r.done:
+			return
+		case <-t.C:
+			endpoints, err := resolveSRV(name)
+			if err != nil || len(endpoints) == 0 {
+				continue
+			}
+
+			r.m.Lock()
+			changed := !reflect.DeepEqual(endpoints, r.endpoints)
+			r.endpoints = endpoints
+			r.m.Unlock()
+
+			if !changed {
+				continue
+			}
+
+			select {
+			case r.C <- true:
+			case <-r.done:
+				return
+			}
+		}
+	}
+}
+
+func resolveSRV(name string) ([]conn.Endpoint, error) {
+	_, records, err := lookupSRV("", "", name)
+	if err != nil {
+		return nil, fmt.Errorf("[h2-proxy]: %w", err)
+	}
+
+	var endpoints []conn.Endpoint
+	for _, rec := range records {
+		// only the lowest priority records are used, the rest are backups
+		if rec.Priority != records[0].Priority {
+			continue
+		}
+
+		endpoints = append(endpoints, conn.Endpoint{
+			Address: net.JoinHostPort(rec.Target, fmt.Sprint(rec.Port)),
+			Weight:  int(rec.Weight),
+		})
+	}
+
+	sort.Slice(endpoints, func(i, j int) bool { return endpoints[i].Address < endpoints[j].Address })
+	return endpoints, nil
 }
@@ -1,9 +1,15 @@
 package resolver
 
 import (
+	"errors"
+	"net"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+
+	"github.com/cperez08/h2-proxy/conn"
 )
 
 func TestResolve(t *testing.T) {
@@ -14,3 +20,48 @@ func TestResolve(t *testing.T) {
 	assert.NotEqual(t, 0, len(r.GetCurrentIPs()))
 	r.CloseResolver()
 }
+
+func TestResolveSRV(t *testing.T) {
+	defer func() { lookupSRV = net.LookupSRV }()
+
+	var m sync.Mutex
+	records := []*net.SRV{
+		{Target: "b.users.svc.", Port: 50051, Priority: 10, Weight: 1},
+		{Target: "a.users.svc.", Port: 50051, Priority: 10, Weight: 3},
+		{Target: "backup.users.svc.", Port: 50051, Priority: 20, Weight: 1},
+	}
+	lookupSRV = func(service, proto, name string) (string, []*net.SRV, error) {
+		m.Lock()
+		defer m.Unlock()
+		return name, records, nil
+	}
+
+	r := NewResolver(1, true)
+	endpoints := r.ResolveSRV("_grpc._tcp.users.svc")
+	assert.Equal(t, []conn.Endpoint{
+		{Address: "a.users.svc.:50051", Weight: 3},
+		{Address: "b.users.svc.:50051", Weight: 1},
+	}, endpoints)
+
+	m.Lock()
+	records = []*net.SRV{{Target: "a.users.svc.", Port: 50051, Priority: 10, Weight: 2}}
+	m.Unlock()
+
+	select {
+	case <-r.C:
+		assert.Equal(t, []conn.Endpoint{{Address: "a.users.svc.:50051", Weight: 2}}, r.GetCurrentEndpoints())
+	case <-time.After(3 * time.Second):
+		t.Log("expecting change notification")
+		t.Fail()
+	}
+
+	r.CloseResolver()
+
+	lookupSRV = func(service, proto, name string) (string, []*net.SRV, error) {
+		return "", nil, errors.New("no such host")
+	}
+	r = NewResolver(1, false)
+	assert.Empty(t, r.ResolveSRV("_grpc._tcp.users.svc"))
+	// nothing is watched without refresh
+	r.CloseResolver()
+}
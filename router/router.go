@@ -0,0 +1,289 @@
+package router
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/cperez08/h2-proxy/cluster"
+	"github.com/cperez08/h2-proxy/config"
+	"github.com/cperez08/h2-proxy/lb"
+	"github.com/cperez08/h2-proxy/ratelimit"
+)
+
+// Route is a compiled route pointing to one or more weighted upstream clusters
+type Route struct {
+	Config      *config.RouteConfig
+	VirtualHost *VirtualHost
+	clusters    []weightedCluster
+	totalWeight int
+	mirror      *cluster.Cluster
+	limiter     *ratelimit.Limiter
+	global      *ratelimit.Service
+	match       func(path string) bool
+}
+
+// weightedCluster keeps the cumulative weight of the clusters up to this one
+type weightedCluster struct {
+	cluster    *cluster.Cluster
+	cumulative int
+}
+
+// VirtualHost is a route table selected by the request :authority
+type VirtualHost struct {
+	Name         string
+	PreserveHost bool // the client :authority is sent to the target
+	routes       []*Route
+}
+
+// suffixHost is a virtual host matched by a wildcard domain
+type suffixHost struct {
+	suffix string
+	vh     *VirtualHost
+}
+
+// Router picks the virtual host by :authority and then
+// the route evaluating the virtual host routes in order
+type Router struct {
+	exact       map[string]*VirtualHost
+	suffixes    []suffixHost // sorted by suffix length, longest first
+	wildcard    *VirtualHost // virtual host with the * domain
+	defaultHost *VirtualHost // top level routes, used when no virtual host matches
+}
+
+// NewRouter compiles the virtual hosts and routes defined in the configuration,
+// every route must reference one of the clusters
+func NewRouter(cfg *config.ProxyConfig, clusters map[string]*cluster.Cluster) (*Router, error) {
+	var global *ratelimit.Service
+	if g := cfg.GlobalRateLimit; g != nil {
+		c, ok := clusters[g.Cluster]
+		if !ok {
+			return nil, fmt.Errorf("[h2-proxy]: unknown global rate limit cluster %s", g.Cluster)
+		}
+		global = ratelimit.NewService(g, c)
+	}
+
+	rt := &Router{exact: make(map[string]*VirtualHost)}
+	for _, vhc := range cfg.VirtualHosts {
+		vh, err := newVirtualHost(vhc.Name, vhc.PreserveHost, vhc.Routes, clusters, global)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, d := range vhc.Domains {
+			d = strings.ToLower(d)
+			switch {
+			case d == "*":
+				rt.wildcard = vh
+			case strings.HasPrefix(d, "*."):
+				rt.suffixes = append(rt.suffixes, suffixHost{suffix: d[1:], vh: vh})
+			default:
+				rt.exact[d] = vh
+			}
+		}
+	}
+
+	sort.SliceStable(rt.suffixes, func(i, j int) bool {
+		return len(rt.suffixes[i].suffix) > len(rt.suffixes[j].suffix)
+	})
+
+	if len(cfg.Routes) > 0 {
+		vh, err := newVirtualHost("", false, cfg.Routes, clusters, global)
+		if err != nil {
+			return nil, err
+		}
+		rt.defaultHost = vh
+	}
+
+	return rt, nil
+}
+
+// Route returns the first route matching the request in its virtual host, nil if none matches
+func (rt *Router) Route(r *http.Request) *Route {
+	vh := rt.VirtualHost(r.Host)
+	if vh == nil {
+		return nil
+	}
+
+	for _, route := range vh.routes {
+		if route.match(r.URL.Path) {
+			return route
+		}
+	}
+
+	return nil
+}
+
+// VirtualHost returns the virtual host for the authority, exact domains are
+// checked first, then the longest wildcard suffix, then * and the top level routes
+func (rt *Router) VirtualHost(authority string) *VirtualHost {
+	host := strings.ToLower(authority)
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	if vh, ok := rt.exact[host]; ok {
+		return vh
+	}
+
+	for _, s := range rt.suffixes {
+		if strings.HasSuffix(host, s.suffix) && len(host) > len(s.suffix) {
+			return s.vh
+		}
+	}
+
+	if rt.wildcard != nil {
+		return rt.wildcard
+	}
+
+	return rt.defaultHost
+}
+
+func newVirtualHost(name string, preserveHost bool, routes []*config.RouteConfig, clusters map[string]*cluster.Cluster, global *ratelimit.Service) (*VirtualHost, error) {
+	vh := &VirtualHost{Name: name, PreserveHost: preserveHost}
+	for _, rc := range routes {
+		r, err := newRoute(rc, clusters, global)
+		if err != nil {
+			return nil, err
+		}
+		r.VirtualHost = vh
+		vh.routes = append(vh.routes, r)
+	}
+
+	return vh, nil
+}
+
+// PickCluster returns the cluster for the request, when the route splits the traffic
+// the cluster is picked by weight, randomly or sticky when the route has a hash policy
+func (r *Route) PickCluster(req *http.Request) *cluster.Cluster {
+	if len(r.clusters) == 1 {
+		return r.clusters[0].cluster
+	}
+
+	var n int
+	if h, ok := lb.RequestHash(req, r.Config.HashPolicy); ok {
+		n = int(h % uint64(r.totalWeight))
+	} else {
+		n = rand.Intn(r.totalWeight)
+	}
+
+	i := sort.Search(len(r.clusters), func(i int) bool { return r.clusters[i].cumulative > n })
+	return r.clusters[i].cluster
+}
+
+// MirrorCluster returns the shadow cluster when the request is sampled to be mirrored, nil otherwise
+func (r *Route) MirrorCluster() *cluster.Cluster {
+	if r.mirror == nil || rand.Float64()*100 >= r.Config.Mirror.Percentage {
+		return nil
+	}
+
+	return r.mirror
+}
+
+// Subset returns the subset of the cluster endpoints selected by the request headers,
+// nil when the route has no subset policy. The metadata is empty when the request has none
+// of the headers, in that case the fallback policy is applied
+func (r *Route) Subset(req *http.Request) *lb.Subset {
+	p := r.Config.Subset
+	if p == nil {
+		return nil
+	}
+
+	s := &lb.Subset{Metadata: make(map[string]string, len(p.Headers)), Fallback: lb.SubsetFallback(p.Fallback), Default: p.DefaultSubset}
+	for h, key := range p.Headers {
+		if v := req.Header.Get(h); v != "" {
+			s.Metadata[key] = v
+		}
+	}
+
+	return s
+}
+
+// AllowRequest takes a token of the route rate limit and then asks the global rate limit service
+// for the route descriptors, when the limit is reached false is returned with the time until
+// the request would be allowed. The errors of the global rate limit service are returned to be logged
+func (r *Route) AllowRequest(req *http.Request) (time.Duration, bool, error) {
+	if wait, ok := r.limiter.Allow(req); !ok {
+		return wait, false, nil
+	}
+
+	if len(r.Config.RateLimitDescriptors) == 0 {
+		return 0, true, nil
+	}
+
+	return r.global.Allow(req.Context(), ratelimit.Descriptors(req, r.Config.RateLimitDescriptors))
+}
+
+func newRoute(rc *config.RouteConfig, clusters map[string]*cluster.Cluster, global *ratelimit.Service) (*Route, error) {
+	weighted := rc.WeightedClusters
+	if rc.Cluster != "" {
+		weighted = []*config.WeightedCluster{{Name: rc.Cluster, Weight: 1}}
+	}
+
+	if len(weighted) == 0 {
+		return nil, errors.New("[h2-proxy]: route without cluster")
+	}
+
+	match, err := newMatcher(rc.Match)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(rc.RateLimitDescriptors) > 0 && global == nil {
+		return nil, errors.New("[h2-proxy]: route rate limit descriptors without global rate limit service")
+	}
+
+	r := &Route{Config: rc, match: match, limiter: ratelimit.New(rc.RateLimit), global: global}
+	for _, wc := range weighted {
+		c, ok := clusters[wc.Name]
+		if !ok {
+			return nil, fmt.Errorf("[h2-proxy]: unknown cluster %s", wc.Name)
+		}
+
+		if wc.Weight <= 0 {
+			return nil, fmt.Errorf("[h2-proxy]: invalid weight for cluster %s", wc.Name)
+		}
+
+		r.totalWeight += wc.Weight
+		r.clusters = append(r.clusters, weightedCluster{cluster: c, cumulative: r.totalWeight})
+	}
+
+	if rc.Mirror != nil {
+		c, ok := clusters[rc.Mirror.Cluster]
+		if !ok {
+			return nil, fmt.Errorf("[h2-proxy]: unknown mirror cluster %s", rc.Mirror.Cluster)
+		}
+		r.mirror = c
+	}
+
+	return r, nil
+}
+
+// newMatcher returns the function matching the :path, gRPC paths
+// have the format /package.Service/Method
+func newMatcher(m *config.RouteMatch) (func(string) bool, error) {
+	switch {
+	case m.Prefix != "":
+		return func(path string) bool { return strings.HasPrefix(path, m.Prefix) }, nil
+	case m.Service != "" && m.Method != "":
+		full := "/" + m.Service + "/" + m.Method
+		return func(path string) bool { return path == full }, nil
+	case m.Service != "":
+		prefix := "/" + m.Service + "/"
+		return func(path string) bool { return strings.HasPrefix(path, prefix) }, nil
+	case m.Regex != "":
+		re, err := regexp.Compile("^(?:" + m.Regex + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("[h2-proxy]: invalid route regex %w", err)
+		}
+		return re.MatchString, nil
+	default:
+		return nil, errors.New("[h2-proxy]: route without matcher")
+	}
+}
@@ -0,0 +1,286 @@
+package router
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/cperez08/h2-proxy/cluster"
+	"github.com/cperez08/h2-proxy/config"
+	"github.com/cperez08/h2-proxy/lb"
+)
+
+var clusters = map[string]*cluster.Cluster{
+	"users":   {Name: "users"},
+	"orders":  {Name: "orders"},
+	"default": {Name: "default"},
+}
+
+func TestRoute(t *testing.T) {
+	cfg := &config.ProxyConfig{Routes: []*config.RouteConfig{
+		{Match: &config.RouteMatch{Service: "user.UserService", Method: "CreateUser"}, Cluster: "users"},
+		{Match: &config.RouteMatch{Service: "order.OrderService"}, Cluster: "orders"},
+		{Match: &config.RouteMatch{Regex: `/user\.UserService/(Get|List)User`}, Cluster: "users"},
+		{Match: &config.RouteMatch{Prefix: "/api/"}, Cluster: "default"},
+	}}
+
+	rt, err := NewRouter(cfg, clusters)
+	if err != nil {
+		t.Log("unexpected error creating router", err)
+		t.FailNow()
+	}
+
+	cases := map[string]string{
+		"/user.UserService/CreateUser":  "users",
+		"/user.UserService/GetUser":     "users",
+		"/user.UserService/ListUser":    "users",
+		"/order.OrderService/GetOrder":  "orders",
+		"/order.OrderServiceV2/GetItem": "",
+		"/user.UserService/DeleteUser":  "",
+		"/api/v1/users":                 "default",
+		"/other":                        "",
+	}
+
+	for path, expected := range cases {
+		req, _ := http.NewRequest(http.MethodPost, "http://localhost"+path, nil)
+		route := rt.Route(req)
+		if expected == "" {
+			assert.Nil(t, route, path)
+			continue
+		}
+
+		if assert.NotNil(t, route, path) {
+			assert.Equal(t, expected, route.PickCluster(req).Name, path)
+		}
+	}
+}
+
+func TestNewRouterErrors(t *testing.T) {
+	_, err := NewRouter(&config.ProxyConfig{Routes: []*config.RouteConfig{
+		{Match: &config.RouteMatch{Prefix: "/"}, Cluster: "unknown"},
+	}}, clusters)
+	assert.Error(t, err)
+
+	_, err = NewRouter(&config.ProxyConfig{Routes: []*config.RouteConfig{
+		{Match: &config.RouteMatch{Regex: "(unclosed"}, Cluster: "users"},
+	}}, clusters)
+	assert.Error(t, err)
+
+	_, err = NewRouter(&config.ProxyConfig{Routes: []*config.RouteConfig{
+		{Match: &config.RouteMatch{}, Cluster: "users"},
+	}}, clusters)
+	assert.Error(t, err)
+
+	// the descriptors need the global rate limit service
+	descriptors := []*config.RateLimitDescriptor{{Entries: []*config.DescriptorEntry{{Key: "a", Value: "b"}}}}
+	_, err = NewRouter(&config.ProxyConfig{Routes: []*config.RouteConfig{
+		{Match: &config.RouteMatch{Prefix: "/"}, Cluster: "users", RateLimitDescriptors: descriptors},
+	}}, clusters)
+	assert.Error(t, err)
+
+	_, err = NewRouter(&config.ProxyConfig{GlobalRateLimit: &config.GlobalRateLimitConfig{Cluster: "unknown"}}, clusters)
+	assert.Error(t, err)
+}
+
+func TestVirtualHosts(t *testing.T) {
+	toUsers := []*config.RouteConfig{{Match: &config.RouteMatch{Prefix: "/"}, Cluster: "users"}}
+	cfg := &config.ProxyConfig{
+		VirtualHosts: []*config.VirtualHostConfig{
+			{Name: "api", Domains: []string{"api.example.com"}, Routes: toUsers, PreserveHost: true},
+			{Name: "example", Domains: []string{"*.example.com"}, Routes: []*config.RouteConfig{{Match: &config.RouteMatch{Prefix: "/"}, Cluster: "orders"}}},
+			{Name: "internal", Domains: []string{"*.internal.example.com", "Internal"}, Routes: []*config.RouteConfig{{Match: &config.RouteMatch{Prefix: "/admin"}, Cluster: "default"}}},
+		},
+		Routes: []*config.RouteConfig{{Match: &config.RouteMatch{Prefix: "/"}, Cluster: "default"}},
+	}
+
+	rt, err := NewRouter(cfg, clusters)
+	if err != nil {
+		t.Log("unexpected error creating router", err)
+		t.FailNow()
+	}
+
+	cases := map[string]string{
+		"api.example.com":           "api",
+		"API.example.com:8443":      "api",
+		"www.example.com":           "example",
+		"a.b.example.com":           "example",
+		"grpc.internal.example.com": "internal",
+		"internal":                  "internal",
+		"example.com":               "",
+		"other.com":                 "",
+	}
+
+	for host, expected := range cases {
+		vh := rt.VirtualHost(host)
+		if assert.NotNil(t, vh, host) {
+			assert.Equal(t, expected, vh.Name, host)
+		}
+	}
+
+	req, _ := http.NewRequest(http.MethodPost, "http://api.example.com/user.UserService/GetUser", nil)
+	route := rt.Route(req)
+	if assert.NotNil(t, route) {
+		assert.Equal(t, "users", route.PickCluster(req).Name)
+		assert.True(t, route.VirtualHost.PreserveHost)
+	}
+
+	// routes are not shared across virtual hosts
+	req, _ = http.NewRequest(http.MethodPost, "http://grpc.internal.example.com/user.UserService/GetUser", nil)
+	assert.Nil(t, rt.Route(req))
+
+	// * takes precedence over the top level routes
+	cfg.VirtualHosts = append(cfg.VirtualHosts, &config.VirtualHostConfig{Name: "any", Domains: []string{"*"}, Routes: toUsers})
+	if rt, err = NewRouter(cfg, clusters); err != nil {
+		t.Log("unexpected error creating router", err)
+		t.FailNow()
+	}
+	assert.Equal(t, "any", rt.VirtualHost("other.com").Name)
+
+	// without top level routes nor * unknown hosts are not routed
+	cfg.VirtualHosts = cfg.VirtualHosts[:1]
+	cfg.Routes = nil
+	if rt, err = NewRouter(cfg, clusters); err != nil {
+		t.Log("unexpected error creating router", err)
+		t.FailNow()
+	}
+	assert.Nil(t, rt.VirtualHost("other.com"))
+
+	req, _ = http.NewRequest(http.MethodPost, "http://other.com/", nil)
+	assert.Nil(t, rt.Route(req))
+
+	cfg.VirtualHosts[0].Routes = []*config.RouteConfig{{Match: &config.RouteMatch{Prefix: "/"}, Cluster: "unknown"}}
+	_, err = NewRouter(cfg, clusters)
+	assert.Error(t, err)
+}
+
+func TestWeightedClusters(t *testing.T) {
+	cfg := &config.ProxyConfig{Routes: []*config.RouteConfig{
+		{Match: &config.RouteMatch{Prefix: "/"}, WeightedClusters: []*config.WeightedCluster{
+			{Name: "users", Weight: 90},
+			{Name: "orders", Weight: 10},
+		}},
+	}}
+
+	rt, err := NewRouter(cfg, clusters)
+	if err != nil {
+		t.Log("unexpected error creating router", err)
+		t.FailNow()
+	}
+
+	req, _ := http.NewRequest(http.MethodPost, "http://localhost/user.UserService/GetUser", nil)
+	route := rt.Route(req)
+	if route == nil {
+		t.Log("expecting route")
+		t.FailNow()
+	}
+
+	picked := map[string]int{}
+	for i := 0; i < 10000; i++ {
+		picked[route.PickCluster(req).Name]++
+	}
+
+	assert.InDelta(t, 9000, picked["users"], 300)
+	assert.InDelta(t, 1000, picked["orders"], 300)
+
+	_, err = NewRouter(&config.ProxyConfig{Routes: []*config.RouteConfig{
+		{Match: &config.RouteMatch{Prefix: "/"}, WeightedClusters: []*config.WeightedCluster{{Name: "unknown", Weight: 1}}},
+	}}, clusters)
+	assert.Error(t, err)
+}
+
+func TestWeightedClustersHashPolicy(t *testing.T) {
+	cfg := &config.ProxyConfig{Routes: []*config.RouteConfig{
+		{
+			Match:            &config.RouteMatch{Prefix: "/"},
+			WeightedClusters: []*config.WeightedCluster{{Name: "users", Weight: 50}, {Name: "orders", Weight: 50}},
+			HashPolicy:       &config.HashPolicy{Header: "x-user-id"},
+		},
+	}}
+
+	rt, err := NewRouter(cfg, clusters)
+	if err != nil {
+		t.Log("unexpected error creating router", err)
+		t.FailNow()
+	}
+
+	picked := map[string]bool{}
+	for i := 0; i < 100; i++ {
+		req, _ := http.NewRequest(http.MethodPost, "http://localhost/user.UserService/GetUser", nil)
+		req.Header.Set("x-user-id", fmt.Sprintf("user-%d", i))
+		route := rt.Route(req)
+
+		// the same user always goes to the same cluster
+		c := route.PickCluster(req)
+		for j := 0; j < 10; j++ {
+			assert.Equal(t, c.Name, route.PickCluster(req).Name)
+		}
+		picked[c.Name] = true
+	}
+
+	assert.True(t, picked["users"])
+	assert.True(t, picked["orders"])
+}
+
+func TestMirrorCluster(t *testing.T) {
+	cfg := &config.ProxyConfig{Routes: []*config.RouteConfig{
+		{Match: &config.RouteMatch{Prefix: "/users"}, Cluster: "users", Mirror: &config.MirrorPolicy{Cluster: "orders", Percentage: 100}},
+		{Match: &config.RouteMatch{Prefix: "/sampled"}, Cluster: "users", Mirror: &config.MirrorPolicy{Cluster: "orders", Percentage: 10}},
+		{Match: &config.RouteMatch{Prefix: "/"}, Cluster: "users"},
+	}}
+
+	rt, err := NewRouter(cfg, clusters)
+	if err != nil {
+		t.Log("unexpected error creating router", err)
+		t.FailNow()
+	}
+
+	req, _ := http.NewRequest(http.MethodPost, "http://localhost/users", nil)
+	if c := rt.Route(req).MirrorCluster(); assert.NotNil(t, c) {
+		assert.Equal(t, "orders", c.Name)
+	}
+
+	req, _ = http.NewRequest(http.MethodPost, "http://localhost/other", nil)
+	assert.Nil(t, rt.Route(req).MirrorCluster())
+
+	req, _ = http.NewRequest(http.MethodPost, "http://localhost/sampled", nil)
+	var mirrored int
+	for i := 0; i < 10000; i++ {
+		if rt.Route(req).MirrorCluster() != nil {
+			mirrored++
+		}
+	}
+	assert.InDelta(t, 1000, mirrored, 200)
+
+	cfg.Routes[0].Mirror.Cluster = "unknown"
+	_, err = NewRouter(cfg, clusters)
+	assert.Error(t, err)
+}
+
+func TestRouteSubset(t *testing.T) {
+	cfg := &config.ProxyConfig{Routes: []*config.RouteConfig{
+		{Match: &config.RouteMatch{Prefix: "/users"}, Cluster: "users", Subset: &config.SubsetPolicy{
+			Headers:  map[string]string{"x-version": "version", "x-shard": "shard"},
+			Fallback: "no_fallback",
+		}},
+		{Match: &config.RouteMatch{Prefix: "/"}, Cluster: "users"},
+	}}
+
+	rt, err := NewRouter(cfg, clusters)
+	if err != nil {
+		t.Log("unexpected error creating router", err)
+		t.FailNow()
+	}
+
+	req, _ := http.NewRequest(http.MethodPost, "http://localhost/users", nil)
+	req.Header.Set("x-version", "v2")
+	if s := rt.Route(req).Subset(req); assert.NotNil(t, s) {
+		assert.Equal(t, map[string]string{"version": "v2"}, s.Metadata)
+		assert.Equal(t, lb.NoFallback, s.Fallback)
+	}
+
+	req, _ = http.NewRequest(http.MethodPost, "http://localhost/other", nil)
+	req.Header.Set("x-version", "v2")
+	assert.Nil(t, rt.Route(req).Subset(req))
+}